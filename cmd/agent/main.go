@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Solmorn/Distributed-calculations/internal/agent"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+)
+
+func main() {
+	var cfg agent.Config
+	flag.StringVar(&cfg.ID, "id", pkg.GetEnvString("AGENT_ID", ""), "agent identifier, generated from the hostname if empty")
+	flag.StringVar(&cfg.OrchestratorAddr, "orchestrator", pkg.GetEnvString("ORCHESTRATOR_ADDR", "localhost:50051"), "gRPC address of the orchestrator")
+	flag.IntVar(&cfg.Workers, "workers", pkg.GetEnvInt("COMPUTING_POWER", 3), "number of worker goroutines")
+	flag.BoolVar(&cfg.TLS, "tls", pkg.GetEnvBool("GRPC_TLS", false), "connect to the orchestrator over TLS")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", pkg.GetEnvString("GRPC_TLS_CA", ""), "CA to verify the orchestrator certificate, enables TLS")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", pkg.GetEnvString("GRPC_TLS_CERT", ""), "client certificate for mutual TLS")
+	flag.StringVar(&cfg.TLSKey, "tls-key", pkg.GetEnvString("GRPC_TLS_KEY", ""), "private key of the client certificate")
+	flag.StringVar(&cfg.TLSServerName, "tls-server-name", pkg.GetEnvString("GRPC_TLS_SERVER_NAME", ""), "expected name in the orchestrator certificate")
+	ops := flag.String("operations", pkg.GetEnvString("AGENT_OPERATIONS", ""), "comma-separated operations the agent accepts, all supported if empty")
+	flag.StringVar(&cfg.Token, "token", pkg.GetEnvString("AGENT_TOKEN", ""), "agent token issued by an administrator")
+	flag.BoolVar(&cfg.InsecureToken, "insecure-token", pkg.GetEnvBool("AGENT_INSECURE_TOKEN", false), "send the token without TLS")
+	flag.Parse()
+
+	for _, op := range strings.Split(*ops, ",") {
+		if op = strings.TrimSpace(op); op != "" {
+			cfg.Operations = append(cfg.Operations, op)
+		}
+	}
+
+	if cfg.Workers <= 0 {
+		log.Fatalf("Number of workers must be positive, got %d", cfg.Workers)
+	}
+
+	agent.StartAgent(cfg)
+	log.Printf("Agent started with %d workers, orchestrator %s", cfg.Workers, cfg.OrchestratorAddr)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	log.Println("Dead signal has been received, stopping agent...")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"github.com/Solmorn/Distributed-calculations/internal/orch"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+)
+
+func main() {
+	var cfg orch.Config
+	flag.StringVar(&cfg.HTTPAddr, "http-addr", pkg.GetEnvString("HTTP_ADDR", ":8080"), "address of the REST API")
+	flag.StringVar(&cfg.GRPCAddr, "grpc-addr", pkg.GetEnvString("GRPC_ADDR", ":50051"), "address of the gRPC server for agents")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", pkg.GetEnvString("GRPC_TLS_CERT", ""), "server certificate for the gRPC server, enables TLS")
+	flag.StringVar(&cfg.TLSKey, "tls-key", pkg.GetEnvString("GRPC_TLS_KEY", ""), "private key of the server certificate")
+	flag.StringVar(&cfg.TLSClientCA, "tls-client-ca", pkg.GetEnvString("GRPC_TLS_CLIENT_CA", ""), "CA for agent certificates, enables mutual TLS")
+	flag.BoolVar(&cfg.RequireAgentAuth, "agent-auth", pkg.GetEnvBool("AGENT_AUTH_REQUIRED", false), "require agent tokens on the gRPC server")
+	flag.Parse()
+
+	database := db.GetInstance()
+	defer func() {
+		if err := database.Close(); err != nil {
+			log.Printf("Error close bd: %v", err)
+		}
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Println("Dead signal has been received, close bd...")
+		if err := database.Close(); err != nil {
+			log.Printf("Error close bd: %v", err)
+		}
+		os.Exit(0)
+	}()
+
+	orch.RunOrchestrator(cfg)
+}
@@ -2,34 +2,221 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"log"
+	"os"
 	"time"
 
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
 	"github.com/Solmorn/Distributed-calculations/pkg"
 	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
-func StartAgent() {
-	computingPower := pkg.GetEnvInt("COMPUTING_POWER", 3)
-	for i := 0; i < computingPower; i++ {
-		go worker(i)
-	}
+// Config — настройки агента
+type Config struct {
+	ID               string // идентификатор агента; если пуст, берётся из токена или сертификата, а без них генерируется
+	OrchestratorAddr string // gRPC адрес оркестратора
+	Workers          int    // количество рабочих горутин
+
+	// Operations — операции, которые агент берёт на себя; если пусто, все поддерживаемые
+	Operations []string
+
+	// TLS для соединения с оркестратором; включается флагом TLS или заданным TLSCA.
+	// TLSCert и TLSKey — клиентский сертификат, если оркестратор требует mTLS.
+	TLS           bool
+	TLSCA         string
+	TLSCert       string
+	TLSKey        string
+	TLSServerName string
+
+	// Token — токен агента, выданный администратором, если оркестратор их требует.
+	// Без TLS токен не отправляется, если не задан InsecureToken.
+	Token         string
+	InsecureToken bool
 }
 
-func worker(id int) {
-	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+func StartAgent(cfg Config) {
+	identity, err := credentialsID(cfg)
+	if err != nil {
+		log.Fatalf("Agent failed to read its credentials: %v", err)
+	}
+	switch {
+	case cfg.ID == "" && identity != "":
+		cfg.ID = identity
+	case cfg.ID == "":
+		cfg.ID = newAgentID()
+	case identity != "" && cfg.ID != identity:
+		log.Printf("Agent %s: an orchestrator checking credentials accepts only id %q", cfg.ID, identity)
+	}
+	if len(cfg.Operations) == 0 {
+		cfg.Operations = OperationNames()
+	}
+	for _, op := range cfg.Operations {
+		if _, ok := LookupOperation(op); !ok {
+			log.Fatalf("Agent %s does not support operation %q", cfg.ID, op)
+		}
+	}
+
+	creds, err := transportCredentials(cfg)
+	if err != nil {
+		log.Fatalf("Agent %s failed to configure TLS: %v", cfg.ID, err)
+	}
 
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if cfg.Token != "" {
+		if creds.Info().SecurityProtocol != "tls" && !cfg.InsecureToken {
+			log.Fatalf("Agent %s refuses to send its token without TLS; enable TLS or set --insecure-token", cfg.ID)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{
+			token:    cfg.Token,
+			insecure: cfg.InsecureToken,
+		}))
+	}
+
+	conn, err := grpc.Dial(cfg.OrchestratorAddr, opts...)
 	if err != nil {
-		log.Fatalf("Worker %d failed to connect: %v", id, err)
+		log.Fatalf("Agent %s failed to connect: %v", cfg.ID, err)
 	}
-	defer conn.Close()
 
 	client := pb.NewTaskServiceClient(conn)
 
+	// задачи берутся только после регистрации: до неё оркестратор не знает,
+	// какие операции умеет агент, и может выдать ему чужую
+	registered := make(chan struct{})
+	go keepAlive(client, cfg, registered)
+	go func() {
+		<-registered
+		receiveTasks(client, cfg)
+	}()
+}
+
+func transportCredentials(cfg Config) (credentials.TransportCredentials, error) {
+	if !cfg.TLS && cfg.TLSCA == "" && cfg.TLSCert == "" {
+		return insecure.NewCredentials(), nil
+	}
+
+	tlsConfig, err := pkg.ClientTLSConfig(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey, cfg.TLSServerName)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// tokenCredentials добавляет токен агента к каждому вызову
+type tokenCredentials struct {
+	token    string
+	insecure bool
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return !c.insecure
+}
+
+// credentialsID возвращает идентификатор, под которым оркестратор знает агента по токену,
+// а без токена — по клиентскому сертификату. Пустая строка, если нет ни того, ни другого.
+func credentialsID(cfg Config) (string, error) {
+	if cfg.Token != "" {
+		return auth.AgentTokenID(cfg.Token)
+	}
+	if cfg.TLSCert == "" {
+		return "", nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return "", err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return leaf.Subject.CommonName, nil
+}
+
+// newAgentID собирает идентификатор из имени хоста и случайного суффикса,
+// чтобы несколько агентов на одной машине не путались
+func newAgentID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "agent"
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
+
+// keepAlive регистрирует агента и присылает heartbeat.
+// Если оркестратор агента не знает (перезапуск или признал мёртвым), агент регистрируется заново.
+// ready закрывается после первой успешной регистрации.
+func keepAlive(client pb.TaskServiceClient, cfg Config, ready chan<- struct{}) {
+	hostname, _ := os.Hostname()
+	info := &pb.AgentInfo{
+		AgentId:    cfg.ID,
+		Hostname:   hostname,
+		Workers:    int32(cfg.Workers),
+		Operations: cfg.Operations,
+	}
+
+	registered := false
+	interval := time.Second
+	for {
+		var resp *pb.AgentResponse
+		var err error
+		if registered {
+			resp, err = client.Heartbeat(context.Background(), &pb.AgentHeartbeat{AgentId: cfg.ID})
+		} else {
+			resp, err = client.RegisterAgent(context.Background(), info)
+		}
+
+		switch {
+		case status.Code(err) == codes.Unimplemented:
+			// старый оркестратор не регистрирует агентов: задачи можно брать сразу
+			log.Printf("Agent %s: orchestrator does not support registration", cfg.ID)
+			if ready != nil {
+				close(ready)
+			}
+			return
+		case err != nil:
+			log.Printf("Agent %s error reaching orchestrator: %v", cfg.ID, err)
+		case !resp.Success:
+			if registered {
+				log.Printf("Agent %s is unknown to orchestrator, registering again", cfg.ID)
+			}
+			registered = false
+		default:
+			if !registered {
+				log.Printf("Agent %s registered", cfg.ID)
+			}
+			if ready != nil {
+				close(ready)
+				ready = nil
+			}
+			registered = true
+			if resp.HeartbeatMs > 0 {
+				interval = time.Duration(resp.HeartbeatMs) * time.Millisecond
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func worker(id int, client pb.TaskServiceClient, agentID string) {
 	for {
-		task, err := client.GetTask(context.Background(), &pb.TaskRequest{})
+		task, err := client.GetTask(context.Background(), &pb.TaskRequest{AgentId: agentID})
 		if err != nil {
 			log.Printf("Worker %d error getting task: %v", id, err)
 			time.Sleep(1 * time.Second)
@@ -41,33 +228,72 @@ func worker(id int) {
 		}
 		log.Printf("Worker %d received task: %+v", id, task)
 
-		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
-		result := compute(task.Arg1, task.Arg2, task.Operation)
-		_, err = client.SendTaskResult(context.Background(), &pb.TaskResult{
-			Id:     task.Id,
-			Result: result,
-		})
+		if !process(client, task, agentID, nil) {
+			log.Printf("Worker %d dropped task %d: lease lost", id, task.Id)
+			continue
+		}
+
+		result := execute(task, agentID)
+		_, err = client.SendTaskResult(context.Background(), result)
 
 		if err != nil {
 			log.Printf("Worker %d error sending result: %v", id, err)
+		} else if result.Error != "" {
+			log.Printf("Worker %d failed task %d: %s", id, task.Id, result.Error)
 		} else {
-			log.Printf("Worker %d completed task %d with result %f", id, task.Id, result)
+			log.Printf("Worker %d completed task %d with result %f", id, task.Id, result.Result)
 		}
 	}
 }
 
-func compute(arg1, arg2 float64, op string) float64 {
-	switch op {
-	case "+":
-		return arg1 + arg2
-	case "-":
-		return arg1 - arg2
-	case "*":
-		return arg1 * arg2
-	case "/":
-		if arg2 != 0 {
-			return arg1 / arg2
+// process ждёт время выполнения операции, продлевая аренду задачи.
+// Возвращает false, если оркестратор отказал в продлении или отменил задачу через cancelled
+// и задачу нужно бросить.
+func process(client pb.TaskServiceClient, task *pb.Task, agentID string, cancelled <-chan struct{}) bool {
+	done := time.After(time.Duration(task.OperationTime) * time.Millisecond)
+
+	// без аренды продлевать нечего
+	var extend <-chan time.Time
+	if task.LeaseMs > 0 {
+		ticker := time.NewTicker(time.Duration(task.LeaseMs) * time.Millisecond / 2)
+		defer ticker.Stop()
+		extend = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return true
+		case <-cancelled:
+			return false
+		case <-extend:
+			resp, err := client.ExtendLease(context.Background(), &pb.TaskLease{Id: task.Id, AgentId: agentID})
+			if err != nil {
+				log.Printf("Error extending lease of task %d: %v", task.Id, err)
+				continue
+			}
+			if !resp.Success {
+				return false
+			}
 		}
 	}
-	return 0
+}
+
+// execute выполняет задачу; если операция не удалась, ошибка передаётся оркестратору в результате
+func execute(task *pb.Task, agentID string) *pb.TaskResult {
+	result := &pb.TaskResult{Id: task.Id, AgentId: agentID}
+
+	// старый оркестратор присылает только arg1 и arg2
+	args := task.Args
+	if len(args) == 0 {
+		args = []float64{task.Arg1, task.Arg2}
+	}
+
+	value, err := compute(task.Operation, args)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Result = value
+	}
+	return result
 }
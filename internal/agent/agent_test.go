@@ -1,6 +1,9 @@
 package agent
 
 import (
+	"math"
+	"os"
+	"slices"
 	"testing"
 )
 
@@ -13,27 +16,138 @@ func TestCompute(t *testing.T) {
 		arg2     float64
 		op       string
 		expected float64
+		fails    bool
 	}{
-		{"Addition", 5.0, 3.0, "+", 8.0},
-		{"Subtraction", 5.0, 3.0, "-", 2.0},
-		{"Multiplication", 5.0, 3.0, "*", 15.0},
-		{"Division", 15.0, 3.0, "/", 5.0},
-		{"Division by zero", 5.0, 0.0, "/", 0.0},
-		{"Invalid operation", 5.0, 3.0, "?", 0.0},
+		{"Addition", 5.0, 3.0, "+", 8.0, false},
+		{"Subtraction", 5.0, 3.0, "-", 2.0, false},
+		{"Multiplication", 5.0, 3.0, "*", 15.0, false},
+		{"Division", 15.0, 3.0, "/", 5.0, false},
+		{"Division by zero", 5.0, 0.0, "/", 0.0, true},
+		{"Multiplication overflow", 1e308, 10.0, "*", 0.0, true},
+		{"Addition overflow", 1e308, 1e308, "+", 0.0, true},
+		{"Division overflow", 1.0, 1e-320, "/", 0.0, true},
+		{"Power", 2.0, 10.0, "^", 1024.0, false},
+		{"Negative exponent", 2.0, -1.0, "^", 0.5, false},
+		{"Root of negative number", -8.0, 1.0 / 3, "^", 0.0, true},
+		{"Integer division", 7.0, 2.0, "//", 3.0, false},
+		{"Integer division rounds down", -7.0, 2.0, "//", -4.0, false},
+		{"Integer division by zero", 7.0, 0.0, "//", 0.0, true},
+		{"Modulo", 7.0, 3.0, "%", 1.0, false},
+		{"Modulo follows divisor sign", -7.0, 3.0, "%", 2.0, false},
+		{"Modulo of fractions", 5.5, 2.0, "%", 1.5, false},
+		{"Modulo by zero", 7.0, 0.0, "%", 0.0, true},
+		{"Invalid operation", 5.0, 3.0, "?", 0.0, true},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := compute(tc.arg1, tc.arg2, tc.op)
-			if result != tc.expected {
-				t.Errorf("%s: Expected %f, got %f", tc.name, tc.expected, result)
+			result, err := compute(tc.op, []float64{tc.arg1, tc.arg2})
+			if tc.fails {
+				if err == nil {
+					t.Errorf("%s: Expected an error, got %f", tc.name, result)
+				}
+				return
+			}
+			if err != nil || result != tc.expected {
+				t.Errorf("%s: Expected %f, got %f (%v)", tc.name, tc.expected, result, err)
 			}
 		})
 	}
 }
 
+func TestOperationRegistry(t *testing.T) {
+	if _, ok := LookupOperation("hypot"); ok {
+		t.Fatal("Operation hypot should not be registered yet")
+	}
+
+	RegisterOperation(&builtin{
+		name: "hypot", min: 2, max: 2, timeEnv: "TIME_TEST_HYPOT_MS", timeMs: 50,
+		apply: func(args []float64) (float64, error) { return math.Hypot(args[0], args[1]), nil },
+	})
+	defer func() {
+		operationsMu.Lock()
+		delete(registry, "hypot")
+		operationsMu.Unlock()
+	}()
+
+	op, ok := LookupOperation("hypot")
+	if !ok || op.Cost() != 50 {
+		t.Fatalf("Registered operation not found or has wrong cost")
+	}
+	if !slices.Contains(OperationNames(), "hypot") {
+		t.Error("Registered operation is missing from the names")
+	}
+	if result, err := compute("hypot", []float64{3, 4}); err != nil || result != 5 {
+		t.Errorf("Expected 5, got %f (%v)", result, err)
+	}
+	if _, err := compute("hypot", []float64{2}); err == nil {
+		t.Error("Wrong number of arguments should be rejected")
+	}
+
+	os.Setenv("TIME_TEST_HYPOT_MS", "75")
+	defer os.Unsetenv("TIME_TEST_HYPOT_MS")
+	if op.Cost() != 75 {
+		t.Errorf("Cost should follow the environment, got %d", op.Cost())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering an operation twice should panic")
+		}
+	}()
+	RegisterOperation(op)
+}
+
+func TestFunctions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		args     []float64
+		expected float64
+		fails    bool
+	}{
+		{"sqrt", []float64{16}, 4, false},
+		{"sqrt", []float64{-1}, 0, true},
+		{"abs", []float64{-2.5}, 2.5, false},
+		{"min", []float64{3, -1, 2}, -1, false},
+		{"max", []float64{3, -1, 2, 7}, 7, false},
+		{"max", nil, 0, true},
+		{"log", []float64{1000}, 3, false},
+		{"log", []float64{8, 2}, 3, false},
+		{"log", []float64{0}, 0, true},
+		{"ln", []float64{1}, 0, false},
+		{"exp", []float64{0}, 1, false},
+		{"sin", []float64{0}, 0, false},
+		{"cos", []float64{0}, 1, false},
+		{"tan", []float64{0}, 0, false},
+		{"floor", []float64{-1.5}, -2, false},
+		{"ceil", []float64{1.2}, 2, false},
+		{"round", []float64{2.5}, 3, false},
+		{"round", []float64{3.14159, 2}, 3.14, false},
+		{"round", []float64{1234, -2}, 1200, false},
+		{"round", []float64{1, 0.5}, 0, true},
+		{"round", []float64{1.25, 400}, 1.25, false},
+		{"round", []float64{1e300, 10}, 1e300, false},
+		{"round", []float64{1234, -400}, 0, false},
+		{"round", []float64{math.Inf(1), 2}, 0, true},
+		{"round", []float64{1, 2, 3}, 0, true},
+	}
+
+	for _, tc := range testCases {
+		result, err := compute(tc.name, tc.args)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s%v: Expected an error, got %f", tc.name, tc.args, result)
+			}
+			continue
+		}
+		if err != nil || math.Abs(result-tc.expected) > 1e-9 {
+			t.Errorf("%s%v: Expected %f, got %f (%v)", tc.name, tc.args, tc.expected, result, err)
+		}
+	}
+}
+
 type TestExporter struct {
-	Compute func(arg1, arg2 float64, op string) float64
+	Compute func(name string, args []float64) (float64, error)
 }
 
 var TestExport = TestExporter{
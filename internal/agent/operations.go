@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Solmorn/Distributed-calculations/pkg"
+)
+
+var ErrDivisionByZero = errors.New("division by zero")
+
+// Operation — операция, которую агент выполняет как отдельную задачу.
+// Тот же реестр использует оркестратор, чтобы проверять выражения и узнавать время выполнения.
+type Operation interface {
+	Name() string
+	// Arity — допустимое число аргументов; max < 0 означает без ограничения
+	Arity() (min, max int)
+	// Cost — время выполнения операции в мс
+	Cost() int
+	Apply(args []float64) (float64, error)
+}
+
+var (
+	operationsMu sync.RWMutex
+	registry     = make(map[string]Operation)
+)
+
+// RegisterOperation добавляет операцию в реестр. Повторная регистрация имени — ошибка программы.
+func RegisterOperation(op Operation) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+
+	if _, dup := registry[op.Name()]; dup {
+		panic("agent: operation " + op.Name() + " registered twice")
+	}
+	registry[op.Name()] = op
+}
+
+func LookupOperation(name string) (Operation, bool) {
+	operationsMu.RLock()
+	defer operationsMu.RUnlock()
+
+	op, ok := registry[name]
+	return op, ok
+}
+
+// OperationNames возвращает имена всех зарегистрированных операций по порядку
+func OperationNames() []string {
+	operationsMu.RLock()
+	defer operationsMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckArity проверяет, что операция принимает n аргументов
+func CheckArity(op Operation, n int) error {
+	min, max := op.Arity()
+	if n < min || (max >= 0 && n > max) {
+		return fmt.Errorf("operation %s does not take %d arguments", op.Name(), n)
+	}
+	return nil
+}
+
+// builtin — встроенная операция; время выполнения можно переопределить переменной среды
+type builtin struct {
+	name     string
+	min, max int
+	timeEnv  string
+	timeMs   int
+	apply    func(args []float64) (float64, error)
+}
+
+func (b *builtin) Name() string                          { return b.name }
+func (b *builtin) Arity() (int, int)                     { return b.min, b.max }
+func (b *builtin) Cost() int                             { return pkg.GetEnvInt(b.timeEnv, b.timeMs) }
+func (b *builtin) Apply(args []float64) (float64, error) { return b.apply(args) }
+
+// binary — операция двух аргументов; переполнение и результаты вне действительных чисел
+// считаются ошибкой, иначе бесконечность попала бы в итог выражения
+func binary(name, timeEnv string, timeMs int, apply func(a, b float64) (float64, error)) *builtin {
+	return &builtin{
+		name:    name,
+		min:     2,
+		max:     2,
+		timeEnv: timeEnv,
+		timeMs:  timeMs,
+		apply: func(args []float64) (float64, error) {
+			result, err := apply(args[0], args[1])
+			if err != nil {
+				return 0, err
+			}
+			if math.IsNaN(result) || math.IsInf(result, 0) {
+				return 0, fmt.Errorf("%g %s %g is not a real number", args[0], name, args[1])
+			}
+			return result, nil
+		},
+	}
+}
+
+// function — функция выражения; время выполнения задаётся своей переменной, например TIME_SQRT_MS
+func function(name string, min, max int, apply func(args []float64) (float64, error)) *builtin {
+	return &builtin{
+		name:    name,
+		min:     min,
+		max:     max,
+		timeEnv: "TIME_" + strings.ToUpper(name) + "_MS",
+		timeMs:  functionTimeMs,
+		apply:   apply,
+	}
+}
+
+// unary — функция одного аргумента; результаты вне действительных чисел
+// (корень из отрицательного, логарифм нуля и т.п.) считаются ошибкой
+func unary(name string, f func(x float64) float64) *builtin {
+	return function(name, 1, 1, func(args []float64) (float64, error) {
+		result := f(args[0])
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return 0, fmt.Errorf("%s(%g) is not a real number", name, args[0])
+		}
+		return result, nil
+	})
+}
+
+// функции по умолчанию считаются столько же, сколько умножение
+const functionTimeMs = 200
+
+// roundTo округляет x до n знаков после запятой, половины — от нуля
+func roundTo(args []float64) (float64, error) {
+	if len(args) == 1 {
+		return math.Round(args[0]), nil
+	}
+
+	digits := args[1]
+	if digits != math.Trunc(digits) {
+		return 0, fmt.Errorf("round: number of digits must be an integer, got %g", digits)
+	}
+	x, scale := args[0], math.Pow(10, digits)
+	switch {
+	case scale == 0:
+		// разряд больше любого конечного числа
+		return 0, nil
+	case math.IsInf(x*scale, 0) && !math.IsInf(x, 0):
+		// у float64 нет столько знаков после запятой — округлять нечего
+		return x, nil
+	}
+
+	result := math.Round(x*scale) / scale
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, fmt.Errorf("round(%g, %g) is not a real number", x, digits)
+	}
+	return result, nil
+}
+
+// logarithm — десятичный логарифм, а с двумя аргументами — логарифм x по основанию base
+func logarithm(args []float64) (float64, error) {
+	x, base := args[0], 10.0
+	if len(args) == 2 {
+		base = args[1]
+	}
+	if x <= 0 || base <= 0 || base == 1 {
+		return 0, fmt.Errorf("log(%g) with base %g is not a real number", x, base)
+	}
+	return math.Log(x) / math.Log(base), nil
+}
+
+func extremum(pick func(a, b float64) float64) func(args []float64) (float64, error) {
+	return func(args []float64) (float64, error) {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = pick(result, arg)
+		}
+		return result, nil
+	}
+}
+
+func init() {
+	RegisterOperation(binary("+", "TIME_ADDITION_MS", 100, func(a, b float64) (float64, error) {
+		return a + b, nil
+	}))
+	RegisterOperation(binary("-", "TIME_SUBTRACTION_MS", 100, func(a, b float64) (float64, error) {
+		return a - b, nil
+	}))
+	RegisterOperation(binary("*", "TIME_MULTIPLICATIONS_MS", 200, func(a, b float64) (float64, error) {
+		return a * b, nil
+	}))
+	RegisterOperation(binary("/", "TIME_DIVISIONS_MS", 300, func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return a / b, nil
+	}))
+	RegisterOperation(binary("^", "TIME_POWER_MS", 300, func(a, b float64) (float64, error) {
+		return math.Pow(a, b), nil
+	}))
+	// целочисленное деление и остаток округляют вниз, поэтому a = b*(a//b) + a%b при любых знаках
+	RegisterOperation(binary("//", "TIME_INTEGER_DIVISIONS_MS", 300, func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Floor(a / b), nil
+	}))
+	RegisterOperation(binary("%", "TIME_MODULO_MS", 300, func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return a - b*math.Floor(a/b), nil
+	}))
+
+	RegisterOperation(unary("sqrt", math.Sqrt))
+	RegisterOperation(unary("abs", math.Abs))
+	RegisterOperation(unary("ln", math.Log))
+	RegisterOperation(unary("exp", math.Exp))
+	RegisterOperation(unary("sin", math.Sin))
+	RegisterOperation(unary("cos", math.Cos))
+	RegisterOperation(unary("tan", math.Tan))
+	RegisterOperation(unary("floor", math.Floor))
+	RegisterOperation(unary("ceil", math.Ceil))
+	RegisterOperation(function("log", 1, 2, logarithm))
+	RegisterOperation(function("round", 1, 2, roundTo))
+	RegisterOperation(function("min", 1, -1, extremum(math.Min)))
+	RegisterOperation(function("max", 1, -1, extremum(math.Max)))
+}
+
+// compute выполняет операцию задачи через реестр
+func compute(name string, args []float64) (float64, error) {
+	op, ok := LookupOperation(name)
+	if !ok {
+		return 0, fmt.Errorf("unsupported operation %q", name)
+	}
+	if err := CheckArity(op, len(args)); err != nil {
+		return 0, err
+	}
+	return op.Apply(args)
+}
@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// receiveTasks получает задачи через поток TaskStream и переподключается при обрыве.
+// Если оркестратор поток не поддерживает, рабочие опрашивают GetTask, как раньше.
+func receiveTasks(client pb.TaskServiceClient, cfg Config) {
+	for {
+		err := streamTasks(client, cfg)
+		if status.Code(err) == codes.Unimplemented {
+			log.Printf("Agent %s: orchestrator does not support task streaming, falling back to polling", cfg.ID)
+			for i := 0; i < cfg.Workers; i++ {
+				go worker(i, client, cfg.ID)
+			}
+			return
+		}
+
+		log.Printf("Agent %s task stream closed: %v", cfg.ID, err)
+		time.Sleep(time.Second)
+	}
+}
+
+func streamTasks(client pb.TaskServiceClient, cfg Config) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.TaskStream(ctx)
+	if err != nil {
+		return err
+	}
+
+	// писать в поток может только одна горутина
+	out := make(chan *pb.AgentMessage, 2*cfg.Workers+1)
+	out <- capacityMessage(cfg.ID, cfg.Workers)
+	go func() {
+		for {
+			select {
+			case msg := <-out:
+				if err := stream.Send(msg); err != nil {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	running := newRunningTasks()
+	tasks := make(chan *pb.Task)
+	for i := 0; i < cfg.Workers; i++ {
+		go streamWorker(ctx, i, client, cfg.ID, tasks, out, running)
+	}
+
+	for {
+		task, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		// отмена места не занимает: рабочий, считающий задачу, бросит её сам
+		if task.Cancelled {
+			running.cancel(task.Id)
+			continue
+		}
+
+		// отмена может прийти раньше, чем рабочий возьмёт задачу
+		running.add(task.Id)
+
+		// оркестратор присылает задачи только на объявленные свободные места,
+		// поэтому свободный рабочий найдётся
+		select {
+		case tasks <- task:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runningTasks — задачи, полученные из потока и ещё не досчитанные
+type runningTasks struct {
+	mu        sync.Mutex
+	cancelled map[int32]chan struct{}
+}
+
+func newRunningTasks() *runningTasks {
+	return &runningTasks{cancelled: make(map[int32]chan struct{})}
+}
+
+func (r *runningTasks) add(id int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cancelled[id] = make(chan struct{})
+}
+
+// done возвращает канал, который закроется при отмене задачи
+func (r *runningTasks) done(id int32) <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cancelled[id]
+}
+
+// cancel закрывает канал задачи. Запись остаётся до finish, чтобы рабочий,
+// ещё не взявший задачу, тоже увидел отмену.
+func (r *runningTasks) cancel(id int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ch, ok := r.cancelled[id]; ok {
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+}
+
+func (r *runningTasks) finish(id int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.cancelled, id)
+}
+
+func streamWorker(ctx context.Context, id int, client pb.TaskServiceClient, agentID string, tasks <-chan *pb.Task, out chan<- *pb.AgentMessage, running *runningTasks) {
+	for {
+		var task *pb.Task
+		select {
+		case task = <-tasks:
+		case <-ctx.Done():
+			return
+		}
+		log.Printf("Worker %d received task: %+v", id, task)
+
+		var msgs []*pb.AgentMessage
+		completed := process(client, task, agentID, running.done(task.Id))
+		running.finish(task.Id)
+		if completed {
+			result := execute(task, agentID)
+			msgs = append(msgs, &pb.AgentMessage{Payload: &pb.AgentMessage_Result{Result: result}})
+			if result.Error != "" {
+				log.Printf("Worker %d failed task %d: %s", id, task.Id, result.Error)
+			} else {
+				log.Printf("Worker %d completed task %d with result %f", id, task.Id, result.Result)
+			}
+		} else {
+			log.Printf("Worker %d dropped task %d: lease lost or task cancelled", id, task.Id)
+		}
+		msgs = append(msgs, capacityMessage(agentID, 1))
+
+		for _, msg := range msgs {
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				// поток оборвался, пока считали: результат отправляем обычным вызовом
+				if result := msg.GetResult(); result != nil {
+					if _, err := client.SendTaskResult(context.Background(), result); err != nil {
+						log.Printf("Worker %d error sending result: %v", id, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func capacityMessage(agentID string, free int) *pb.AgentMessage {
+	return &pb.AgentMessage{Payload: &pb.AgentMessage_Capacity{Capacity: &pb.AgentCapacity{
+		AgentId: agentID,
+		Free:    int32(free),
+	}}}
+}
@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// pollingServer — оркестратор без поддержки TaskStream
+type pollingServer struct {
+	pb.UnimplementedTaskServiceServer
+	mu      sync.Mutex
+	tasks   []*pb.Task
+	results chan *pb.TaskResult
+}
+
+func (s *pollingServer) GetTask(ctx context.Context, req *pb.TaskRequest) (*pb.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.tasks) == 0 {
+		return &pb.Task{HasTask: false}, nil
+	}
+	task := s.tasks[0]
+	s.tasks = s.tasks[1:]
+	return task, nil
+}
+
+func (s *pollingServer) SendTaskResult(ctx context.Context, result *pb.TaskResult) (*pb.TaskResponse, error) {
+	s.results <- result
+	return &pb.TaskResponse{Success: true}, nil
+}
+
+func TestReceiveTasksFallsBackToPolling(t *testing.T) {
+	fake := &pollingServer{
+		tasks:   []*pb.Task{{Id: 1, Arg1: 2, Arg2: 3, Operation: "*", HasTask: true}},
+		results: make(chan *pb.TaskResult, 1),
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterTaskServiceServer(server, fake)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	go receiveTasks(pb.NewTaskServiceClient(conn), Config{ID: "old-orchestrator", Workers: 1})
+
+	select {
+	case result := <-fake.results:
+		if result.Id != 1 || result.Result != 6 || result.AgentId != "old-orchestrator" {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Agent did not fall back to polling")
+	}
+}
+
+// cancellingServer выдаёт долгую задачу по потоку и сразу её отменяет
+type cancellingServer struct {
+	pb.UnimplementedTaskServiceServer
+	messages chan *pb.AgentMessage
+}
+
+func (s *cancellingServer) TaskStream(stream pb.TaskService_TaskStreamServer) error {
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+	stream.Send(&pb.Task{Id: 1, Args: []float64{2, 3}, Operation: "+", OperationTime: 60000, HasTask: true})
+	stream.Send(&pb.Task{Id: 1, Cancelled: true})
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		s.messages <- msg
+	}
+}
+
+func TestStreamedTaskCancelled(t *testing.T) {
+	fake := &cancellingServer{messages: make(chan *pb.AgentMessage, 4)}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterTaskServiceServer(server, fake)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	go streamTasks(pb.NewTaskServiceClient(conn), Config{ID: "cancelled-agent", Workers: 1})
+
+	// агент бросает задачу без результата и освобождает место
+	select {
+	case msg := <-fake.messages:
+		if msg.GetResult() != nil || msg.GetCapacity().GetFree() != 1 {
+			t.Errorf("Expected the worker to be freed, got %+v", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Agent did not drop the cancelled task")
+	}
+}
+
+// registeringServer отвечает на регистрацию, только когда тест разрешит
+type registeringServer struct {
+	pb.UnimplementedTaskServiceServer
+	allow chan struct{}
+}
+
+func (s *registeringServer) RegisterAgent(ctx context.Context, req *pb.AgentInfo) (*pb.AgentResponse, error) {
+	<-s.allow
+	return &pb.AgentResponse{Success: true, HeartbeatMs: 10}, nil
+}
+
+func (s *registeringServer) Heartbeat(ctx context.Context, req *pb.AgentHeartbeat) (*pb.AgentResponse, error) {
+	return &pb.AgentResponse{Success: true, HeartbeatMs: 10}, nil
+}
+
+func TestTasksWaitForRegistration(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		service pb.TaskServiceServer
+		allow   chan struct{}
+	}{
+		{"registration", nil, make(chan struct{})},
+		{"old orchestrator", &pollingServer{}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			service := tt.service
+			if service == nil {
+				service = &registeringServer{allow: tt.allow}
+			}
+
+			lis := bufconn.Listen(1 << 20)
+			server := grpc.NewServer()
+			pb.RegisterTaskServiceServer(server, service)
+			go server.Serve(lis)
+			defer server.Stop()
+
+			conn, err := grpc.NewClient("passthrough:///bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer conn.Close()
+
+			ready := make(chan struct{})
+			go keepAlive(pb.NewTaskServiceClient(conn), Config{ID: "registering", Workers: 1}, ready)
+
+			if tt.allow != nil {
+				select {
+				case <-ready:
+					t.Fatal("Agent is ready before the orchestrator registered it")
+				case <-time.After(50 * time.Millisecond):
+				}
+				close(tt.allow)
+			}
+
+			select {
+			case <-ready:
+			case <-time.After(3 * time.Second):
+				t.Fatal("Agent did not become ready")
+			}
+		})
+	}
+}
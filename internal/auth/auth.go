@@ -37,7 +37,8 @@ func CheckPasswordHash(password, hash string) bool {
 }
 
 type Claims struct {
-	UserID int `json:"user_id"`
+	UserID int    `json:"user_id"`
+	Role   string `json:"role,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -73,9 +74,65 @@ func ValidateToken(tokenString string) (int, error) {
 		return 0, errors.New("invalid token")
 	}
 
+	// токен агента не даёт доступа к API пользователей
+	if claims.Role != "" {
+		return 0, errors.New("invalid token role")
+	}
+
 	return claims.UserID, nil
 }
 
+const agentRole = "agent"
+
+// GenerateAgentToken выпускает токен агента. tokenID нужен, чтобы токен можно было отозвать;
+// при нулевом ttl токен не истекает.
+func GenerateAgentToken(tokenID, name string, ttl time.Duration) (string, error) {
+	claims := &Claims{
+		Role: agentRole,
+		StandardClaims: jwt.StandardClaims{
+			Id:      tokenID,
+			Subject: name,
+		},
+	}
+	if ttl > 0 {
+		claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+// ValidateAgentToken проверяет подпись и роль токена агента и возвращает его идентификатор
+func ValidateAgentToken(tokenString string) (string, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if !token.Valid || claims.Role != agentRole || claims.Id == "" {
+		return "", errors.New("invalid agent token")
+	}
+
+	return claims.Id, nil
+}
+
+// AgentTokenID читает идентификатор из токена агента без проверки подписи: агенту он нужен,
+// чтобы называться так же, как его знает оркестратор
+func AgentTokenID(tokenString string) (string, error) {
+	claims := &Claims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims); err != nil {
+		return "", err
+	}
+	if claims.Role != agentRole || claims.Id == "" {
+		return "", errors.New("invalid agent token")
+	}
+	return claims.Id, nil
+}
+
 func ExtractTokenFromRequest(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
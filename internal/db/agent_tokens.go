@@ -0,0 +1,136 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+func (d *Database) initAgentTokens() {
+	_, err := d.db.Exec(`
+	CREATE TABLE IF NOT EXISTS agent_tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_by INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER,
+		revoked_at INTEGER,
+		FOREIGN KEY (created_by) REFERENCES users(id)
+	)
+	`)
+	if err != nil {
+		log.Fatalf("Error make agent_tokens db: %v", err)
+	}
+}
+
+// CreateAgentToken запоминает выпущенный токен агента; нулевой expiresAt — бессрочный токен
+func (d *Database) CreateAgentToken(id, name string, createdBy int, createdAt, expiresAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var expires sql.NullInt64
+	if !expiresAt.IsZero() {
+		expires = sql.NullInt64{Int64: expiresAt.UnixMilli(), Valid: true}
+	}
+
+	_, err := d.db.Exec(
+		"INSERT INTO agent_tokens (id, name, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		id, name, createdBy, createdAt.UnixMilli(), expires,
+	)
+	return err
+}
+
+// RevokeAgentToken отзывает токен. Возвращает false, если токена нет или он уже отозван.
+func (d *Database) RevokeAgentToken(id string, now time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		"UPDATE agent_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL",
+		now.UnixMilli(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// IsAgentTokenActive сообщает, что токен выпущен, не отозван и не истёк
+func (d *Database) IsAgentTokenActive(id string, now time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var active bool
+	err := d.db.QueryRow(
+		`SELECT revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) FROM agent_tokens WHERE id = ?`,
+		now.UnixMilli(), id,
+	).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return active, nil
+}
+
+func (d *Database) GetAgentTokens() ([]struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query("SELECT id, name, created_at, expires_at, revoked_at FROM agent_tokens ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []struct {
+		ID        string
+		Name      string
+		CreatedAt time.Time
+		ExpiresAt *time.Time
+		RevokedAt *time.Time
+	}
+
+	for rows.Next() {
+		var token struct {
+			ID        string
+			Name      string
+			CreatedAt time.Time
+			ExpiresAt *time.Time
+			RevokedAt *time.Time
+		}
+		var createdAt int64
+		var expiresAt, revokedAt sql.NullInt64
+		if err := rows.Scan(&token.ID, &token.Name, &createdAt, &expiresAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		token.CreatedAt = time.UnixMilli(createdAt)
+		if expiresAt.Valid {
+			t := time.UnixMilli(expiresAt.Int64)
+			token.ExpiresAt = &t
+		}
+		if revokedAt.Valid {
+			t := time.UnixMilli(revokedAt.Int64)
+			token.RevokedAt = &t
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
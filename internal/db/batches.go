@@ -0,0 +1,112 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Пакет — выражения, принятые одним запросом; expressions.batch_id связывает их с пакетом
+func (d *Database) initBatches() {
+	d.addColumn("expressions", "batch_id", "INTEGER")
+
+	_, err := d.db.Exec(`
+	CREATE TABLE IF NOT EXISTS batches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS expressions_batch ON expressions (batch_id)
+	`)
+	if err != nil {
+		log.Fatalf("Error make batches db: %v", err)
+	}
+}
+
+// SaveBatch сохраняет пакет и все его выражения в одной транзакции.
+// Выражения получают ID подряд; возвращаются ID пакета и выражений.
+func (d *Database) SaveBatch(userID int, expressions []NewExpression, now time.Time) (int, []int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO batches (user_id, created_at) VALUES (?, ?)", userID, now.UnixMilli())
+	if err != nil {
+		return 0, nil, err
+	}
+	batchID, err := res.LastInsertId()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var lastID int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM expressions").Scan(&lastID); err != nil {
+		return 0, nil, err
+	}
+
+	ids := make([]int, len(expressions))
+	for i, e := range expressions {
+		ids[i] = lastID + 1 + i
+		if err := insertExpression(tx, ids[i], userID, e, sql.NullInt64{Int64: batchID, Valid: true}); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return int(batchID), ids, nil
+}
+
+// GetBatch возвращает пакет пользователя и его выражения по порядку; sql.ErrNoRows, если пакета нет
+func (d *Database) GetBatch(id int, userID int) (struct {
+	CreatedAt   time.Time
+	Expressions []struct {
+		ID     int
+		Status string
+	}
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var batch struct {
+		CreatedAt   time.Time
+		Expressions []struct {
+			ID     int
+			Status string
+		}
+	}
+
+	var createdAt int64
+	err := d.db.QueryRow("SELECT created_at FROM batches WHERE id = ? AND user_id = ?", id, userID).Scan(&createdAt)
+	if err != nil {
+		return batch, err
+	}
+	batch.CreatedAt = time.UnixMilli(createdAt)
+
+	rows, err := d.db.Query("SELECT id, status FROM expressions WHERE batch_id = ? ORDER BY id", id)
+	if err != nil {
+		return batch, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var exp struct {
+			ID     int
+			Status string
+		}
+		if err := rows.Scan(&exp.ID, &exp.Status); err != nil {
+			return batch, err
+		}
+		batch.Expressions = append(batch.Expressions, exp)
+	}
+
+	return batch, rows.Err()
+}
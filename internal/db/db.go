@@ -2,8 +2,12 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -59,6 +63,80 @@ func (d *Database) initDB() {
 	if err != nil {
 		log.Fatalf("Error make tasks db: %v", err)
 	}
+
+	// аренда задачи агентом: срок в мс unix-времени и число выдач
+	d.addColumn("tasks", "lease_deadline", "INTEGER")
+	d.addColumn("tasks", "attempts", "INTEGER NOT NULL DEFAULT 0")
+
+	// номер узла в графе выражения, по нему вычисление восстанавливается после перезапуска
+	d.addColumn("tasks", "node", "INTEGER NOT NULL DEFAULT -1")
+
+	// агент, которому выдана задача
+	d.addColumn("tasks", "agent_id", "TEXT")
+
+	// все аргументы операции в JSON; arg1 и arg2 остаются для задач, сохранённых до этого
+	d.addColumn("tasks", "args", "TEXT")
+
+	d.initReplicas()
+	d.initVariables()
+	d.initWebhooks()
+	d.initAgentTokens()
+	d.initSheets()
+	d.initBatches()
+	d.initIdempotency()
+}
+
+// encodeArgs раскладывает аргументы по колонкам: первые два отдельно, все вместе в JSON
+func encodeArgs(args []float64) (float64, float64, string) {
+	var arg1, arg2 float64
+	if len(args) > 0 {
+		arg1 = args[0]
+	}
+	if len(args) > 1 {
+		arg2 = args[1]
+	}
+	encoded, _ := json.Marshal(args)
+	return arg1, arg2, string(encoded)
+}
+
+func decodeArgs(arg1, arg2 float64, encoded sql.NullString) []float64 {
+	var args []float64
+	if encoded.Valid && json.Unmarshal([]byte(encoded.String), &args) == nil {
+		return args
+	}
+	return []float64{arg1, arg2}
+}
+
+// addColumn добавляет колонку в уже существующую таблицу, если её там ещё нет
+func (d *Database) addColumn(table, column, definition string) {
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		log.Fatalf("Error reading %s columns: %v", table, err)
+	}
+
+	exists := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			log.Fatalf("Error reading %s columns: %v", table, err)
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	rows.Close()
+
+	if exists {
+		return
+	}
+
+	_, err = d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		log.Fatalf("Error adding %s.%s column: %v", table, column, err)
+	}
 }
 
 func (d *Database) CreateUser(login, hashedPassword string) (int, error) {
@@ -97,6 +175,18 @@ func (d *Database) GetUserByLogin(login string) (int, string, error) {
 	return id, password, nil
 }
 
+func (d *Database) GetUserLogin(userID int) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var login string
+	err := d.db.QueryRow("SELECT login FROM users WHERE id = ?", userID).Scan(&login)
+	if err != nil {
+		return "", err
+	}
+	return login, nil
+}
+
 func GetInstance() *Database {
 	once.Do(func() {
 		db, err := sql.Open("sqlite3", "./calculator.db")
@@ -146,6 +236,82 @@ func (d *Database) SaveExpression(id int, userID int, expression string, status
 	return err
 }
 
+// NewExpression — выражение с уже подставленными значениями имён, готовое к сохранению
+type NewExpression struct {
+	Expression  string
+	Replicas    int
+	Variables   map[string]float64
+	Label       string
+	DependsOn   []int
+	CallbackURL string
+}
+
+// CreateExpression сохраняет выражение в обработке, его уведомление и ключ идемпотентности
+// в одной транзакции. Выражение получает следующий свободный ID, он и возвращается.
+// Без ключа idempotencyKey пуст.
+func (d *Database) CreateExpression(userID int, e NewExpression, idempotencyKey, fingerprint string, now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var lastID int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM expressions").Scan(&lastID); err != nil {
+		return 0, err
+	}
+
+	id := lastID + 1
+	if err := insertExpression(tx, id, userID, e, sql.NullInt64{}); err != nil {
+		return 0, err
+	}
+
+	if idempotencyKey != "" {
+		_, err = tx.Exec(upsertIdempotencyKey, userID, idempotencyKey, fingerprint, id, now.UnixMilli())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// insertExpression добавляет выражение в обработке и его уведомление внутри транзакции
+func insertExpression(tx *sql.Tx, id int, userID int, e NewExpression, batchID sql.NullInt64) error {
+	var variables sql.NullString
+	if len(e.Variables) > 0 {
+		encoded, err := json.Marshal(e.Variables)
+		if err != nil {
+			return err
+		}
+		variables = sql.NullString{String: string(encoded), Valid: true}
+	}
+	label, dependsOn, err := encodeLineage(e.Label, e.DependsOn)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO expressions (id, user_id, expression, status, result, replicas, variables, label, depends_on, batch_id)
+		VALUES (?, ?, ?, 'processing', 0, ?, ?, ?, ?, ?)`,
+		id, userID, e.Expression, max(e.Replicas, 1), variables, label, dependsOn, batchID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if e.CallbackURL != "" {
+		_, err = tx.Exec("INSERT INTO webhooks (expression_id, url) VALUES (?, ?)", id, e.CallbackURL)
+	}
+	return err
+}
+
 func (d *Database) GetExpression(id int, userID int) (string, string, float64, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -168,11 +334,14 @@ func (d *Database) GetAllExpressions(userID int) ([]struct {
 	Expression string
 	Status     string
 	Result     float64
+	Variables  map[string]float64
+	Label      string
+	DependsOn  []int
 }, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	rows, err := d.db.Query("SELECT id, expression, status, result FROM expressions WHERE user_id = ? ORDER BY id", userID)
+	rows, err := d.db.Query("SELECT id, expression, status, result, variables, label, depends_on FROM expressions WHERE user_id = ? ORDER BY id", userID)
 	if err != nil {
 		return nil, err
 	}
@@ -183,6 +352,9 @@ func (d *Database) GetAllExpressions(userID int) ([]struct {
 		Expression string
 		Status     string
 		Result     float64
+		Variables  map[string]float64
+		Label      string
+		DependsOn  []int
 	}
 
 	for rows.Next() {
@@ -191,10 +363,17 @@ func (d *Database) GetAllExpressions(userID int) ([]struct {
 			Expression string
 			Status     string
 			Result     float64
+			Variables  map[string]float64
+			Label      string
+			DependsOn  []int
 		}
-		if err := rows.Scan(&exp.ID, &exp.Expression, &exp.Status, &exp.Result); err != nil {
+		var variables, label, dependsOn sql.NullString
+		if err := rows.Scan(&exp.ID, &exp.Expression, &exp.Status, &exp.Result, &variables, &label, &dependsOn); err != nil {
 			return nil, err
 		}
+		exp.Variables = decodeVariables(variables)
+		exp.Label = label.String
+		exp.DependsOn = decodeDependencies(dependsOn)
 		expressions = append(expressions, exp)
 	}
 
@@ -205,13 +384,14 @@ func (d *Database) GetAllExpressions(userID int) ([]struct {
 	return expressions, nil
 }
 
-func (d *Database) SaveTask(expressionID int, arg1, arg2 float64, operation string) (int, error) {
+func (d *Database) SaveTask(expressionID int, node int, args []float64, operation string) (int, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	arg1, arg2, encoded := encodeArgs(args)
 	res, err := d.db.Exec(
-		"INSERT INTO tasks (expression_id, arg1, arg2, operation) VALUES (?, ?, ?, ?)",
-		expressionID, arg1, arg2, operation,
+		"INSERT INTO tasks (expression_id, node, arg1, arg2, args, operation) VALUES (?, ?, ?, ?, ?, ?)",
+		expressionID, node, arg1, arg2, encoded, operation,
 	)
 	if err != nil {
 		return 0, err
@@ -230,36 +410,101 @@ func (d *Database) UpdateTaskResult(taskID int, result float64) error {
 	defer d.mu.Unlock()
 
 	_, err := d.db.Exec(
-		"UPDATE tasks SET processed = TRUE, result = ? WHERE id = ?",
+		"UPDATE tasks SET processed = TRUE, result = ?, lease_deadline = NULL WHERE id = ?",
 		result, taskID,
 	)
 	return err
 }
 
+// SubmitTaskResult сохраняет результат задачи, только если его прислал агент, которому она выдана.
+// Возвращает false, если задача выдана другому агенту или уже выполнена. Результат головной
+// задачи копий определяет голосование, поэтому от агента он не принимается.
+func (d *Database) SubmitTaskResult(taskID int, agentID string, result float64) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		`UPDATE tasks SET processed = TRUE, result = ?, lease_deadline = NULL
+		WHERE id = ? AND processed = FALSE AND replicas <= 1 AND lease_deadline IS NOT NULL AND agent_id = ?`,
+		result, taskID, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 func (d *Database) GetUnprocessedTasks(limit int) ([]struct {
 	ID           int
 	ExpressionID int
-	Arg1         float64
-	Arg2         float64
+	Args         []float64
 	Operation    string
 }, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	rows, err := d.db.Query(
-		"SELECT id, expression_id, arg1, arg2, operation FROM tasks WHERE processed = FALSE LIMIT ?",
+		`SELECT t.id, t.expression_id, t.arg1, t.arg2, t.args, t.operation FROM tasks t
+		JOIN expressions e ON e.id = t.expression_id
+		WHERE t.processed = FALSE AND t.lease_deadline IS NULL AND t.replicas <= 1 AND e.status = 'processing'
+		LIMIT ?`,
 		limit,
 	)
 	if err != nil {
 		return nil, err
 	}
+	return scanUnprocessedTasks(rows)
+}
+
+// GetUnprocessedTasksByOperation возвращает все невыполненные задачи с одной из операций operations.
+// Задача сохраняется, только когда её аргументы готовы, поэтому зависимостей она уже не ждёт.
+func (d *Database) GetUnprocessedTasksByOperation(operations []string) ([]struct {
+	ID           int
+	ExpressionID int
+	Args         []float64
+	Operation    string
+}, error) {
+	if len(operations) == 0 {
+		return nil, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	args := make([]any, len(operations))
+	for i, op := range operations {
+		args[i] = op
+	}
+	rows, err := d.db.Query(
+		`SELECT t.id, t.expression_id, t.arg1, t.arg2, t.args, t.operation FROM tasks t
+		JOIN expressions e ON e.id = t.expression_id
+		WHERE t.processed = FALSE AND t.lease_deadline IS NULL AND t.replicas <= 1 AND e.status = 'processing'
+		AND t.operation IN (?`+strings.Repeat(", ?", len(operations)-1)+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanUnprocessedTasks(rows)
+}
+
+func scanUnprocessedTasks(rows *sql.Rows) ([]struct {
+	ID           int
+	ExpressionID int
+	Args         []float64
+	Operation    string
+}, error) {
 	defer rows.Close()
 
 	var tasks []struct {
 		ID           int
 		ExpressionID int
-		Arg1         float64
-		Arg2         float64
+		Args         []float64
 		Operation    string
 	}
 
@@ -267,13 +512,15 @@ func (d *Database) GetUnprocessedTasks(limit int) ([]struct {
 		var task struct {
 			ID           int
 			ExpressionID int
-			Arg1         float64
-			Arg2         float64
+			Args         []float64
 			Operation    string
 		}
-		if err := rows.Scan(&task.ID, &task.ExpressionID, &task.Arg1, &task.Arg2, &task.Operation); err != nil {
+		var arg1, arg2 float64
+		var args sql.NullString
+		if err := rows.Scan(&task.ID, &task.ExpressionID, &arg1, &arg2, &args, &task.Operation); err != nil {
 			return nil, err
 		}
+		task.Args = decodeArgs(arg1, arg2, args)
 		tasks = append(tasks, task)
 	}
 
@@ -300,6 +547,358 @@ func (d *Database) GetTaskResult(taskID int) (float64, bool, error) {
 	return result, processed, nil
 }
 
+// LeaseTask закрепляет задачу за агентом до deadline и увеличивает счётчик выдач.
+// Возвращает false, если задача уже выполнена или выдана, выражение больше не обрабатывается
+// или агент уже взял другую копию той же задачи. Задачу с истёкшей арендой выдаёт снова
+// только reaper, сняв аренду.
+func (d *Database) LeaseTask(taskID int, agentID string, deadline time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		`UPDATE tasks SET lease_deadline = ?, agent_id = ?, attempts = attempts + 1
+		WHERE id = ? AND processed = FALSE AND replicas <= 1 AND lease_deadline IS NULL
+		AND expression_id IN (SELECT id FROM expressions WHERE status = 'processing')
+		AND (replica_of IS NULL OR NOT EXISTS (
+			SELECT 1 FROM tasks o WHERE o.replica_of = tasks.replica_of AND o.id != tasks.id AND o.agent_id = ?
+		))`,
+		deadline.UnixMilli(), agentID, taskID, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ExtendTaskLease продлевает аренду задачи, которая всё ещё выдана этому агенту
+func (d *Database) ExtendTaskLease(taskID int, agentID string, deadline time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		`UPDATE tasks SET lease_deadline = ?
+		WHERE id = ? AND processed = FALSE AND lease_deadline IS NOT NULL AND COALESCE(agent_id, '') = ?`,
+		deadline.UnixMilli(), taskID, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ReleaseFailedTask снимает аренду задачи, которую агент не смог выполнить.
+// Возвращает false, если задача выдана другому агенту или уже выполнена.
+func (d *Database) ReleaseFailedTask(taskID int, agentID string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		`UPDATE tasks SET lease_deadline = NULL
+		WHERE id = ? AND processed = FALSE AND replicas <= 1 AND lease_deadline IS NOT NULL AND agent_id = ?`,
+		taskID, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ReleaseTaskLease снимает аренду, чтобы задачу можно было выдать снова
+func (d *Database) ReleaseTaskLease(taskID int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec("UPDATE tasks SET lease_deadline = NULL, agent_id = NULL WHERE id = ?", taskID)
+	return err
+}
+
+// GetExpiredTasks возвращает невыполненные задачи выражений в обработке, у которых истекла аренда
+func (d *Database) GetExpiredTasks(now time.Time) ([]struct {
+	ID           int
+	ExpressionID int
+	Args         []float64
+	Operation    string
+	Attempts     int
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(
+		`SELECT t.id, t.expression_id, t.arg1, t.arg2, t.args, t.operation, t.attempts FROM tasks t
+		JOIN expressions e ON e.id = t.expression_id
+		WHERE t.processed = FALSE AND t.lease_deadline IS NOT NULL AND t.lease_deadline < ?
+		AND e.status = 'processing'`,
+		now.UnixMilli(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanLeasedTasks(rows)
+}
+
+// GetAgentTasks возвращает невыполненные задачи выражений в обработке, арендованные агентом
+func (d *Database) GetAgentTasks(agentID string) ([]struct {
+	ID           int
+	ExpressionID int
+	Args         []float64
+	Operation    string
+	Attempts     int
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(
+		`SELECT t.id, t.expression_id, t.arg1, t.arg2, t.args, t.operation, t.attempts FROM tasks t
+		JOIN expressions e ON e.id = t.expression_id
+		WHERE t.processed = FALSE AND t.lease_deadline IS NOT NULL AND t.agent_id = ?
+		AND e.status = 'processing'`,
+		agentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanLeasedTasks(rows)
+}
+
+// scanLeasedTasks читает задачи вместе с числом выдач, как их возвращают
+// GetExpiredTasks и GetAgentTasks
+func scanLeasedTasks(rows *sql.Rows) ([]struct {
+	ID           int
+	ExpressionID int
+	Args         []float64
+	Operation    string
+	Attempts     int
+}, error) {
+	defer rows.Close()
+
+	var tasks []struct {
+		ID           int
+		ExpressionID int
+		Args         []float64
+		Operation    string
+		Attempts     int
+	}
+
+	for rows.Next() {
+		var task struct {
+			ID           int
+			ExpressionID int
+			Args         []float64
+			Operation    string
+			Attempts     int
+		}
+		var arg1, arg2 float64
+		var args sql.NullString
+		if err := rows.Scan(&task.ID, &task.ExpressionID, &arg1, &arg2, &args, &task.Operation, &task.Attempts); err != nil {
+			return nil, err
+		}
+		task.Args = decodeArgs(arg1, arg2, args)
+		tasks = append(tasks, task)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// GetTaskState возвращает результат задачи, признак выполнения и признак действующей аренды
+func (d *Database) GetTaskState(taskID int) (float64, bool, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var result sql.NullFloat64
+	var processed, leased bool
+	err := d.db.QueryRow(
+		"SELECT result, processed, lease_deadline IS NOT NULL FROM tasks WHERE id = ?",
+		taskID,
+	).Scan(&result, &processed, &leased)
+	if err != nil {
+		return 0, false, false, err
+	}
+	return result.Float64, processed, leased, nil
+}
+
+// GetExpressionTasks возвращает все задачи выражения в порядке создания
+func (d *Database) GetExpressionTasks(expressionID int) ([]struct {
+	ID        int
+	Node      int
+	Processed bool
+	Result    float64
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(
+		"SELECT id, node, processed, result FROM tasks WHERE expression_id = ? AND replica_of IS NULL ORDER BY id",
+		expressionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []struct {
+		ID        int
+		Node      int
+		Processed bool
+		Result    float64
+	}
+
+	for rows.Next() {
+		var task struct {
+			ID        int
+			Node      int
+			Processed bool
+			Result    float64
+		}
+		var result sql.NullFloat64
+		if err := rows.Scan(&task.ID, &task.Node, &task.Processed, &result); err != nil {
+			return nil, err
+		}
+		task.Result = result.Float64
+		tasks = append(tasks, task)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// GetProcessingExpressions возвращает выражения всех пользователей, вычисление которых не завершено
+func (d *Database) GetProcessingExpressions() ([]struct {
+	ID         int
+	UserID     int
+	Expression string
+	Replicas   int
+	Variables  map[string]float64
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query("SELECT id, user_id, expression, replicas, variables FROM expressions WHERE status = 'processing' ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expressions []struct {
+		ID         int
+		UserID     int
+		Expression string
+		Replicas   int
+		Variables  map[string]float64
+	}
+
+	for rows.Next() {
+		var exp struct {
+			ID         int
+			UserID     int
+			Expression string
+			Replicas   int
+			Variables  map[string]float64
+		}
+		var variables sql.NullString
+		if err := rows.Scan(&exp.ID, &exp.UserID, &exp.Expression, &exp.Replicas, &variables); err != nil {
+			return nil, err
+		}
+		exp.Variables = decodeVariables(variables)
+		expressions = append(expressions, exp)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return expressions, nil
+}
+
+// GetExpressionStatus возвращает статус выражения любого пользователя
+func (d *Database) GetExpressionStatus(id int) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var status string
+	err := d.db.QueryRow("SELECT status FROM expressions WHERE id = ?", id).Scan(&status)
+	return status, err
+}
+
+// FinishExpression переводит выражение из обработки в итоговый статус.
+// Возвращает false, если выражение уже не обрабатывается.
+func (d *Database) FinishExpression(id int, status string, result float64) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		"UPDATE expressions SET status = ?, result = ? WHERE id = ? AND status = 'processing'",
+		status, result, id,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// CancelExpression отменяет выражение пользователя, если оно ещё обрабатывается
+func (d *Database) CancelExpression(id int, userID int) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		"UPDATE expressions SET status = 'cancelled' WHERE id = ? AND user_id = ? AND status = 'processing'",
+		id, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteUnprocessedTasks удаляет невыполненные задачи выражения
+func (d *Database) DeleteUnprocessedTasks(expressionID int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec("DELETE FROM tasks WHERE expression_id = ? AND processed = FALSE", expressionID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
 func (d *Database) Close() error {
 	return d.db.Close()
 }
@@ -2,7 +2,9 @@ package db
 
 import (
 	"os"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -137,7 +139,7 @@ func TestTaskOperations(t *testing.T) {
 	arg2 := 4.0
 	operation := "*"
 
-	taskID, err := database.SaveTask(expressionID, arg1, arg2, operation)
+	taskID, err := database.SaveTask(expressionID, 0, []float64{arg1, arg2}, operation)
 	if err != nil {
 		t.Fatalf("Failed to save task: %v", err)
 	}
@@ -159,12 +161,8 @@ func TestTaskOperations(t *testing.T) {
 		t.Errorf("Task ID mismatch: expected %d, got %d", taskID, tasks[0].ID)
 	}
 
-	if tasks[0].Arg1 != arg1 {
-		t.Errorf("Arg1 mismatch: expected %f, got %f", arg1, tasks[0].Arg1)
-	}
-
-	if tasks[0].Arg2 != arg2 {
-		t.Errorf("Arg2 mismatch: expected %f, got %f", arg2, tasks[0].Arg2)
+	if !slices.Equal(tasks[0].Args, []float64{arg1, arg2}) {
+		t.Errorf("Args mismatch: expected [%f %f], got %v", arg1, arg2, tasks[0].Args)
 	}
 
 	if tasks[0].Operation != operation {
@@ -197,3 +195,379 @@ func TestTaskOperations(t *testing.T) {
 		}
 	}
 }
+
+func TestTaskLeases(t *testing.T) {
+	database := GetInstance()
+
+	userID, _ := database.CreateUser("leaseuser", "password")
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	database.SaveExpression(expressionID, userID, "1+2", "processing", 0)
+
+	taskID, err := database.SaveTask(expressionID, 0, []float64{1.0, 2.0}, "+")
+	if err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+
+	if ok, err := database.ExtendTaskLease(taskID, "agent-1", time.Now()); err != nil || ok {
+		t.Errorf("Task without a lease should not be extended, got %v (%v)", ok, err)
+	}
+
+	now := time.Now()
+	ok, err := database.LeaseTask(taskID, "agent-1", now.Add(time.Second))
+	if err != nil || !ok {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+
+	// задача могла остаться в очереди, но выданную второй раз не выдаём
+	if ok, _ := database.LeaseTask(taskID, "agent-2", now.Add(time.Second)); ok {
+		t.Error("Leased task should not be leased again")
+	}
+
+	held, err := database.GetAgentTasks("agent-1")
+	if err != nil {
+		t.Fatalf("Failed to get agent tasks: %v", err)
+	}
+	if len(held) != 1 || held[0].ID != taskID {
+		t.Errorf("Expected agent-1 to hold task %d, got %+v", taskID, held)
+	}
+	if held, _ := database.GetAgentTasks("agent-2"); len(held) != 0 {
+		t.Errorf("Expected agent-2 to hold no tasks, got %+v", held)
+	}
+
+	tasks, _ := database.GetUnprocessedTasks(10)
+	for _, task := range tasks {
+		if task.ID == taskID {
+			t.Error("Leased task should not be in unprocessed tasks list")
+		}
+	}
+
+	expired, err := database.GetExpiredTasks(now)
+	if err != nil {
+		t.Fatalf("Failed to get expired tasks: %v", err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("Expected no expired tasks, got %d", len(expired))
+	}
+
+	expired, _ = database.GetExpiredTasks(now.Add(2 * time.Second))
+	if len(expired) != 1 || expired[0].ID != taskID || expired[0].Attempts != 1 {
+		t.Fatalf("Expected task %d expired after 1 attempt, got %+v", taskID, expired)
+	}
+
+	if ok, _ := database.ExtendTaskLease(taskID, "agent-2", now.Add(time.Minute)); ok {
+		t.Error("Lease should only be extended by the agent holding the task")
+	}
+
+	if ok, err := database.ExtendTaskLease(taskID, "agent-1", now.Add(time.Minute)); err != nil || !ok {
+		t.Errorf("Failed to extend lease: %v", err)
+	}
+
+	expired, _ = database.GetExpiredTasks(now.Add(2 * time.Second))
+	if len(expired) != 0 {
+		t.Errorf("Extended lease should not expire, got %d expired tasks", len(expired))
+	}
+
+	if err := database.ReleaseTaskLease(taskID); err != nil {
+		t.Fatalf("Failed to release lease: %v", err)
+	}
+
+	if held, _ := database.GetAgentTasks("agent-1"); len(held) != 0 {
+		t.Errorf("Released task should not belong to agent, got %+v", held)
+	}
+
+	database.LeaseTask(taskID, "agent-2", now)
+	expired, _ = database.GetExpiredTasks(now.Add(time.Second))
+	if len(expired) != 1 || expired[0].Attempts != 2 {
+		t.Errorf("Expected second attempt to be counted, got %+v", expired)
+	}
+
+	if ok, _ := database.SubmitTaskResult(taskID, "agent-1", 4.0); ok {
+		t.Error("Result should only be accepted from the agent holding the task")
+	}
+	if ok, err := database.SubmitTaskResult(taskID, "agent-2", 3.0); err != nil || !ok {
+		t.Fatalf("Failed to submit result: %v", err)
+	}
+	if ok, _ := database.SubmitTaskResult(taskID, "agent-2", 4.0); ok {
+		t.Error("Result of a processed task should not be overwritten")
+	}
+	if ok, _ := database.LeaseTask(taskID, "agent-2", now); ok {
+		t.Error("Processed task should not be leased")
+	}
+
+	if ok, err := database.FinishExpression(expressionID, "completed", 3.0); err != nil || !ok {
+		t.Errorf("Failed to finish expression: %v", err)
+	}
+	if ok, _ := database.FinishExpression(expressionID, "error", 0); ok {
+		t.Error("Finished expression should not be finished again")
+	}
+}
+
+func TestTaskArgs(t *testing.T) {
+	database := GetInstance()
+
+	userID, _ := database.CreateUser("argsuser", "password")
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	database.SaveExpression(expressionID, userID, "max(1, 2, 3)+sqrt(4)", "processing", 0)
+	defer database.FinishExpression(expressionID, "completed", 5)
+
+	variadic, _ := database.SaveTask(expressionID, 0, []float64{1, 2, 3}, "max")
+	unary, _ := database.SaveTask(expressionID, 1, []float64{4}, "sqrt")
+
+	// задача, сохранённая до появления колонки args
+	res, err := database.db.Exec(
+		"INSERT INTO tasks (expression_id, node, arg1, arg2, operation) VALUES (?, ?, ?, ?, ?)",
+		expressionID, 2, 5.0, 6.0, "+",
+	)
+	if err != nil {
+		t.Fatalf("Failed to insert legacy task: %v", err)
+	}
+	legacy, _ := res.LastInsertId()
+
+	expected := map[int][]float64{
+		variadic:    {1, 2, 3},
+		unary:       {4},
+		int(legacy): {5, 6},
+	}
+	for id := range expected {
+		database.LeaseTask(id, "args-agent", time.Now().Add(time.Minute))
+	}
+
+	held, err := database.GetAgentTasks("args-agent")
+	if err != nil {
+		t.Fatalf("Failed to get agent tasks: %v", err)
+	}
+	if len(held) != len(expected) {
+		t.Fatalf("Expected %d tasks, got %d", len(expected), len(held))
+	}
+	for _, task := range held {
+		if !slices.Equal(task.Args, expected[task.ID]) {
+			t.Errorf("Task %d: expected args %v, got %v", task.ID, expected[task.ID], task.Args)
+		}
+	}
+}
+
+func TestUserVariablesAndLineage(t *testing.T) {
+	database := GetInstance()
+
+	userID, _ := database.CreateUser("lineagedbuser", "password")
+	now := time.Now()
+	database.SetUserVariable(userID, "rate", 1, now)
+	if err := database.SetUserVariable(userID, "rate", 2, now.Add(time.Second)); err != nil {
+		t.Fatalf("Failed to update variable: %v", err)
+	}
+	database.SetUserVariable(userID, "fee", 3, now)
+
+	variables, err := database.GetUserVariables(userID)
+	if err != nil {
+		t.Fatalf("Failed to get variables: %v", err)
+	}
+	if len(variables) != 2 || variables[0].Name != "fee" || variables[1].Value != 2 {
+		t.Errorf("Unexpected variables: %+v", variables)
+	}
+
+	if ok, _ := database.DeleteUserVariable(userID, "fee"); !ok {
+		t.Error("Variable should be deleted")
+	}
+	if ok, _ := database.DeleteUserVariable(userID, "fee"); ok {
+		t.Error("Deleted variable should not be deleted again")
+	}
+
+	baseID, err := database.CreateExpression(userID, NewExpression{Expression: "2*3", Label: "base"}, "", "", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create labelled expression: %v", err)
+	}
+	database.FinishExpression(baseID, "completed", 6)
+	totalID, _ := database.CreateExpression(userID, NewExpression{
+		Expression: "$base+1",
+		Variables:  map[string]float64{"$base": 6},
+		DependsOn:  []int{baseID},
+	}, "", "", time.Now())
+	database.FinishExpression(totalID, "completed", 7)
+
+	id, status, result, err := database.FindExpressionByLabel(userID, "base")
+	if err != nil || id != baseID || status != "completed" || result != 6 {
+		t.Errorf("Unexpected labelled expression: %d %s %f (%v)", id, status, result, err)
+	}
+
+	lineage, err := database.GetExpressionLineage(totalID, userID)
+	if err != nil {
+		t.Fatalf("Failed to get lineage: %v", err)
+	}
+	if lineage.Label != "" || !slices.Equal(lineage.DependsOn, []int{baseID}) || lineage.Variables["$base"] != 6 {
+		t.Errorf("Unexpected lineage: %+v", lineage)
+	}
+
+	if _, err := database.CreateExpression(userID, NewExpression{Expression: "1+1", Label: "base"}, "", "", time.Now()); err == nil {
+		t.Error("Label should be unique per user")
+	}
+}
+
+func TestSheetCells(t *testing.T) {
+	database := GetInstance()
+
+	userID, _ := database.CreateUser("sheetdbuser", "password")
+	now := time.Now()
+	sheetID, err := database.CreateSheet(userID, "budget", now)
+	if err != nil {
+		t.Fatalf("Failed to create sheet: %v", err)
+	}
+	if _, _, err := database.GetSheet(sheetID, userID+1); err == nil {
+		t.Error("Sheet of another user should not be found")
+	}
+
+	database.SetCellExpression(sheetID, "a", "1", now)
+	database.SetCellExpression(sheetID, "b", "a*2", now)
+
+	cells, err := database.GetSheetCells(sheetID)
+	if err != nil {
+		t.Fatalf("Failed to get cells: %v", err)
+	}
+	if len(cells) != 2 || cells[0].Name != "a" || cells[0].Status != "pending" {
+		t.Fatalf("Unexpected cells: %+v", cells)
+	}
+	revision := cells[1].Revision
+
+	if pending, _ := database.GetPendingCells(); len(pending) < 2 {
+		t.Errorf("Expected pending cells, got %+v", pending)
+	}
+
+	// отметка к пересчёту делает прочитанную ревизию устаревшей
+	database.MarkCellsPending(sheetID, []string{"b"}, now)
+	if ok, _ := database.SetCellResult(sheetID, "b", revision, "completed", 2, "", 0, now); ok {
+		t.Error("Stale result should not be saved")
+	}
+	if ok, err := database.SetCellResult(sheetID, "b", revision+1, "error", 0, "cell a has no value", 0, now); err != nil || !ok {
+		t.Errorf("Failed to save cell result: %v", err)
+	}
+
+	cells, _ = database.GetSheetCells(sheetID)
+	if cells[1].Status != "error" || cells[1].Error != "cell a has no value" {
+		t.Errorf("Unexpected cell: %+v", cells[1])
+	}
+
+	if ok, _ := database.DeleteCell(sheetID, "a"); !ok {
+		t.Error("Cell should be deleted")
+	}
+	if ok, _ := database.DeleteCell(sheetID, "a"); ok {
+		t.Error("Deleted cell should not be deleted again")
+	}
+}
+
+func TestSaveBatch(t *testing.T) {
+	database := GetInstance()
+
+	userID, _ := database.CreateUser("batchdbuser", "password")
+	lastID, _ := database.GetLastExpressionID()
+
+	batchID, ids, err := database.SaveBatch(userID, []NewExpression{
+		{Expression: "1+1"},
+		{Expression: "x*2", Replicas: 3, Variables: map[string]float64{"x": 4}, Label: "doubled"},
+		{Expression: "2^3", CallbackURL: "https://example.com/hook"},
+	}, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to save batch: %v", err)
+	}
+	if !slices.Equal(ids, []int{lastID + 1, lastID + 2, lastID + 3}) {
+		t.Errorf("Expected consecutive IDs after %d, got %v", lastID, ids)
+	}
+
+	lineage, _ := database.GetExpressionLineage(ids[1], userID)
+	if lineage.Label != "doubled" || lineage.Variables["x"] != 4 {
+		t.Errorf("Unexpected lineage: %+v", lineage)
+	}
+	if webhooks, _ := database.GetWebhooks(ids[2]); len(webhooks) != 1 {
+		t.Errorf("Expected a webhook for expression %d, got %+v", ids[2], webhooks)
+	}
+
+	database.FinishExpression(ids[0], "completed", 2)
+	batch, err := database.GetBatch(batchID, userID)
+	if err != nil {
+		t.Fatalf("Failed to get batch: %v", err)
+	}
+	if len(batch.Expressions) != 3 || batch.Expressions[0].Status != "completed" || batch.Expressions[1].Status != "processing" {
+		t.Errorf("Unexpected batch: %+v", batch)
+	}
+	for _, id := range ids[1:] {
+		database.FinishExpression(id, "cancelled", 0)
+	}
+
+	if _, err := database.GetBatch(batchID, userID+1); err == nil {
+		t.Error("Batch of another user should not be found")
+	}
+}
+
+func TestCreateExpression(t *testing.T) {
+	database := GetInstance()
+
+	userID, _ := database.CreateUser("createexpressionuser", "password")
+	lastID, _ := database.GetLastExpressionID()
+
+	id, err := database.CreateExpression(userID, NewExpression{
+		Expression:  "x+1",
+		Replicas:    3,
+		Variables:   map[string]float64{"x": 2},
+		Label:       "next",
+		DependsOn:   []int{lastID},
+		CallbackURL: "https://example.com/hook",
+	}, "key-create", "abc", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+	if id != lastID+1 {
+		t.Errorf("Expected ID %d, got %d", lastID+1, id)
+	}
+	defer database.FinishExpression(id, "cancelled", 0)
+
+	if expr, status, _, _ := database.GetExpression(id, userID); expr != "x+1" || status != "processing" {
+		t.Errorf("Unexpected expression %q with status %s", expr, status)
+	}
+	lineage, _ := database.GetExpressionLineage(id, userID)
+	if lineage.Label != "next" || lineage.Variables["x"] != 2 || !slices.Equal(lineage.DependsOn, []int{lastID}) {
+		t.Errorf("Unexpected lineage: %+v", lineage)
+	}
+	if webhooks, _ := database.GetWebhooks(id); len(webhooks) != 1 {
+		t.Errorf("Expected a webhook, got %+v", webhooks)
+	}
+	if keyID, fingerprint, err := database.FindIdempotencyKey(userID, "key-create", time.Now().Add(-time.Hour)); err != nil || keyID != id || fingerprint != "abc" {
+		t.Errorf("Unexpected key: %d %q (%v)", keyID, fingerprint, err)
+	}
+
+	// без ключа сохраняется только выражение
+	plain, err := database.CreateExpression(userID, NewExpression{Expression: "1+1"}, "", "", time.Now())
+	if err != nil || plain != id+1 {
+		t.Fatalf("Expected ID %d, got %d (%v)", id+1, plain, err)
+	}
+	database.FinishExpression(plain, "cancelled", 0)
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	database := GetInstance()
+
+	userID, _ := database.CreateUser("idempotencydbuser", "password")
+	now := time.Now()
+	expressionID, err := database.CreateExpression(userID, NewExpression{Expression: "1+1"}, "key-1", "abc", now)
+	if err != nil {
+		t.Fatalf("Failed to save key: %v", err)
+	}
+	database.FinishExpression(expressionID, "completed", 2)
+
+	id, fingerprint, err := database.FindIdempotencyKey(userID, "key-1", now.Add(-time.Hour))
+	if err != nil || id != expressionID || fingerprint != "abc" {
+		t.Errorf("Unexpected key: %d %q (%v)", id, fingerprint, err)
+	}
+	if _, _, err := database.FindIdempotencyKey(userID+1, "key-1", now.Add(-time.Hour)); err == nil {
+		t.Error("Key of another user should not be found")
+	}
+	if _, _, err := database.FindIdempotencyKey(userID, "key-1", now.Add(time.Second)); err == nil {
+		t.Error("Expired key should not be found")
+	}
+
+	if n, err := database.DeleteExpiredIdempotencyKeys(now.Add(time.Second)); err != nil || n < 1 {
+		t.Errorf("Expected expired keys to be deleted, got %d (%v)", n, err)
+	}
+	if _, _, err := database.FindIdempotencyKey(userID, "key-1", now.Add(-time.Hour)); err == nil {
+		t.Error("Deleted key should not be found")
+	}
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// Ключи идемпотентности POST /api/v1/calculate: повтор запроса с тем же ключом возвращает
+// уже созданное выражение. fingerprint — отпечаток тела запроса, чтобы заметить ключ,
+// использованный для другого запроса.
+func (d *Database) initIdempotency() {
+	_, err := d.db.Exec(`
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		expression_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, key),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (expression_id) REFERENCES expressions(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idempotency_keys_created ON idempotency_keys (created_at)
+	`)
+	if err != nil {
+		log.Fatalf("Error make idempotency_keys db: %v", err)
+	}
+}
+
+// upsertIdempotencyKey запоминает ключ; истёкший ключ с тем же именем заменяется
+const upsertIdempotencyKey = `INSERT INTO idempotency_keys (user_id, key, fingerprint, expression_id, created_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (user_id, key) DO UPDATE SET fingerprint = excluded.fingerprint,
+		expression_id = excluded.expression_id, created_at = excluded.created_at`
+
+// FindIdempotencyKey возвращает выражение и отпечаток запроса для ключа, использованного
+// не раньше since; sql.ErrNoRows, если такого нет
+func (d *Database) FindIdempotencyKey(userID int, key string, since time.Time) (int, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var expressionID int
+	var fingerprint string
+	err := d.db.QueryRow(
+		"SELECT expression_id, fingerprint FROM idempotency_keys WHERE user_id = ? AND key = ? AND created_at >= ?",
+		userID, key, since.UnixMilli(),
+	).Scan(&expressionID, &fingerprint)
+	if err != nil {
+		return 0, "", err
+	}
+	return expressionID, fingerprint, nil
+}
+
+// DeleteExpiredIdempotencyKeys удаляет ключи, использованные раньше before
+func (d *Database) DeleteExpiredIdempotencyKeys(before time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
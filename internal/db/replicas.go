@@ -0,0 +1,206 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// Проверяемое выполнение: каждая операция выражения с replicas > 1 сохраняется
+// как головная задача, которая агентам не выдаётся, и replicas копий со ссылкой на неё
+// в replica_of. Результат головной задачи — значение, за которое проголосовало большинство копий.
+func (d *Database) initReplicas() {
+	d.addColumn("expressions", "replicas", "INTEGER NOT NULL DEFAULT 1")
+	d.addColumn("tasks", "replica_of", "INTEGER")
+	d.addColumn("tasks", "replicas", "INTEGER NOT NULL DEFAULT 1")
+
+	// ошибка, с которой агент не смог выполнить копию; её голос тоже учитывается
+	d.addColumn("tasks", "error", "TEXT")
+
+	// число копий для выражений пользователя, в которых replicas не задано; 0 — обычное выполнение
+	d.addColumn("users", "default_replicas", "INTEGER NOT NULL DEFAULT 0")
+}
+
+func (d *Database) GetUserReplicas(userID int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var replicas int
+	err := d.db.QueryRow("SELECT default_replicas FROM users WHERE id = ?", userID).Scan(&replicas)
+	return replicas, err
+}
+
+func (d *Database) SetUserReplicas(userID int, replicas int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec("UPDATE users SET default_replicas = ? WHERE id = ?", replicas, userID)
+	return err
+}
+
+// SaveReplicatedTask сохраняет головную задачу и её копии в одной транзакции.
+// Возвращает ID головной задачи и ID копий.
+func (d *Database) SaveReplicatedTask(expressionID int, node int, args []float64, operation string, replicas int) (int, []int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	arg1, arg2, encoded := encodeArgs(args)
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"INSERT INTO tasks (expression_id, node, arg1, arg2, args, operation, replicas) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		expressionID, node, arg1, arg2, encoded, operation, replicas,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	head, err := res.LastInsertId()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ids := make([]int, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		res, err := tx.Exec(
+			"INSERT INTO tasks (expression_id, node, arg1, arg2, args, operation, replica_of) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			expressionID, node, arg1, arg2, encoded, operation, head,
+		)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, nil, err
+		}
+		ids = append(ids, int(id))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	return int(head), ids, nil
+}
+
+// SubmitReplicaResult сохраняет результат копии, только если её прислал агент, которому она выдана.
+// Возвращает false, если копия выдана другому агенту или уже выполнена.
+func (d *Database) SubmitReplicaResult(taskID int, agentID string, result float64) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		`UPDATE tasks SET processed = TRUE, result = ?, lease_deadline = NULL
+		WHERE id = ? AND processed = FALSE AND lease_deadline IS NOT NULL AND agent_id = ?`,
+		result, taskID, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SubmitReplicaError сохраняет ошибку копии, только если её прислал агент, которому она выдана.
+// Возвращает false, если копия выдана другому агенту или уже выполнена.
+func (d *Database) SubmitReplicaError(taskID int, agentID string, message string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		`UPDATE tasks SET processed = TRUE, error = ?, lease_deadline = NULL
+		WHERE id = ? AND processed = FALSE AND lease_deadline IS NOT NULL AND agent_id = ?`,
+		message, taskID, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteUnprocessedReplicas удаляет копии головной задачи, результаты которых голосованию уже не нужны
+func (d *Database) DeleteUnprocessedReplicas(headID int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec("DELETE FROM tasks WHERE replica_of = ? AND processed = FALSE", headID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// GetTaskReplicas возвращает копии головной задачи; для обычной задачи список пуст
+func (d *Database) GetTaskReplicas(headID int) ([]struct {
+	ID        int
+	AgentID   string
+	Processed bool
+	Leased    bool
+	Result    float64
+	Error     string
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(
+		"SELECT id, agent_id, processed, lease_deadline IS NOT NULL, result, error FROM tasks WHERE replica_of = ? ORDER BY id",
+		headID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replicas []struct {
+		ID        int
+		AgentID   string
+		Processed bool
+		Leased    bool
+		Result    float64
+		Error     string
+	}
+
+	for rows.Next() {
+		var replica struct {
+			ID        int
+			AgentID   string
+			Processed bool
+			Leased    bool
+			Result    float64
+			Error     string
+		}
+		var agentID, message sql.NullString
+		var result sql.NullFloat64
+		if err := rows.Scan(&replica.ID, &agentID, &replica.Processed, &replica.Leased, &result, &message); err != nil {
+			return nil, err
+		}
+		replica.AgentID = agentID.String
+		replica.Result = result.Float64
+		replica.Error = message.String
+		replicas = append(replicas, replica)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return replicas, nil
+}
@@ -0,0 +1,305 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Лист — набор именованных ячеек пользователя. Ячейка хранит выражение, которое может
+// ссылаться на другие ячейки листа, и последнее вычисленное значение. expression_id —
+// выражение, которым ячейка считалась в последний раз. revision растёт при каждой отметке
+// ячейки к пересчёту, чтобы устаревший пересчёт не затёр более новый.
+func (d *Database) initSheets() {
+	_, err := d.db.Exec(`
+	CREATE TABLE IF NOT EXISTS sheets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS sheet_cells (
+		sheet_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		expression TEXT NOT NULL,
+		status TEXT NOT NULL,
+		value REAL NOT NULL DEFAULT 0,
+		error TEXT,
+		expression_id INTEGER,
+		revision INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (sheet_id, name),
+		FOREIGN KEY (sheet_id) REFERENCES sheets(id),
+		FOREIGN KEY (expression_id) REFERENCES expressions(id)
+	)
+	`)
+	if err != nil {
+		log.Fatalf("Error make sheets db: %v", err)
+	}
+}
+
+func (d *Database) CreateSheet(userID int, name string, now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec("INSERT INTO sheets (user_id, name, created_at) VALUES (?, ?, ?)", userID, name, now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+// GetSheet возвращает имя листа пользователя; sql.ErrNoRows, если листа нет или он чужой
+func (d *Database) GetSheet(id int, userID int) (string, time.Time, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var name string
+	var createdAt int64
+	err := d.db.QueryRow("SELECT name, created_at FROM sheets WHERE id = ? AND user_id = ?", id, userID).Scan(&name, &createdAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return name, time.UnixMilli(createdAt), nil
+}
+
+func (d *Database) GetSheets(userID int) ([]struct {
+	ID        int
+	Name      string
+	CreatedAt time.Time
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query("SELECT id, name, created_at FROM sheets WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sheets []struct {
+		ID        int
+		Name      string
+		CreatedAt time.Time
+	}
+
+	for rows.Next() {
+		var s struct {
+			ID        int
+			Name      string
+			CreatedAt time.Time
+		}
+		var createdAt int64
+		if err := rows.Scan(&s.ID, &s.Name, &createdAt); err != nil {
+			return nil, err
+		}
+		s.CreatedAt = time.UnixMilli(createdAt)
+		sheets = append(sheets, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sheets, nil
+}
+
+func (d *Database) GetSheetCells(sheetID int) ([]struct {
+	Name         string
+	Expression   string
+	Status       string
+	Value        float64
+	Error        string
+	ExpressionID int
+	Revision     int
+	UpdatedAt    time.Time
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(
+		"SELECT name, expression, status, value, error, expression_id, revision, updated_at FROM sheet_cells WHERE sheet_id = ? ORDER BY name",
+		sheetID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cells []struct {
+		Name         string
+		Expression   string
+		Status       string
+		Value        float64
+		Error        string
+		ExpressionID int
+		Revision     int
+		UpdatedAt    time.Time
+	}
+
+	for rows.Next() {
+		var c struct {
+			Name         string
+			Expression   string
+			Status       string
+			Value        float64
+			Error        string
+			ExpressionID int
+			Revision     int
+			UpdatedAt    time.Time
+		}
+		var errMsg sql.NullString
+		var expressionID sql.NullInt64
+		var updatedAt int64
+		if err := rows.Scan(&c.Name, &c.Expression, &c.Status, &c.Value, &errMsg, &expressionID, &c.Revision, &updatedAt); err != nil {
+			return nil, err
+		}
+		c.Error = errMsg.String
+		c.ExpressionID = int(expressionID.Int64)
+		c.UpdatedAt = time.UnixMilli(updatedAt)
+		cells = append(cells, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cells, nil
+}
+
+// SetCellExpression записывает выражение ячейки; до пересчёта ячейка ждёт в статусе pending
+func (d *Database) SetCellExpression(sheetID int, name, expression string, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(
+		`INSERT INTO sheet_cells (sheet_id, name, expression, status, updated_at) VALUES (?, ?, ?, 'pending', ?)
+		ON CONFLICT (sheet_id, name) DO UPDATE SET expression = excluded.expression, status = 'pending',
+			error = NULL, revision = revision + 1, updated_at = excluded.updated_at`,
+		sheetID, name, expression, now.UnixMilli(),
+	)
+	return err
+}
+
+// MarkCellsPending отмечает ячейки, которые будут пересчитаны
+func (d *Database) MarkCellsPending(sheetID int, names []string, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range names {
+		_, err := tx.Exec(
+			"UPDATE sheet_cells SET status = 'pending', revision = revision + 1, updated_at = ? WHERE sheet_id = ? AND name = ?",
+			now.UnixMilli(), sheetID, name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetCellResult сохраняет итог пересчёта ячейки, если с момента чтения revision её не отмечали
+// к пересчёту снова. expressionID = 0, если выражение не запускалось.
+func (d *Database) SetCellResult(sheetID int, name string, revision int, status string, value float64, errMsg string, expressionID int, now time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var errValue sql.NullString
+	if errMsg != "" {
+		errValue = sql.NullString{String: errMsg, Valid: true}
+	}
+	var expressionValue sql.NullInt64
+	if expressionID != 0 {
+		expressionValue = sql.NullInt64{Int64: int64(expressionID), Valid: true}
+	}
+
+	res, err := d.db.Exec(
+		`UPDATE sheet_cells SET status = ?, value = ?, error = ?, expression_id = ?, updated_at = ?
+		WHERE sheet_id = ? AND name = ? AND revision = ?`,
+		status, value, errValue, expressionValue, now.UnixMilli(), sheetID, name, revision,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteCell удаляет ячейку. Возвращает false, если её не было.
+func (d *Database) DeleteCell(sheetID int, name string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec("DELETE FROM sheet_cells WHERE sheet_id = ? AND name = ?", sheetID, name)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetPendingCells возвращает ячейки всех листов, пересчёт которых прервал перезапуск
+func (d *Database) GetPendingCells() ([]struct {
+	SheetID int
+	UserID  int
+	Name    string
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(`
+		SELECT c.sheet_id, s.user_id, c.name FROM sheet_cells c
+		JOIN sheets s ON s.id = c.sheet_id
+		WHERE c.status = 'pending'
+		ORDER BY c.sheet_id, c.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cells []struct {
+		SheetID int
+		UserID  int
+		Name    string
+	}
+
+	for rows.Next() {
+		var c struct {
+			SheetID int
+			UserID  int
+			Name    string
+		}
+		if err := rows.Scan(&c.SheetID, &c.UserID, &c.Name); err != nil {
+			return nil, err
+		}
+		cells = append(cells, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cells, nil
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Значения имён, подставленные в выражение (переменные запроса, сохранённые переменные
+// пользователя и результаты других выражений), хранятся рядом с ним в expressions.variables
+// как JSON-объект имя -> значение. label — имя, под которым на результат можно сослаться
+// из других выражений, depends_on — JSON-список выражений, на результаты которых ссылается это.
+func (d *Database) initVariables() {
+	d.addColumn("expressions", "variables", "TEXT")
+	d.addColumn("expressions", "label", "TEXT")
+	d.addColumn("expressions", "depends_on", "TEXT")
+
+	_, err := d.db.Exec(`
+	CREATE UNIQUE INDEX IF NOT EXISTS expressions_user_label ON expressions (user_id, label);
+
+	CREATE TABLE IF NOT EXISTS user_variables (
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value REAL NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, name),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	)
+	`)
+	if err != nil {
+		log.Fatalf("Error make user_variables db: %v", err)
+	}
+}
+
+// encodeLineage готовит значения колонок label и depends_on; пустые значения — NULL
+func encodeLineage(label string, dependsOn []int) (sql.NullString, sql.NullString, error) {
+	var labelValue, dependsValue sql.NullString
+	if label != "" {
+		labelValue = sql.NullString{String: label, Valid: true}
+	}
+	if len(dependsOn) > 0 {
+		encoded, err := json.Marshal(dependsOn)
+		if err != nil {
+			return labelValue, dependsValue, err
+		}
+		dependsValue = sql.NullString{String: string(encoded), Valid: true}
+	}
+	return labelValue, dependsValue, nil
+}
+
+// GetExpressionLineage возвращает подстановки, метку и зависимости выражения пользователя
+func (d *Database) GetExpressionLineage(id int, userID int) (struct {
+	Variables map[string]float64
+	Label     string
+	DependsOn []int
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var lineage struct {
+		Variables map[string]float64
+		Label     string
+		DependsOn []int
+	}
+	var variables, label, dependsOn sql.NullString
+	err := d.db.QueryRow(
+		"SELECT variables, label, depends_on FROM expressions WHERE id = ? AND user_id = ?",
+		id, userID,
+	).Scan(&variables, &label, &dependsOn)
+	if err != nil {
+		return lineage, err
+	}
+
+	lineage.Variables = decodeVariables(variables)
+	lineage.Label = label.String
+	lineage.DependsOn = decodeDependencies(dependsOn)
+	return lineage, nil
+}
+
+// FindExpressionByLabel ищет выражение пользователя по метке; sql.ErrNoRows, если такой нет
+func (d *Database) FindExpressionByLabel(userID int, label string) (int, string, float64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var id int
+	var status string
+	var result float64
+	err := d.db.QueryRow(
+		"SELECT id, status, result FROM expressions WHERE user_id = ? AND label = ?",
+		userID, label,
+	).Scan(&id, &status, &result)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	return id, status, result, nil
+}
+
+// SetUserVariable сохраняет переменную пользователя, заменяя прежнее значение
+func (d *Database) SetUserVariable(userID int, name string, value float64, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(
+		`INSERT INTO user_variables (user_id, name, value, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		userID, name, value, now.UnixMilli(),
+	)
+	return err
+}
+
+func (d *Database) GetUserVariables(userID int) ([]struct {
+	Name      string
+	Value     float64
+	UpdatedAt time.Time
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query("SELECT name, value, updated_at FROM user_variables WHERE user_id = ? ORDER BY name", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variables []struct {
+		Name      string
+		Value     float64
+		UpdatedAt time.Time
+	}
+
+	for rows.Next() {
+		var v struct {
+			Name      string
+			Value     float64
+			UpdatedAt time.Time
+		}
+		var updatedAt int64
+		if err := rows.Scan(&v.Name, &v.Value, &updatedAt); err != nil {
+			return nil, err
+		}
+		v.UpdatedAt = time.UnixMilli(updatedAt)
+		variables = append(variables, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return variables, nil
+}
+
+// DeleteUserVariable удаляет переменную пользователя. Возвращает false, если её не было.
+func (d *Database) DeleteUserVariable(userID int, name string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec("DELETE FROM user_variables WHERE user_id = ? AND name = ?", userID, name)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func decodeVariables(encoded sql.NullString) map[string]float64 {
+	if !encoded.Valid {
+		return nil
+	}
+
+	var variables map[string]float64
+	if err := json.Unmarshal([]byte(encoded.String), &variables); err != nil {
+		return nil
+	}
+	return variables
+}
+
+func decodeDependencies(encoded sql.NullString) []int {
+	if !encoded.Valid {
+		return nil
+	}
+
+	var ids []int
+	if err := json.Unmarshal([]byte(encoded.String), &ids); err != nil {
+		return nil
+	}
+	return ids
+}
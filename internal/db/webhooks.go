@@ -0,0 +1,227 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+func (d *Database) initWebhooks() {
+	// секрет пользователя для подписи уведомлений
+	d.addColumn("users", "webhook_secret", "TEXT")
+
+	_, err := d.db.Exec(`
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		expression_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'waiting',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER,
+		last_error TEXT,
+		FOREIGN KEY (expression_id) REFERENCES expressions(id)
+	)
+	`)
+	if err != nil {
+		log.Fatalf("Error make webhooks db: %v", err)
+	}
+}
+
+func (d *Database) GetWebhookSecret(userID int) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var secret sql.NullString
+	err := d.db.QueryRow("SELECT webhook_secret FROM users WHERE id = ?", userID).Scan(&secret)
+	if err != nil {
+		return "", err
+	}
+	return secret.String, nil
+}
+
+// SetWebhookSecret сохраняет секрет, только если у пользователя его ещё нет,
+// и возвращает тот, что в итоге сохранён
+func (d *Database) SetWebhookSecret(userID int, secret string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec("UPDATE users SET webhook_secret = ? WHERE id = ? AND webhook_secret IS NULL", secret, userID)
+	if err != nil {
+		return "", err
+	}
+
+	var stored sql.NullString
+	err = d.db.QueryRow("SELECT webhook_secret FROM users WHERE id = ?", userID).Scan(&stored)
+	if err != nil {
+		return "", err
+	}
+	return stored.String, nil
+}
+
+// ActivateWebhooks ставит уведомления завершившегося выражения в очередь на отправку
+func (d *Database) ActivateWebhooks(expressionID int, now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		"UPDATE webhooks SET status = 'pending', next_attempt_at = ? WHERE expression_id = ? AND status = 'waiting'",
+		now.UnixMilli(), expressionID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// ActivateFinishedWebhooks ставит в очередь уведомления выражений, которые завершились,
+// но не успели их активировать, например из-за остановки оркестратора
+func (d *Database) ActivateFinishedWebhooks(now time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	res, err := d.db.Exec(
+		`UPDATE webhooks SET status = 'pending', next_attempt_at = ?
+		WHERE status = 'waiting' AND expression_id IN (
+			SELECT id FROM expressions WHERE status IN ('completed', 'error')
+		)`,
+		now.UnixMilli(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// GetDueWebhooks возвращает уведомления, время очередной попытки которых наступило
+func (d *Database) GetDueWebhooks(now time.Time, limit int) ([]struct {
+	ID           int
+	URL          string
+	Attempts     int
+	ExpressionID int
+	Expression   string
+	Status       string
+	Result       float64
+	Secret       string
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(
+		`SELECT w.id, w.url, w.attempts, e.id, e.expression, e.status, e.result, COALESCE(u.webhook_secret, '')
+		FROM webhooks w
+		JOIN expressions e ON e.id = w.expression_id
+		JOIN users u ON u.id = e.user_id
+		WHERE w.status = 'pending' AND w.next_attempt_at <= ?
+		ORDER BY w.next_attempt_at
+		LIMIT ?`,
+		now.UnixMilli(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []struct {
+		ID           int
+		URL          string
+		Attempts     int
+		ExpressionID int
+		Expression   string
+		Status       string
+		Result       float64
+		Secret       string
+	}
+
+	for rows.Next() {
+		var w struct {
+			ID           int
+			URL          string
+			Attempts     int
+			ExpressionID int
+			Expression   string
+			Status       string
+			Result       float64
+			Secret       string
+		}
+		if err := rows.Scan(&w.ID, &w.URL, &w.Attempts, &w.ExpressionID, &w.Expression, &w.Status, &w.Result, &w.Secret); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// RecordWebhookAttempt сохраняет итог попытки доставки и время следующей
+func (d *Database) RecordWebhookAttempt(id int, status string, attempts int, nextAttempt time.Time, lastError string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(
+		"UPDATE webhooks SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+		status, attempts, nextAttempt.UnixMilli(), lastError, id,
+	)
+	return err
+}
+
+func (d *Database) GetWebhooks(expressionID int) ([]struct {
+	ID        int
+	URL       string
+	Status    string
+	Attempts  int
+	LastError string
+}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(
+		"SELECT id, url, status, attempts, COALESCE(last_error, '') FROM webhooks WHERE expression_id = ? ORDER BY id",
+		expressionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []struct {
+		ID        int
+		URL       string
+		Status    string
+		Attempts  int
+		LastError string
+	}
+
+	for rows.Next() {
+		var w struct {
+			ID        int
+			URL       string
+			Status    string
+			Attempts  int
+			LastError string
+		}
+		if err := rows.Scan(&w.ID, &w.URL, &w.Status, &w.Attempts, &w.LastError); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
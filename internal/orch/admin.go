@@ -0,0 +1,58 @@
+package orch
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+)
+
+// isAdmin проверяет, перечислен ли логин в ADMIN_LOGINS (через запятую)
+func isAdmin(login string) bool {
+	for _, admin := range strings.Split(pkg.GetEnvString("ADMIN_LOGINS", ""), ",") {
+		if strings.TrimSpace(admin) == login && login != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// adminOnly пропускает только администраторов; ставится после auth.AuthMiddleware
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := auth.GetUserIDFromContext(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		database := db.GetInstance()
+		login, err := database.GetUserLogin(userID)
+		if err != nil {
+			log.Printf("Error getting user %d: %v", userID, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !isAdmin(login) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func handleAdminAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"agents": agents.list()})
+}
@@ -0,0 +1,254 @@
+package orch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type agentTokenKey struct{}
+
+// agentIdentity возвращает проверенную личность агента: ID его токена, а без проверки токенов —
+// имя (CN) клиентского сертификата, подписанного CA агентов. false, если личность не проверялась.
+func agentIdentity(ctx context.Context) (string, bool) {
+	if tokenID, ok := ctx.Value(agentTokenKey{}).(string); ok {
+		return tokenID, true
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := info.State.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
+
+// checkAgentID сверяет идентификатор, которым агент назвался, с его проверенной личностью.
+// Иначе один процесс мог бы назваться несколькими агентами и проголосовать за все копии операции.
+// Без токенов и mTLS агенту приходится верить на слово.
+func checkAgentID(ctx context.Context, agentID string) error {
+	identity, ok := agentIdentity(ctx)
+	if !ok || agentID == identity {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "agent id %q does not match its credentials", agentID)
+}
+
+// authenticateAgent проверяет токен агента из метаданных вызова и возвращает его идентификатор
+func authenticateAgent(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", status.Error(codes.Unauthenticated, "agent token is required")
+	}
+
+	tokenString, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "invalid authorization format")
+	}
+
+	tokenID, err := auth.ValidateAgentToken(tokenString)
+	if err != nil {
+		return "", status.Error(codes.Unauthenticated, "invalid agent token")
+	}
+
+	if err := checkAgentToken(tokenID); err != nil {
+		return "", err
+	}
+	return tokenID, nil
+}
+
+// checkAgentToken проверяет, что токен не отозван и не истёк
+func checkAgentToken(tokenID string) error {
+	database := db.GetInstance()
+	active, err := database.IsAgentTokenActive(tokenID, time.Now())
+	if err != nil {
+		log.Printf("Error checking agent token %s: %v", tokenID, err)
+		return status.Error(codes.Internal, "internal error")
+	}
+	if !active {
+		return status.Error(codes.Unauthenticated, "agent token is revoked or expired")
+	}
+	return nil
+}
+
+func agentAuthUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	tokenID, err := authenticateAgent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, agentTokenKey{}, tokenID), req)
+}
+
+func agentAuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	tokenID, err := authenticateAgent(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, tokenID: tokenID})
+}
+
+// authenticatedStream перепроверяет токен на каждом сообщении агента,
+// чтобы отзыв токена обрывал уже открытый поток задач
+type authenticatedStream struct {
+	grpc.ServerStream
+	tokenID string
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return context.WithValue(s.ServerStream.Context(), agentTokenKey{}, s.tokenID)
+}
+
+func (s *authenticatedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return checkAgentToken(s.tokenID)
+}
+
+// agentTokenRequest — тело POST /api/v1/admin/agent-tokens
+type agentTokenRequest struct {
+	Name     string `json:"name"`
+	TTLHours int    `json:"ttl_hours,omitempty"`
+}
+
+type agentToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Token     string     `json:"token,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func handleAgentTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listAgentTokens(w)
+	case http.MethodPost:
+		mintAgentToken(w, r)
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+func mintAgentToken(w http.ResponseWriter, r *http.Request) {
+	var req agentTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" || req.TTLHours < 0 {
+		http.Error(w, "Name is required and ttl_hours must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("Error generating agent token ID: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	ttl := time.Duration(req.TTLHours) * time.Hour
+	token := agentToken{ID: hex.EncodeToString(raw), Name: req.Name, CreatedAt: now}
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+
+	token.Token, err = auth.GenerateAgentToken(token.ID, token.Name, ttl)
+	if err != nil {
+		log.Printf("Error generating agent token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Time{}
+	if token.ExpiresAt != nil {
+		expiresAt = *token.ExpiresAt
+	}
+	database := db.GetInstance()
+	if err := database.CreateAgentToken(token.ID, token.Name, userID, now, expiresAt); err != nil {
+		log.Printf("Error saving agent token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func listAgentTokens(w http.ResponseWriter) {
+	database := db.GetInstance()
+	dbTokens, err := database.GetAgentTokens()
+	if err != nil {
+		log.Printf("Error receiving agent tokens: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	tokens := make([]agentToken, 0, len(dbTokens))
+	for _, t := range dbTokens {
+		tokens = append(tokens, agentToken{
+			ID:        t.ID,
+			Name:      t.Name,
+			CreatedAt: t.CreatedAt,
+			ExpiresAt: t.ExpiresAt,
+			RevokedAt: t.RevokedAt,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"tokens": tokens})
+}
+
+func handleAgentTokenByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Path[len("/api/v1/admin/agent-tokens/"):]
+
+	database := db.GetInstance()
+	ok, err := database.RevokeAgentToken(id, time.Now())
+	if err != nil {
+		log.Printf("Error revoking agent token %s: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Token not found or already revoked", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "status": "revoked"})
+}
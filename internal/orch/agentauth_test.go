@@ -0,0 +1,172 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestAgentTokens(t *testing.T) {
+	database := db.GetInstance()
+	adminID, err := database.CreateUser("tokenadmin", "password")
+	if err != nil {
+		t.Fatalf("Failed to create admin user: %v", err)
+	}
+	t.Setenv("ADMIN_LOGINS", "tokenadmin")
+
+	admin := func(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), adminID))
+		rr := httptest.NewRecorder()
+		adminOnly(handler)(rr, req)
+		return rr
+	}
+
+	rr := admin(handleAgentTokens, "POST", "/api/v1/admin/agent-tokens", `{"name": "rack-1", "ttl_hours": 24}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Mint returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var minted agentToken
+	json.Unmarshal(rr.Body.Bytes(), &minted)
+	if minted.ID == "" || minted.Token == "" || minted.ExpiresAt == nil {
+		t.Fatalf("Unexpected minted token: %+v", minted)
+	}
+
+	if rr := admin(handleAgentTokens, "POST", "/api/v1/admin/agent-tokens", `{"ttl_hours": 1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Token without name returned %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+
+	if _, err := auth.ValidateToken(minted.Token); err == nil {
+		t.Error("Agent token should not be accepted as a user token")
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server, err := newGRPCServer(Config{RequireAgentAuth: true})
+	if err != nil {
+		t.Fatalf("Failed to create gRPC server: %v", err)
+	}
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewTaskServiceClient(conn)
+
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	userToken, _ := auth.GenerateToken(adminID)
+
+	heartbeatCode := func(ctx context.Context) codes.Code {
+		_, err := client.Heartbeat(ctx, &pb.AgentHeartbeat{AgentId: minted.ID})
+		return status.Code(err)
+	}
+
+	if code := heartbeatCode(context.Background()); code != codes.Unauthenticated {
+		t.Errorf("Call without token returned %v", code)
+	}
+	if code := heartbeatCode(withToken(userToken)); code != codes.Unauthenticated {
+		t.Errorf("Call with user token returned %v", code)
+	}
+	if code := heartbeatCode(withToken(minted.Token)); code != codes.OK {
+		t.Fatalf("Call with agent token returned %v", code)
+	}
+
+	// с одним токеном нельзя назваться другими агентами и взять несколько копий операции
+	for _, agentID := range []string{"a1", "a2"} {
+		_, err := client.GetTask(withToken(minted.Token), &pb.TaskRequest{AgentId: agentID})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("GetTask as %q with a token of %q returned %v", agentID, minted.ID, err)
+		}
+	}
+	if id, err := auth.AgentTokenID(minted.Token); err != nil || id != minted.ID {
+		t.Errorf("Agent should read id %q from its token, got %q (%v)", minted.ID, id, err)
+	}
+
+	ctx, cancel := context.WithTimeout(withToken(minted.Token), 5*time.Second)
+	defer cancel()
+	stream, err := client.TaskStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	if rr := admin(handleAgentTokenByID, "DELETE", "/api/v1/admin/agent-tokens/"+minted.ID, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Revoke returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// отзыв обрывает уже открытый поток на следующем сообщении агента
+	stream.Send(&pb.AgentMessage{Payload: &pb.AgentMessage_Capacity{Capacity: &pb.AgentCapacity{AgentId: minted.ID, Free: 1}}})
+	if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Stream with revoked token returned %v", err)
+	}
+
+	if code := heartbeatCode(withToken(minted.Token)); code != codes.Unauthenticated {
+		t.Errorf("Call with revoked token returned %v", code)
+	}
+
+	if rr := admin(handleAgentTokenByID, "DELETE", "/api/v1/admin/agent-tokens/"+minted.ID, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Second revoke returned %d, expected %d", rr.Code, http.StatusNotFound)
+	}
+
+	rr = admin(handleAgentTokens, "GET", "/api/v1/admin/agent-tokens", "")
+	var list struct {
+		Tokens []agentToken `json:"tokens"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	found := false
+	for _, token := range list.Tokens {
+		if token.ID == minted.ID {
+			found = true
+			if token.RevokedAt == nil || token.Token != "" {
+				t.Errorf("Listed token should be revoked and not expose the secret: %+v", token)
+			}
+		}
+	}
+	if !found {
+		t.Error("Minted token is missing from the list")
+	}
+}
+
+func TestAgentIdentityFromCertificate(t *testing.T) {
+	if err := checkAgentID(context.Background(), "anyone"); err != nil {
+		t.Errorf("Without credentials the agent id is taken on trust, got %v", err)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "rack-2"}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+	}})
+
+	if err := checkAgentID(ctx, "rack-2"); err != nil {
+		t.Errorf("Agent named after its certificate was rejected: %v", err)
+	}
+	if err := checkAgentID(ctx, "rack-3"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Agent with a foreign id returned %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package orch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/agent"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+// agentInfo — агент, зарегистрировавшийся у оркестратора
+type agentInfo struct {
+	ID            string    `json:"id"`
+	Hostname      string    `json:"hostname"`
+	Workers       int       `json:"workers"`
+	Operations    []string  `json:"operations"`
+	Status        string    `json:"status"`
+	RegisteredAt  time.Time `json:"registered_at"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+
+	// сколько раз результат агента разошёлся с большинством при проверяемом выполнении
+	DivergentResults int `json:"divergent_results"`
+}
+
+// agentRegistry хранит известных агентов и время их последнего heartbeat
+type agentRegistry struct {
+	mu     sync.Mutex
+	agents map[string]*agentInfo
+}
+
+var agents = newAgentRegistry()
+
+func newAgentRegistry() *agentRegistry {
+	return &agentRegistry{agents: make(map[string]*agentInfo)}
+}
+
+func getHeartbeatInterval() time.Duration {
+	return time.Duration(pkg.GetEnvInt("AGENT_HEARTBEAT_MS", 1000)) * time.Millisecond
+}
+
+// getDispatchTimeout — сколько задача ждёт в очереди агента, умеющего её выполнить
+func getDispatchTimeout() time.Duration {
+	return time.Duration(pkg.GetEnvInt("TASK_DISPATCH_TIMEOUT_MS", 30000)) * time.Millisecond
+}
+
+// getAgentTimeout — сколько агент может молчать, прежде чем будет признан мёртвым
+func getAgentTimeout() time.Duration {
+	return getHeartbeatInterval() * time.Duration(pkg.GetEnvInt("AGENT_MISSED_HEARTBEATS", 3))
+}
+
+func (r *agentRegistry) register(info agentInfo, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info.Status = "alive"
+	info.RegisteredAt = now
+	info.LastHeartbeat = now
+	// пометки о расхождениях переживают повторную регистрацию
+	if known, ok := r.agents[info.ID]; ok {
+		info.DivergentResults = known.DivergentResults
+	}
+	r.agents[info.ID] = &info
+}
+
+// flagDivergent отмечает, что результат агента не совпал с большинством
+func (r *agentRegistry) flagDivergent(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if agent, ok := r.agents[id]; ok {
+		agent.DivergentResults++
+	}
+}
+
+// heartbeat отмечает, что агент жив. Возвращает false, если агент неизвестен или уже признан мёртвым.
+func (r *agentRegistry) heartbeat(id string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, ok := r.agents[id]
+	if !ok || agent.Status != "alive" {
+		return false
+	}
+	agent.LastHeartbeat = now
+	return true
+}
+
+// expire помечает мёртвыми агентов, молчавших дольше timeout, и возвращает их идентификаторы
+func (r *agentRegistry) expire(now time.Time, timeout time.Duration) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var dead []string
+	for id, agent := range r.agents {
+		if agent.Status == "alive" && now.Sub(agent.LastHeartbeat) > timeout {
+			agent.Status = "dead"
+			dead = append(dead, id)
+		}
+	}
+	sort.Strings(dead)
+	return dead
+}
+
+// supports сообщает, умеет ли агент выполнять операцию.
+// Незарегистрированные агенты и агенты без списка операций считаются универсальными.
+func (r *agentRegistry) supports(id string, operation string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, ok := r.agents[id]
+	if !ok || len(agent.Operations) == 0 {
+		return true
+	}
+	return slices.Contains(agent.Operations, operation)
+}
+
+// servable сообщает, что операцию может выполнить хотя бы один живой агент.
+// Пока живых зарегистрированных агентов нет, подходящий ещё может подключиться.
+func (r *agentRegistry) servable(operation string) bool {
+	live, alive := r.capable(operation)
+	return len(live) > 0 || !alive
+}
+
+// capable возвращает живых агентов, умеющих выполнять операцию, и признак того,
+// что живые зарегистрированные агенты вообще есть
+func (r *agentRegistry) capable(operation string) (map[string]bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	live := make(map[string]bool)
+	alive := false
+	for id, agent := range r.agents {
+		if agent.Status != "alive" {
+			continue
+		}
+		alive = true
+		if len(agent.Operations) == 0 || slices.Contains(agent.Operations, operation) {
+			live[id] = true
+		}
+	}
+	return live, alive
+}
+
+func (r *agentRegistry) list() []agentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]agentInfo, 0, len(r.agents))
+	for _, agent := range r.agents {
+		list = append(list, *agent)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (s *TaskServer) RegisterAgent(ctx context.Context, req *pb.AgentInfo) (*pb.AgentResponse, error) {
+	if req.AgentId == "" {
+		return &pb.AgentResponse{Success: false}, nil
+	}
+	if err := checkAgentID(ctx, req.AgentId); err != nil {
+		return nil, err
+	}
+
+	agents.register(agentInfo{
+		ID:         req.AgentId,
+		Hostname:   req.Hostname,
+		Workers:    int(req.Workers),
+		Operations: req.Operations,
+	}, time.Now())
+	log.Printf("Agent %s registered from %s with %d workers", req.AgentId, req.Hostname, req.Workers)
+
+	return &pb.AgentResponse{Success: true, HeartbeatMs: int32(getHeartbeatInterval().Milliseconds())}, nil
+}
+
+func (s *TaskServer) Heartbeat(ctx context.Context, req *pb.AgentHeartbeat) (*pb.AgentResponse, error) {
+	if err := checkAgentID(ctx, req.AgentId); err != nil {
+		return nil, err
+	}
+
+	ok := agents.heartbeat(req.AgentId, time.Now())
+	return &pb.AgentResponse{Success: ok, HeartbeatMs: int32(getHeartbeatInterval().Milliseconds())}, nil
+}
+
+// runAgentMonitor периодически ищет агентов, пропустивших heartbeat,
+// и задачи, которые оставшиеся агенты не могут выполнить или проверить
+func runAgentMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		expireAgents(now)
+		failUnservableTasks(now)
+		failUnreachableVotes(now)
+	}
+}
+
+// expireAgents помечает молчащих агентов мёртвыми и возвращает в очередь выданные им задачи,
+// не дожидаясь истечения аренды
+func expireAgents(now time.Time) {
+	database := db.GetInstance()
+	for _, id := range agents.expire(now, getAgentTimeout()) {
+		tasks, err := database.GetAgentTasks(id)
+		if err != nil {
+			log.Printf("Error receiving tasks of agent %s: %v", id, err)
+			continue
+		}
+
+		log.Printf("Agent %s missed heartbeats, requeueing %d tasks", id, len(tasks))
+		for _, task := range tasks {
+			requeueTask(task.ID, task.ExpressionID, task.Args, task.Operation, task.Attempts)
+		}
+	}
+}
+
+// failUnservableTasks завершает ошибкой задачи, которые дольше TASK_DISPATCH_TIMEOUT_MS
+// ждут в очереди, хотя живые агенты есть, но их операцию не умеет ни один
+func failUnservableTasks(now time.Time) {
+	orphans := adoptOrphanTasks()
+	tasks := taskQueue.removeStale(now.Add(-getDispatchTimeout()), func(task *pb.Task) bool {
+		return !agents.servable(task.Operation)
+	})
+	for _, task := range tasks {
+		expressionID, ok := expressionOfTask(int(task.Id))
+		if !ok {
+			expressionID, ok = orphans[int(task.Id)]
+		}
+		if !ok {
+			continue
+		}
+		log.Printf("No agent supports operation %s of task %d", task.Operation, task.Id)
+		failTask(int(task.Id), expressionID, fmt.Errorf("no agent supports operation %s", task.Operation))
+	}
+}
+
+// adoptOrphanTasks ставит в очередь невыполненные задачи из базы, которых никто не ждёт
+// (например, оставшиеся от выражений, не восстановленных после перезапуска), если их операцию
+// не умеет ни один живой агент, — так и для них отсчитывается TASK_DISPATCH_TIMEOUT_MS.
+// Просматриваются все такие задачи, а не только первые из тех, что выдаются агентам.
+// Возвращает выражения таких задач по ID.
+func adoptOrphanTasks() map[int]int {
+	var unservable []string
+	for _, name := range agent.OperationNames() {
+		if !agents.servable(name) {
+			unservable = append(unservable, name)
+		}
+	}
+
+	database := db.GetInstance()
+	tasks, err := database.GetUnprocessedTasksByOperation(unservable)
+	if err != nil {
+		log.Printf("Error receiving unprocessed tasks: %v", err)
+		return nil
+	}
+
+	orphans := make(map[int]int)
+	for _, task := range tasks {
+		if _, waiting := expressionOfTask(task.ID); waiting {
+			continue
+		}
+		orphans[task.ID] = task.ExpressionID
+		if !taskQueue.queued(task.ID) {
+			taskQueue.push(newTask(task.ID, task.Operation, task.Args))
+		}
+	}
+	return orphans
+}
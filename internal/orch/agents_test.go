@@ -0,0 +1,241 @@
+package orch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+func TestAgentRegistry(t *testing.T) {
+	registry := newAgentRegistry()
+	now := time.Now()
+
+	registry.register(agentInfo{ID: "a", Workers: 2}, now)
+	registry.register(agentInfo{ID: "b", Workers: 1}, now)
+
+	if registry.heartbeat("unknown", now) {
+		t.Error("Heartbeat of unknown agent should be rejected")
+	}
+	if !registry.heartbeat("a", now.Add(2*time.Second)) {
+		t.Error("Heartbeat of registered agent should be accepted")
+	}
+
+	dead := registry.expire(now.Add(3*time.Second), 2*time.Second)
+	if len(dead) != 1 || dead[0] != "b" {
+		t.Fatalf("Expected only agent b to expire, got %v", dead)
+	}
+	if registry.heartbeat("b", now.Add(3*time.Second)) {
+		t.Error("Heartbeat of dead agent should be rejected")
+	}
+	if dead := registry.expire(now.Add(3*time.Second), 2*time.Second); len(dead) != 0 {
+		t.Errorf("Dead agent should not expire twice, got %v", dead)
+	}
+
+	registry.register(agentInfo{ID: "b", Workers: 1}, now.Add(4*time.Second))
+	list := registry.list()
+	if len(list) != 2 || list[0].ID != "a" || list[1].ID != "b" {
+		t.Fatalf("Unexpected agent list: %+v", list)
+	}
+	if list[1].Status != "alive" {
+		t.Errorf("Re-registered agent should be alive, got %s", list[1].Status)
+	}
+}
+
+func TestServableOperations(t *testing.T) {
+	registry := newAgentRegistry()
+	now := time.Now()
+
+	if !registry.servable("*") {
+		t.Error("Without agents any operation may still be served")
+	}
+
+	registry.register(agentInfo{ID: "adder", Workers: 1, Operations: []string{"+"}}, now)
+	if !registry.servable("+") || registry.servable("*") {
+		t.Error("Only operations of alive agents should be servable")
+	}
+
+	registry.register(agentInfo{ID: "universal", Workers: 1}, now)
+	if !registry.servable("*") {
+		t.Error("Agent without an operation list should serve any operation")
+	}
+
+	registry.heartbeat("adder", now.Add(2*time.Second))
+	registry.expire(now.Add(2*time.Second), time.Second)
+	if registry.servable("*") || !registry.servable("+") {
+		t.Error("Dead agents should not serve operations")
+	}
+}
+
+func TestUnservableOrphanTasks(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("unservableuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	// перед ней в базе больше задач, чем агент просматривает за один опрос
+	filler, err := database.CreateExpression(userID, db.NewExpression{Expression: "1+1"}, "", "", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+	defer database.FinishExpression(filler, "cancelled", 0)
+	for i := 0; i <= unprocessedBatch; i++ {
+		if _, err := database.SaveTask(filler, i, []float64{1, 1}, "+"); err != nil {
+			t.Fatalf("Failed to save task: %v", err)
+		}
+	}
+
+	// задача осталась в базе с прошлого запуска, и её никто не ждёт
+	expressionID, err := database.CreateExpression(userID, db.NewExpression{Expression: "2*3"}, "", "", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+	taskID, err := database.SaveTask(expressionID, 0, []float64{2, 3}, "*")
+	if err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+
+	registered := agents
+	agents = newAgentRegistry()
+	defer func() { agents = registered }()
+	agents.register(agentInfo{ID: "orphan-adder", Workers: 1, Operations: []string{"+"}}, time.Now())
+
+	failUnservableTasks(time.Now())
+	if !taskQueue.queued(taskID) {
+		t.Fatal("Unservable task from the database should be queued to wait for an agent")
+	}
+	if _, status, _, _ := database.GetExpression(expressionID, userID); status != "processing" {
+		t.Fatalf("Expression failed before the dispatch timeout, status %s", status)
+	}
+
+	failUnservableTasks(time.Now().Add(getDispatchTimeout() + time.Second))
+	if taskQueue.queued(taskID) {
+		t.Error("Failed task should leave the queue")
+	}
+	if _, status, _, _ := database.GetExpression(expressionID, userID); status != "error" {
+		t.Errorf("Expected status error, got %s", status)
+	}
+}
+
+func TestDeadAgentTasksRequeued(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("agentuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	if err := database.SaveExpression(expressionID, userID, "7-2", "processing", 0); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+	taskID, err := database.SaveTask(expressionID, 0, []float64{7.0, 2.0}, "-")
+	if err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+	pendingTasks.register(taskID, expressionID)
+	defer func() {
+		pendingTasks.release(expressionID, errExpressionFinished)
+		database.FinishExpression(expressionID, "error", 0)
+	}()
+
+	server := &TaskServer{}
+	resp, _ := server.RegisterAgent(context.Background(), &pb.AgentInfo{AgentId: "agent-lost", Hostname: "host", Workers: 1})
+	if !resp.Success || resp.HeartbeatMs <= 0 {
+		t.Fatalf("RegisterAgent failed: %+v", resp)
+	}
+
+	task, _ := server.GetTask(context.Background(), &pb.TaskRequest{AgentId: "agent-lost"})
+	if int(task.Id) != taskID {
+		t.Fatalf("Expected task %d, got %d", taskID, task.Id)
+	}
+
+	// агент жив — его задачи не трогаем
+	expireAgents(time.Now())
+	if taskQueue.len() != 0 {
+		t.Fatal("Tasks of a live agent should not be requeued")
+	}
+
+	expireAgents(time.Now().Add(time.Hour))
+	requeued := taskQueue.pop(nil)
+	if requeued == nil {
+		t.Fatal("Task of dead agent was not requeued")
+	}
+	if int(requeued.Id) != taskID {
+		t.Fatalf("Expected task %d to be requeued, got %d", taskID, requeued.Id)
+	}
+
+	if _, _, leased, _ := database.GetTaskState(taskID); leased {
+		t.Error("Lease of dead agent's task was not released")
+	}
+
+	lease, _ := server.ExtendLease(context.Background(), &pb.TaskLease{Id: task.Id, AgentId: "agent-lost"})
+	if lease.Success {
+		t.Error("Dead agent should not be able to extend the lease")
+	}
+
+	hb, _ := server.Heartbeat(context.Background(), &pb.AgentHeartbeat{AgentId: "agent-lost"})
+	if hb.Success {
+		t.Error("Heartbeat of dead agent should ask it to register again")
+	}
+}
+
+func TestAdminAgents(t *testing.T) {
+	database := db.GetInstance()
+	adminID, err := database.CreateUser("agentadmin", "password")
+	if err != nil {
+		t.Fatalf("Failed to create admin user: %v", err)
+	}
+	userID, err := database.CreateUser("agentviewer", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	t.Setenv("ADMIN_LOGINS", "root, agentadmin")
+
+	server := &TaskServer{}
+	server.RegisterAgent(context.Background(), &pb.AgentInfo{AgentId: "agent-listed", Hostname: "host", Workers: 4, Operations: []string{"+", "-"}})
+
+	request := func(userID int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/admin/agents", nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		adminOnly(handleAdminAgents)(rr, req)
+		return rr
+	}
+
+	if rr := request(userID); rr.Code != http.StatusForbidden {
+		t.Errorf("Non-admin got %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+
+	rr := request(adminID)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Admin got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Agents []agentInfo `json:"agents"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	found := false
+	for _, agent := range resp.Agents {
+		if agent.ID == "agent-listed" {
+			found = true
+			if agent.Workers != 4 || agent.Status != "alive" || len(agent.Operations) != 2 {
+				t.Errorf("Unexpected agent entry: %+v", agent)
+			}
+		}
+	}
+	if !found {
+		t.Error("Registered agent is missing from the list")
+	}
+}
@@ -0,0 +1,280 @@
+package orch
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+)
+
+var errBatchTooLarge = errors.New("batch is too large")
+
+func getMaxBatchSize() int {
+	return pkg.GetEnvInt("MAX_BATCH_SIZE", 10000)
+}
+
+// batchProgress — сводка по выражениям пакета
+type batchProgress struct {
+	ID          int       `json:"id"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	Total       int       `json:"total"`
+	Processing  int       `json:"processing"`
+	Completed   int       `json:"completed"`
+	Error       int       `json:"error"`
+	Cancelled   int       `json:"cancelled"`
+	Expressions []int     `json:"expressions"`
+}
+
+// handleCalculateBatch принимает пакет выражений: JSON-массив запросов, как у
+// POST /api/v1/calculate, или поток таких запросов по одному в строке (NDJSON).
+// Пакет принимается целиком или не принимается вовсе.
+func handleCalculateBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	reqs, err := decodeBatch(r.Body, getMaxBatchSize())
+	if errors.Is(err, errBatchTooLarge) {
+		http.Error(w, fmt.Sprintf("Batch must contain at most %d expressions", getMaxBatchSize()), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reqs) == 0 {
+		http.Error(w, "Batch is empty", http.StatusBadRequest)
+		return
+	}
+
+	for i, req := range reqs {
+		if err := validateCalculateRequest(req); err != nil {
+			http.Error(w, fmt.Sprintf("expression %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	batchID, ids, err := submitBatch(userID, reqs)
+	var unbound *bindError
+	switch {
+	case errors.As(err, &unbound):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, errLabelTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": batchID, "ids": ids})
+}
+
+// decodeBatch читает запросы пакета. Формат определяется по первому символу:
+// '[' — JSON-массив, иначе — запросы подряд, например по одному в строке.
+func decodeBatch(body io.Reader, limit int) ([]calculateRequest, error) {
+	reader := bufio.NewReader(body)
+	for {
+		c, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c[0] != ' ' && c[0] != '\t' && c[0] != '\n' && c[0] != '\r' {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	first, _ := reader.Peek(1)
+	array := first[0] == '['
+
+	dec := json.NewDecoder(reader)
+	if array {
+		dec.Token()
+	}
+
+	var reqs []calculateRequest
+	for dec.More() {
+		if len(reqs) == limit {
+			return nil, errBatchTooLarge
+		}
+
+		var req calculateRequest
+		if err := dec.Decode(&req); err != nil {
+			return nil, fmt.Errorf("expression %d: %w", len(reqs), err)
+		}
+		reqs = append(reqs, req)
+	}
+
+	if array {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim(']') {
+			return nil, errors.New("unterminated array")
+		}
+	}
+	return reqs, nil
+}
+
+// submitBatch сохраняет выражения пакета одной транзакцией и запускает их вычисление.
+// Ошибка в любом выражении отклоняет весь пакет; в её тексте — номер выражения.
+func submitBatch(userID int, reqs []calculateRequest) (int, []int, error) {
+	expressions := make([]db.NewExpression, len(reqs))
+	labels := make(map[string]bool)
+	withCallback := false
+	for i, req := range reqs {
+		replicas, err := replicasFor(userID, req.Replicas)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		bindings, dependsOn, err := bindVariables(userID, req.Expr, req.Variables)
+		var unbound *bindError
+		if errors.As(err, &unbound) {
+			return 0, nil, &bindError{fmt.Sprintf("expression %d: %s", i, unbound.msg)}
+		}
+		if err != nil {
+			log.Printf("Error binding variables: %v", err)
+			return 0, nil, err
+		}
+
+		if req.Label != "" {
+			if labels[req.Label] {
+				return 0, nil, fmt.Errorf("expression %d: %w", i, errLabelTaken)
+			}
+			labels[req.Label] = true
+		}
+		withCallback = withCallback || req.CallbackURL != ""
+
+		expressions[i] = db.NewExpression{
+			Expression:  req.Expr,
+			Replicas:    replicas,
+			Variables:   bindings,
+			Label:       req.Label,
+			DependsOn:   dependsOn,
+			CallbackURL: req.CallbackURL,
+		}
+	}
+
+	// секрет нужен для подписи уведомлений, создаём его заранее
+	if withCallback {
+		if _, err := webhookSecret(userID); err != nil {
+			log.Printf("Error getting webhook secret: %v", err)
+			return 0, nil, err
+		}
+	}
+
+	database := db.GetInstance()
+
+	mu.Lock()
+	for i, e := range expressions {
+		if e.Label == "" {
+			continue
+		}
+		_, _, _, err := database.FindExpressionByLabel(userID, e.Label)
+		if err == nil {
+			mu.Unlock()
+			return 0, nil, fmt.Errorf("expression %d: %w", i, errLabelTaken)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			mu.Unlock()
+			log.Printf("Error checking label: %v", err)
+			return 0, nil, err
+		}
+	}
+
+	batchID, ids, err := database.SaveBatch(userID, expressions, time.Now())
+	mu.Unlock()
+	if err != nil {
+		log.Printf("Error saving batch: %v", err)
+		return 0, nil, err
+	}
+
+	for i, id := range ids {
+		events.publish(expressionEvent{Type: "accepted", ID: id, Status: "processing"})
+		go parseExpression(id, reqs[i].Expr, expressions[i].Replicas, expressions[i].Variables)
+	}
+
+	log.Printf("Batch %d accepted with %d expressions", batchID, len(ids))
+	return batchID, ids, nil
+}
+
+func handleBatchByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Path[len("/api/v1/batches/"):])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	database := db.GetInstance()
+	batch, err := database.GetBatch(id, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error receiving batch %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	progress := batchProgress{
+		ID:          id,
+		Status:      "completed",
+		CreatedAt:   batch.CreatedAt,
+		Total:       len(batch.Expressions),
+		Expressions: make([]int, 0, len(batch.Expressions)),
+	}
+	for _, exp := range batch.Expressions {
+		progress.Expressions = append(progress.Expressions, exp.ID)
+		switch exp.Status {
+		case "completed":
+			progress.Completed++
+		case "error":
+			progress.Error++
+		case "cancelled":
+			progress.Cancelled++
+		default:
+			progress.Processing++
+		}
+	}
+	// пакет завершён, когда досчитаны все его выражения, с ошибкой или без
+	if progress.Processing > 0 {
+		progress.Status = "processing"
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"batch": progress})
+}
@@ -0,0 +1,136 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+func TestDecodeBatch(t *testing.T) {
+	array := `[{"expression": "1+1"}, {"expression": "2*3", "replicas": 2}]`
+	ndjson := "{\"expression\": \"1+1\"}\n{\"expression\": \"2*3\", \"replicas\": 2}\n"
+
+	for _, body := range []string{array, ndjson, "  \n" + array} {
+		reqs, err := decodeBatch(strings.NewReader(body), 10)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", body, err)
+		}
+		if len(reqs) != 2 || reqs[0].Expr != "1+1" || reqs[1].Replicas != 2 {
+			t.Errorf("%q: unexpected requests %+v", body, reqs)
+		}
+	}
+
+	if reqs, err := decodeBatch(strings.NewReader("[]"), 10); err != nil || len(reqs) != 0 {
+		t.Errorf("Expected an empty batch, got %+v (%v)", reqs, err)
+	}
+	if _, err := decodeBatch(strings.NewReader(array), 1); !errors.Is(err, errBatchTooLarge) {
+		t.Errorf("Expected errBatchTooLarge, got %v", err)
+	}
+	for _, body := range []string{`[{"expression": "1"}`, `{"expression": 1}`, `[1, 2]`} {
+		if _, err := decodeBatch(strings.NewReader(body), 10); err == nil {
+			t.Errorf("%q: expected an error", body)
+		}
+	}
+}
+
+func TestCalculateBatch(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("batchuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	request := func(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	submit := func(body string) *httptest.ResponseRecorder {
+		return request(handleCalculateBatch, "POST", "/api/v1/calculate/batch", body)
+	}
+
+	lastID, _ := database.GetLastExpressionID()
+	rejected := []struct {
+		body string
+		code int
+	}{
+		{`[]`, http.StatusBadRequest},
+		{`[{"expression": "1+1"}, {"expression": "2", "replicas": -1}]`, http.StatusBadRequest},
+		{`[{"expression": "1+1"}, {"expression": "x * 2"}]`, http.StatusUnprocessableEntity},
+		{`[{"expression": "1", "label": "twice"}, {"expression": "2", "label": "twice"}]`, http.StatusConflict},
+	}
+	for _, tc := range rejected {
+		if rr := submit(tc.body); rr.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d: %s", tc.body, tc.code, rr.Code, rr.Body.String())
+		}
+	}
+	if id, _ := database.GetLastExpressionID(); id != lastID {
+		t.Fatalf("Rejected batch should not save expressions, last ID moved from %d to %d", lastID, id)
+	}
+
+	defer startFakeAgent()()
+
+	body := "{\"expression\": \"2+3\", \"label\": \"first\"}\n" +
+		"{\"expression\": \"x*4\", \"variables\": {\"x\": 2}}\n" +
+		"{\"expression\": \"1/0\"}\n"
+	rr := submit(body)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Batch returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var created struct {
+		ID  int   `json:"id"`
+		IDs []int `json:"ids"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if len(created.IDs) != 3 || created.IDs[2]-created.IDs[0] != 2 {
+		t.Fatalf("Expected 3 consecutive IDs, got %v", created.IDs)
+	}
+
+	var progress batchProgress
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rr := request(handleBatchByID, "GET", "/api/v1/batches/"+strconv.Itoa(created.ID), "")
+		var response struct {
+			Batch batchProgress `json:"batch"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		progress = response.Batch
+		if progress.Status == "completed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Batch did not complete: %+v", progress)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if progress.Total != 3 || progress.Completed != 2 || progress.Error != 1 || !slices.Equal(progress.Expressions, created.IDs) {
+		t.Errorf("Unexpected progress: %+v", progress)
+	}
+	if _, _, result, _ := database.GetExpression(created.IDs[1], userID); result != 8 {
+		t.Errorf("Expected 8, got %f", result)
+	}
+	if id, _, _, err := database.FindExpressionByLabel(userID, "first"); err != nil || id != created.IDs[0] {
+		t.Errorf("Label should point to %d, got %d (%v)", created.IDs[0], id, err)
+	}
+
+	if rr := submit(`[{"expression": "$first * 2", "label": "first"}]`); rr.Code != http.StatusConflict {
+		t.Errorf("Existing label: expected %d, got %d", http.StatusConflict, rr.Code)
+	}
+	if rr := request(handleBatchByID, "GET", "/api/v1/batches/999999", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Unknown batch: expected %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
@@ -0,0 +1,58 @@
+package orch
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+var errCancelled = errors.New("expression was cancelled")
+
+// handleCancelExpression отменяет выражение: убирает его задачи из очереди и базы
+// и будит вычислитель. Агентам, которые уже считают его задачи, отмена приходит по потоку задач,
+// а опрашивающие GetTask получат отказ при продлении аренды.
+func handleCancelExpression(w http.ResponseWriter, id int, userID int) {
+	database := db.GetInstance()
+	cancelled, err := database.CancelExpression(id, userID)
+	if err != nil {
+		log.Printf("Error cancelling expression %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !cancelled {
+		if _, _, _, err := database.GetExpression(id, userID); err != nil {
+			http.Error(w, "Expression not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Expression is already finished", http.StatusConflict)
+		return
+	}
+
+	removed := removeQueuedTasks(id)
+	dropped := streamed.cancel(id)
+	deleted, err := database.DeleteUnprocessedTasks(id)
+	if err != nil {
+		log.Printf("Error deleting tasks of expression %d: %v", id, err)
+	}
+	pendingTasks.release(id, errCancelled)
+	votes.release(id)
+	events.publish(expressionEvent{Type: "cancelled", ID: id, Status: "cancelled"})
+
+	log.Printf("Expression %d cancelled: %d queued tasks removed, %d tasks dropped by agents, %d tasks deleted", id, removed, dropped, deleted)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "status": "cancelled"})
+}
+
+// removeQueuedTasks убирает из очереди задачи выражения
+func removeQueuedTasks(expressionID int) int {
+	return taskQueue.removeIf(func(task *pb.Task) bool {
+		owner, ok := expressionOfTask(int(task.Id))
+		return ok && owner == expressionID
+	})
+}
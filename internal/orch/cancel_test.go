@@ -0,0 +1,146 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+func TestCancelExpression(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("canceluser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "(1+2)*(3+4)"}`))
+	req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+	rr := httptest.NewRecorder()
+	handleCalculate(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Calculate returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var created map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	expressionID := created["id"]
+
+	// ждём, пока оба независимых сложения окажутся в очереди
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pendingTasks.mu.Lock()
+		waiting := len(pendingTasks.byExpression[expressionID])
+		pendingTasks.mu.Unlock()
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 waiting tasks, got %d", waiting)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// один из агентов уже взял задачу
+	server := &TaskServer{}
+	held := nextTask(t, expressionID)
+
+	cancel := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/api/v1/expressions/"+strconv.Itoa(expressionID), nil)
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		handleExpressionByID(rr, req)
+		return rr
+	}
+
+	if rr := cancel(); rr.Code != http.StatusOK {
+		t.Fatalf("Cancel returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	for task := taskQueue.pop(nil); task != nil; task = taskQueue.pop(nil) {
+		if owner, ok := pendingTasks.expressionOf(int(task.Id)); ok && owner == expressionID {
+			t.Errorf("Task %d of cancelled expression is still queued", task.Id)
+		}
+		server.SendTaskResult(context.Background(), &pb.TaskResult{Id: task.Id, Result: fakeCompute(task)})
+	}
+
+	resp, _ := server.ExtendLease(context.Background(), &pb.TaskLease{Id: held.Id})
+	if resp.Success {
+		t.Error("Agent holding a task of a cancelled expression should be told to drop it")
+	}
+
+	tasks, _ := database.GetExpressionTasks(expressionID)
+	for _, task := range tasks {
+		if !task.Processed {
+			t.Errorf("Unprocessed task %d was not deleted", task.ID)
+		}
+	}
+
+	// вычислитель разблокирован и не перезаписывает статус
+	time.Sleep(50 * time.Millisecond)
+	_, status, _, err := database.GetExpression(expressionID, userID)
+	if err != nil {
+		t.Fatalf("Failed to get expression: %v", err)
+	}
+	if status != "cancelled" {
+		t.Errorf("Status mismatch: expected cancelled, got %s", status)
+	}
+
+	pendingTasks.mu.Lock()
+	_, stillWaiting := pendingTasks.byExpression[expressionID]
+	pendingTasks.mu.Unlock()
+	if stillWaiting {
+		t.Error("Waiting tasks of cancelled expression were not released")
+	}
+
+	if rr := cancel(); rr.Code != http.StatusConflict {
+		t.Errorf("Second cancel returned %d, expected %d", rr.Code, http.StatusConflict)
+	}
+}
+
+func TestAddTaskAfterCancel(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("latetaskuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	database.SaveExpression(expressionID, userID, "(1+2)*3", "processing", 0)
+	database.CancelExpression(expressionID, userID)
+
+	// результат ребёнка пришёл перед отменой, и вычислитель отправляет родителя уже после неё
+	done := make(chan error, 1)
+	go func() {
+		_, err := addTask(expressionID, 0, "*", []float64{3, 3})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errCancelled) {
+			t.Errorf("Expected errCancelled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Task of a cancelled expression is waited for forever")
+	}
+
+	pendingTasks.mu.Lock()
+	_, waiting := pendingTasks.byExpression[expressionID]
+	pendingTasks.mu.Unlock()
+	if waiting {
+		t.Error("Task of a cancelled expression is still registered")
+	}
+	if removeQueuedTasks(expressionID) != 0 || taskQueue.len() != 0 {
+		t.Error("Task of a cancelled expression was queued")
+	}
+}
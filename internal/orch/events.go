@@ -0,0 +1,200 @@
+package orch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+// expressionEvent — переход выражения или одной из его задач в новое состояние
+type expressionEvent struct {
+	Type      string  `json:"type"`
+	ID        int     `json:"id"`
+	TaskID    int     `json:"task_id,omitempty"`
+	Operation string  `json:"operation,omitempty"`
+	Status    string  `json:"status,omitempty"`
+	Result    float64 `json:"result"`
+}
+
+// terminal сообщает, что после события выражение больше не изменится
+func (e expressionEvent) terminal() bool {
+	return isFinished(e.Status)
+}
+
+func isFinished(status string) bool {
+	return status == "completed" || status == "error" || status == "cancelled"
+}
+
+// eventBroker рассылает события выражений подписчикам
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan expressionEvent]struct{}
+}
+
+var events = newEventBroker()
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[int]map[chan expressionEvent]struct{})}
+}
+
+func (b *eventBroker) subscribe(expressionID int) (<-chan expressionEvent, func()) {
+	ch := make(chan expressionEvent, 64)
+
+	b.mu.Lock()
+	if b.subscribers[expressionID] == nil {
+		b.subscribers[expressionID] = make(map[chan expressionEvent]struct{})
+	}
+	b.subscribers[expressionID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		delete(b.subscribers[expressionID], ch)
+		if len(b.subscribers[expressionID]) == 0 {
+			delete(b.subscribers, expressionID)
+		}
+		b.mu.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+// publish не блокируется: медленный подписчик теряет промежуточные события задач,
+// но не итог выражения — без него поток событий не закроется
+func (b *eventBroker) publish(event expressionEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[event.ID] {
+		select {
+		case ch <- event:
+			continue
+		default:
+		}
+
+		if !event.terminal() {
+			log.Printf("Dropping %s event of expression %d for a slow subscriber", event.Type, event.ID)
+			continue
+		}
+
+		// итог вытесняет самое старое событие; отправляют только под b.mu, поэтому место освободится
+		select {
+		case dropped := <-ch:
+			log.Printf("Dropping %s event of expression %d for a slow subscriber", dropped.Type, dropped.ID)
+		default:
+		}
+		ch <- event
+	}
+}
+
+// finishExpression сохраняет итог выражения, оповещает подписчиков и ставит в очередь уведомления
+func finishExpression(id int, status string, result float64) {
+	database := db.GetInstance()
+	ok, err := database.FinishExpression(id, status, result)
+	if err != nil {
+		log.Printf("Error saving expression %d: %v", id, err)
+		return
+	}
+
+	// выражение уже отменено или завершено другим путём
+	if !ok {
+		return
+	}
+
+	events.publish(expressionEvent{Type: status, ID: id, Status: status, Result: result})
+	scheduleWebhooks(id)
+}
+
+// awaitExpression ждёт итога выражения пользователя. Статус время от времени
+// перечитывается из базы, чтобы не зависеть только от событий.
+func awaitExpression(ctx context.Context, id int, userID int) (string, float64, error) {
+	ch, unsubscribe := events.subscribe(id)
+	defer unsubscribe()
+
+	recheck := time.NewTicker(time.Second)
+	defer recheck.Stop()
+
+	database := db.GetInstance()
+	_, status, result, err := database.GetExpression(id, userID)
+	for err == nil && !isFinished(status) {
+		select {
+		case event := <-ch:
+			if event.terminal() {
+				status, result = event.Status, event.Result
+			}
+		case <-recheck.C:
+			_, status, result, err = database.GetExpression(id, userID)
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		}
+	}
+	return status, result, err
+}
+
+// handleExpressionEvents отдаёт переходы состояния выражения как Server-Sent Events
+func handleExpressionEvents(w http.ResponseWriter, r *http.Request, id int, userID int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// подписываемся до чтения статуса, чтобы не пропустить завершение между ними
+	ch, unsubscribe := events.subscribe(id)
+	defer unsubscribe()
+
+	database := db.GetInstance()
+	_, status, result, err := database.GetExpression(id, userID)
+	if err != nil {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	current := expressionEvent{Type: "accepted", ID: id, Status: status, Result: result}
+	if isFinished(status) {
+		current.Type = status
+	}
+	writeEvent(w, current)
+	flusher.Flush()
+	if current.terminal() {
+		return
+	}
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-ch:
+			writeEvent(w, event)
+			flusher.Flush()
+			if event.terminal() {
+				return
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event expressionEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
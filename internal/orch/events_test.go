@@ -0,0 +1,135 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+func TestExpressionEvents(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("eventsuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "2*3+1"}`))
+	req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+	rr := httptest.NewRecorder()
+	handleCalculate(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Calculate returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var created map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	expressionID := created["id"]
+
+	streamReq := httptest.NewRequest("GET", "/api/v1/expressions/"+strconv.Itoa(expressionID)+"/events", nil)
+	streamReq = streamReq.WithContext(context.WithValue(streamReq.Context(), auth.GetUserIDContextKey(), userID))
+	stream := httptest.NewRecorder()
+
+	finished := make(chan struct{})
+	go func() {
+		handleExpressionByID(stream, streamReq)
+		close(finished)
+	}()
+
+	// агент начинает работу только после подписки, чтобы поток увидел все переходы
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		events.mu.Lock()
+		subscribed := len(events.subscribers[expressionID]) > 0
+		events.mu.Unlock()
+		if subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Stream did not subscribe")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	defer startFakeAgent()()
+
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream was not closed after the expression finished")
+	}
+
+	if ct := stream.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type mismatch: expected text/event-stream, got %s", ct)
+	}
+
+	body := stream.Body.String()
+	var types []string
+	for _, line := range strings.Split(body, "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			types = append(types, name)
+		}
+	}
+
+	expected := []string{"accepted", "task_dispatched", "task_completed", "task_dispatched", "task_completed", "completed"}
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Errorf("Event sequence mismatch:\nexpected %v\ngot      %v", expected, types)
+	}
+
+	if !strings.Contains(body, `"status":"completed","result":7`) {
+		t.Errorf("Final event should carry result 7, got body:\n%s", body)
+	}
+}
+
+func TestExpressionEventsFinished(t *testing.T) {
+	database := db.GetInstance()
+	userID, _ := database.CreateUser("eventsdone", "password")
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	database.SaveExpression(expressionID, userID, "1+1", "completed", 2)
+
+	req := httptest.NewRequest("GET", "/api/v1/expressions/"+strconv.Itoa(expressionID)+"/events", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+	rr := httptest.NewRecorder()
+	handleExpressionByID(rr, req)
+
+	if !strings.HasPrefix(rr.Body.String(), "event: completed\n") {
+		t.Errorf("Expected a single completed event, got:\n%s", rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/expressions/"+strconv.Itoa(expressionID)+"/events", nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID+1))
+	rr = httptest.NewRecorder()
+	handleExpressionByID(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Foreign expression returned %d, expected %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestTerminalEventIsNotDropped(t *testing.T) {
+	broker := newEventBroker()
+	ch, unsubscribe := broker.subscribe(1)
+	defer unsubscribe()
+
+	// подписчик не читает, пока буфер не переполнится
+	for i := 0; i < cap(ch)+10; i++ {
+		broker.publish(expressionEvent{Type: "task_completed", ID: 1, TaskID: i})
+	}
+	broker.publish(expressionEvent{Type: "completed", ID: 1, Status: "completed", Result: 7})
+
+	var last expressionEvent
+	for len(ch) > 0 {
+		last = <-ch
+	}
+	if !last.terminal() || last.Result != 7 {
+		t.Errorf("Expected the terminal event to be delivered last, got %+v", last)
+	}
+}
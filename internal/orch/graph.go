@@ -0,0 +1,217 @@
+package orch
+
+import (
+	"errors"
+	"fmt"
+)
+
+// operand — аргумент узла графа: либо уже известное число, либо результат другого узла
+type operand struct {
+	node   int // индекс узла-источника, -1 если значение известно
+	value  float64
+	negate bool // унарный минус над результатом узла-источника
+}
+
+// graphNode — одна операция, которая отправляется агенту отдельной задачей
+type graphNode struct {
+	op      string
+	args    []operand
+	parent  int // -1 для корня
+	slot    int // номер аргумента у родителя
+	pending int // сколько аргументов ещё не вычислено
+	taskID  int // задача, созданная для узла до перезапуска, 0 если её нет
+	done    bool
+	value   float64
+}
+
+// graph — граф зависимостей операций выражения
+type graph struct {
+	nodes []*graphNode
+	root  operand
+	// сколько разных агентов считают каждую операцию; больше 1 — проверяемое выполнение
+	replicas int
+}
+
+type nodeResult struct {
+	node  int
+	value float64
+	err   error
+}
+
+// compile превращает синтаксическое дерево в граф зависимостей
+func compile(tree node) *graph {
+	g := &graph{}
+	g.root = g.add(tree, -1, 0)
+	return g
+}
+
+func (g *graph) add(n node, parent, slot int) operand {
+	switch n := n.(type) {
+	case *numberNode:
+		return operand{node: -1, value: n.value}
+
+	case *unaryNode:
+		arg := g.add(n.operand, parent, slot)
+		if n.op == "-" {
+			if arg.node < 0 {
+				arg.value = -arg.value
+			} else {
+				arg.negate = !arg.negate
+			}
+		}
+		return arg
+
+	case *binaryNode:
+		idx := len(g.nodes)
+		gn := &graphNode{op: n.op, parent: parent, slot: slot}
+		g.nodes = append(g.nodes, gn)
+
+		gn.args = []operand{g.add(n.left, idx, 0), g.add(n.right, idx, 1)}
+		for _, arg := range gn.args {
+			if arg.node >= 0 {
+				gn.pending++
+			}
+		}
+		return operand{node: idx}
+
+	case *callNode:
+		idx := len(g.nodes)
+		gn := &graphNode{op: n.name, parent: parent, slot: slot}
+		g.nodes = append(g.nodes, gn)
+
+		gn.args = make([]operand, len(n.args))
+		for i, arg := range n.args {
+			gn.args[i] = g.add(arg, idx, i)
+			if gn.args[i].node >= 0 {
+				gn.pending++
+			}
+		}
+		return operand{node: idx}
+	}
+
+	panic(fmt.Sprintf("unknown node %T", n))
+}
+
+// ready возвращает индексы невычисленных узлов, все аргументы которых уже известны.
+// Узлы, чей предок уже вычислен, не нужны.
+func (g *graph) ready() []int {
+	var nodes []int
+	needed := make([]bool, len(g.nodes))
+	for i, n := range g.nodes {
+		// родитель всегда идёт раньше детей
+		needed[i] = !n.done && (n.parent < 0 || needed[n.parent])
+		if needed[i] && n.pending == 0 {
+			nodes = append(nodes, i)
+		}
+	}
+	return nodes
+}
+
+// restore восстанавливает состояние графа по задачам, сохранённым до перезапуска
+func (g *graph) restore(tasks []struct {
+	ID        int
+	Node      int
+	Processed bool
+	Result    float64
+}) {
+	for _, task := range tasks {
+		if task.Node < 0 || task.Node >= len(g.nodes) {
+			continue
+		}
+
+		n := g.nodes[task.Node]
+		if n.done {
+			continue
+		}
+
+		if !task.Processed {
+			n.taskID = task.ID
+			continue
+		}
+
+		n.done = true
+		n.value = task.Result
+		if n.parent >= 0 {
+			g.setArg(n, task.Result)
+		}
+	}
+}
+
+// setArg передаёт результат узла n в аргумент его родителя
+func (g *graph) setArg(n *graphNode, value float64) *graphNode {
+	parent := g.nodes[n.parent]
+	arg := &parent.args[n.slot]
+	arg.value = value
+	if arg.negate {
+		arg.value = -arg.value
+	}
+
+	parent.pending--
+	return parent
+}
+
+func (g *graph) result(value float64) float64 {
+	if g.root.negate {
+		return -value
+	}
+	return value
+}
+
+// run вычисляет граф: все готовые узлы отправляются агентам одновременно,
+// родитель ставится в очередь только когда пришли результаты всех детей
+func (g *graph) run(expressionID int) (float64, error) {
+	if g.root.node < 0 {
+		return g.root.value, nil
+	}
+
+	// корень мог быть вычислен ещё до перезапуска
+	if root := g.nodes[g.root.node]; root.done {
+		return g.result(root.value), nil
+	}
+
+	results := make(chan nodeResult, len(g.nodes))
+
+	// ошибки операций вроде деления на ноль сообщает агент, выполняя её по реестру
+	dispatch := func(i int) {
+		n := g.nodes[i]
+		args := make([]float64, len(n.args))
+		for j, arg := range n.args {
+			args[j] = arg.value
+		}
+
+		go func() {
+			var value float64
+			var err error
+			if n.taskID != 0 {
+				value, err = resumeTask(expressionID, n.taskID, n.op, args)
+			} else if g.replicas > 1 {
+				value, err = addReplicatedTask(expressionID, i, n.op, args, g.replicas)
+			} else {
+				value, err = addTask(expressionID, i, n.op, args)
+			}
+			results <- nodeResult{node: i, value: value, err: err}
+		}()
+	}
+
+	for _, i := range g.ready() {
+		dispatch(i)
+	}
+
+	for res := range results {
+		if res.err != nil {
+			return 0, res.err
+		}
+
+		n := g.nodes[res.node]
+		if n.parent < 0 {
+			return g.result(res.value), nil
+		}
+
+		parent := g.setArg(n, res.value)
+		if parent.pending == 0 {
+			dispatch(n.parent)
+		}
+	}
+
+	return 0, errors.New("evaluation stopped unexpectedly")
+}
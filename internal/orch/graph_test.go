@@ -0,0 +1,161 @@
+package orch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+func TestCompile(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  string
+		nodes  int
+		ready  int
+		root   float64
+		negate bool
+	}{
+		{"Constant", "-(5)", 0, 0, -5, false},
+		{"Single operation", "2+3", 1, 1, 0, false},
+		{"Independent branches", "(1+2)*(3+4)", 3, 2, 0, false},
+		{"Chain", "1+2+3+4", 3, 1, 0, false},
+		{"Balanced tree", "((1+2)*(3+4))-((5+6)/(7+8))", 7, 4, 0, false},
+		{"Negated root", "-(1+2)", 1, 1, 0, true},
+		{"Function arguments", "max(1+2, 3*4, 5)", 3, 2, 0, false},
+		{"Function of constants", "sqrt(16)", 1, 1, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := tokenize(tc.input)
+			if err != nil {
+				t.Fatalf("%s: tokenize failed: %v", tc.name, err)
+			}
+
+			tree, err := parse(tokens, nil)
+			if err != nil {
+				t.Fatalf("%s: parse failed: %v", tc.name, err)
+			}
+
+			g := compile(tree)
+			if len(g.nodes) != tc.nodes {
+				t.Errorf("%s: expected %d nodes, got %d", tc.name, tc.nodes, len(g.nodes))
+			}
+
+			if ready := g.ready(); len(ready) != tc.ready {
+				t.Errorf("%s: expected %d ready nodes, got %d", tc.name, tc.ready, len(ready))
+			}
+
+			if tc.nodes == 0 && g.root.value != tc.root {
+				t.Errorf("%s: expected constant %f, got %f", tc.name, tc.root, g.root.value)
+			}
+
+			if g.root.negate != tc.negate {
+				t.Errorf("%s: expected root negate %v, got %v", tc.name, tc.negate, g.root.negate)
+			}
+		})
+	}
+}
+
+func TestCompileNegatedOperand(t *testing.T) {
+	tokens, _ := tokenize("2*-(3+4)")
+	tree, err := parse(tokens, nil)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	g := compile(tree)
+	if len(g.nodes) != 2 {
+		t.Fatalf("Expected 2 nodes, got %d", len(g.nodes))
+	}
+
+	mul := g.nodes[0]
+	if mul.op != "*" || mul.pending != 1 {
+		t.Errorf("Expected * with one pending argument, got %s with %d", mul.op, mul.pending)
+	}
+
+	if !mul.args[1].negate || mul.args[1].node != 1 {
+		t.Errorf("Expected negated reference to node 1, got %+v", mul.args[1])
+	}
+
+	if sum := g.nodes[1]; sum.parent != 0 || sum.slot != 1 {
+		t.Errorf("Expected sum to feed slot 1 of node 0, got parent %d slot %d", sum.parent, sum.slot)
+	}
+}
+
+func TestRunDispatchesIndependentNodesConcurrently(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("graphuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	database.SaveExpression(expressionID, userID, "(1+2)*(3+4)", "processing", 0)
+	defer database.FinishExpression(expressionID, "completed", 21)
+
+	tokens, _ := tokenize("(1+2)*(3+4)")
+	tree, err := parse(tokens, nil)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	done := make(chan nodeResult, 1)
+	go func() {
+		value, err := compile(tree).run(expressionID)
+		done <- nodeResult{value: value, err: err}
+	}()
+
+	// оба сложения должны оказаться в очереди до ответа на любое из них
+	first := nextTask(t, expressionID)
+	second := nextTask(t, expressionID)
+	if first.Operation != "+" || second.Operation != "+" {
+		t.Fatalf("Expected two additions, got %s and %s", first.Operation, second.Operation)
+	}
+
+	server := &TaskServer{}
+	for _, task := range []*pb.Task{first, second} {
+		server.SendTaskResult(context.Background(), &pb.TaskResult{Id: task.Id, Result: fakeCompute(task)})
+	}
+
+	product := nextTask(t, expressionID)
+	if product.Operation != "*" || product.Arg1 != 3 || product.Arg2 != 7 {
+		t.Fatalf("Expected 3 * 7, got %f %s %f", product.Arg1, product.Operation, product.Arg2)
+	}
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: product.Id, Result: 21})
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.value != 21 {
+			t.Errorf("Expected 21, got (%f, %v)", res.value, res.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Evaluation did not finish")
+	}
+}
+
+// nextTask ждёт задачу выражения expressionID и берёт её в аренду, как агент с пустым ID.
+// Задачи других выражений выполняются сразу.
+func nextTask(t *testing.T, expressionID int) *pb.Task {
+	t.Helper()
+
+	server := &TaskServer{}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		task := queuedTask(time.Until(deadline))
+		if task == nil {
+			t.Fatalf("No task for expression %d", expressionID)
+			return nil
+		}
+		if !leaseTask(task, "") {
+			continue
+		}
+		if owner, ok := pendingTasks.expressionOf(int(task.Id)); ok && owner == expressionID {
+			return task
+		}
+		server.SendTaskResult(context.Background(), &pb.TaskResult{Id: task.Id, Result: fakeCompute(task)})
+	}
+}
@@ -0,0 +1,88 @@
+package orch
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+)
+
+var errIdempotencyMismatch = errors.New("idempotency key was already used for a different request")
+
+// idempotentReplay — запрос повторён с тем же ключом; id — выражение, созданное первым запросом
+type idempotentReplay struct {
+	id int
+}
+
+func (e *idempotentReplay) Error() string {
+	return fmt.Sprintf("request was already accepted as expression %d", e.id)
+}
+
+// getIdempotencyTTL — сколько хранится ключ идемпотентности
+func getIdempotencyTTL() time.Duration {
+	return time.Duration(pkg.GetEnvInt("IDEMPOTENCY_TTL_HOURS", 24)) * time.Hour
+}
+
+func validateIdempotencyKey(key string) error {
+	if len(key) > 255 {
+		return errors.New("Idempotency-Key must be at most 255 characters")
+	}
+	for _, c := range key {
+		if c < ' ' || c > '~' {
+			return errors.New("Idempotency-Key must contain only printable ASCII characters")
+		}
+	}
+	return nil
+}
+
+// requestFingerprint — отпечаток запроса: одинаковые по смыслу тела дают одинаковый отпечаток
+func requestFingerprint(req calculateRequest) string {
+	encoded, _ := json.Marshal(req)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkIdempotencyKey проверяет, не принимался ли уже запрос с этим ключом.
+// Возвращает *idempotentReplay, если принимался, и errIdempotencyMismatch,
+// если ключ использован для другого запроса.
+func checkIdempotencyKey(userID int, req calculateRequest) error {
+	database := db.GetInstance()
+	id, fingerprint, err := database.FindIdempotencyKey(userID, req.IdempotencyKey, time.Now().Add(-getIdempotencyTTL()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error checking idempotency key: %v", err)
+		return err
+	}
+
+	if fingerprint != requestFingerprint(req) {
+		return errIdempotencyMismatch
+	}
+	return &idempotentReplay{id: id}
+}
+
+// runIdempotencyJanitor удаляет ключи идемпотентности старше срока хранения
+func runIdempotencyJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		database := db.GetInstance()
+		n, err := database.DeleteExpiredIdempotencyKeys(time.Now().Add(-getIdempotencyTTL()))
+		if err != nil {
+			log.Printf("Error deleting expired idempotency keys: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Deleted %d expired idempotency keys", n)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("idempotentuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	otherID, _ := database.CreateUser("idempotentother", "password")
+
+	calculate := func(userID int, key, body string) (int, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		handleCalculate(rr, req)
+
+		var created map[string]int
+		json.Unmarshal(rr.Body.Bytes(), &created)
+		return created["id"], rr
+	}
+
+	firstID, rr := calculate(userID, "retry-1", `{"expression": "2+2"}`)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("First request returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// повторы, в том числе одновременные, получают то же выражение
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, rr := calculate(userID, "retry-1", `{ "expression": "2+2" }`)
+			if rr.Code != http.StatusCreated || id != firstID || rr.Header().Get("Idempotent-Replayed") != "true" {
+				t.Errorf("Retry returned %d with id %d, expected replay of %d", rr.Code, id, firstID)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, rr := calculate(userID, "retry-1", `{"expression": "3+3"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Reused key: expected %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	if id, rr := calculate(otherID, "retry-1", `{"expression": "2+2"}`); rr.Code != http.StatusCreated || id == firstID {
+		t.Errorf("Keys of different users should not collide, got %d with id %d", rr.Code, id)
+	}
+	if _, rr := calculate(userID, strings.Repeat("k", 256), `{"expression": "2+2"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Long key: expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// после срока хранения ключ можно использовать заново
+	time.Sleep(2 * time.Millisecond)
+	t.Setenv("IDEMPOTENCY_TTL_HOURS", "0")
+	if id, rr := calculate(userID, "retry-1", `{"expression": "3+3"}`); rr.Code != http.StatusCreated || id == firstID {
+		t.Errorf("Expired key should create a new expression, got %d with id %d", rr.Code, id)
+	}
+
+	expressions, _ := database.GetAllExpressions(userID)
+	if len(expressions) != 2 {
+		t.Errorf("Expected 2 expressions, got %d", len(expressions))
+	}
+
+	// досчитываем созданные выражения, чтобы их задачи не остались в очереди
+	defer startFakeAgent()()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, owner := range []int{userID, otherID} {
+		expressions, _ := database.GetAllExpressions(owner)
+		for _, exp := range expressions {
+			for !isFinished(exp.Status) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Expression %d did not complete, status %s", exp.ID, exp.Status)
+				}
+				time.Sleep(5 * time.Millisecond)
+				_, exp.Status, _, _ = database.GetExpression(exp.ID, owner)
+			}
+		}
+	}
+}
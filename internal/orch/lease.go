@@ -0,0 +1,113 @@
+package orch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+func getLeaseDuration() time.Duration {
+	return time.Duration(pkg.GetEnvInt("TASK_LEASE_MS", 5000)) * time.Millisecond
+}
+
+func getMaxAttempts() int {
+	return pkg.GetEnvInt("TASK_MAX_ATTEMPTS", 3)
+}
+
+// leaseTask закрепляет задачу за агентом перед выдачей.
+// Возвращает false, если задачу выдавать уже не нужно.
+func leaseTask(task *pb.Task, agentID string) bool {
+	lease := getLeaseDuration()
+
+	database := db.GetInstance()
+	ok, err := database.LeaseTask(int(task.Id), agentID, time.Now().Add(lease))
+	if err != nil {
+		log.Printf("Error leasing task %d: %v", task.Id, err)
+		return false
+	}
+
+	task.LeaseMs = int32(lease.Milliseconds())
+	if ok {
+		votes.leased(int(task.Id), agentID)
+		if expressionID, waiting := expressionOfTask(int(task.Id)); waiting {
+			events.publish(expressionEvent{Type: "task_dispatched", ID: expressionID, TaskID: int(task.Id), Operation: task.Operation})
+		}
+	}
+	return ok
+}
+
+func (s *TaskServer) ExtendLease(ctx context.Context, req *pb.TaskLease) (*pb.TaskResponse, error) {
+	if err := checkAgentID(ctx, req.AgentId); err != nil {
+		return nil, err
+	}
+
+	database := db.GetInstance()
+	ok, err := database.ExtendTaskLease(int(req.Id), req.AgentId, time.Now().Add(getLeaseDuration()))
+	if err != nil {
+		log.Printf("Error extending lease of task %d: %v", req.Id, err)
+		return &pb.TaskResponse{Success: false}, nil
+	}
+
+	return &pb.TaskResponse{Success: ok}, nil
+}
+
+// runLeaseReaper периодически возвращает в очередь задачи с истёкшей арендой
+func runLeaseReaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		reapExpiredLeases(now)
+	}
+}
+
+func reapExpiredLeases(now time.Time) {
+	database := db.GetInstance()
+	expired, err := database.GetExpiredTasks(now)
+	if err != nil {
+		log.Printf("Error receiving expired tasks: %v", err)
+		return
+	}
+
+	for _, task := range expired {
+		log.Printf("Lease of task %d expired", task.ID)
+		requeueTask(task.ID, task.ExpressionID, task.Args, task.Operation, task.Attempts)
+	}
+}
+
+// requeueTask снимает аренду и возвращает задачу в очередь, а если попытки исчерпаны — завершает её ошибкой
+func requeueTask(taskID, expressionID int, args []float64, op string, attempts int) {
+	maxAttempts := getMaxAttempts()
+	if attempts >= maxAttempts {
+		log.Printf("Task %d of expression %d failed after %d attempts", taskID, expressionID, attempts)
+		failTask(taskID, expressionID, fmt.Errorf("task %d failed after %d attempts", taskID, attempts))
+		return
+	}
+
+	database := db.GetInstance()
+	if err := database.ReleaseTaskLease(taskID); err != nil {
+		log.Printf("Error releasing lease of task %d: %v", taskID, err)
+		return
+	}
+
+	log.Printf("Requeueing task %d (attempt %d of %d)", taskID, attempts, maxAttempts)
+	taskQueue.push(newTask(taskID, op, args))
+}
+
+// failTask завершает ожидание задачи ошибкой; если её никто не ждёт, выражение помечается ошибочным сразу
+func failTask(taskID, expressionID int, err error) {
+	// у копии ошибкой завершается вся операция
+	if head, ok := votes.headOf(taskID); ok {
+		taskID = head
+	}
+	if pendingTasks.resolve(taskID, taskOutcome{err: err}) {
+		return
+	}
+
+	finishExpression(expressionID, "error", 0)
+}
@@ -0,0 +1,114 @@
+package orch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+func TestLeaseExpiryRequeuesAndFails(t *testing.T) {
+	database := db.GetInstance()
+
+	userID, err := database.CreateUser("leaseuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	lastID, err := database.GetLastExpressionID()
+	if err != nil {
+		t.Fatalf("Failed to get last expression ID: %v", err)
+	}
+
+	expressionID := lastID + 1
+	if err := database.SaveExpression(expressionID, userID, "6/3", "processing", 0); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+
+	taskID, err := database.SaveTask(expressionID, 0, []float64{6.0, 3.0}, "/")
+	if err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+	waiting := pendingTasks.register(taskID, expressionID)
+
+	server := &TaskServer{}
+	task, err := server.GetTask(context.Background(), &pb.TaskRequest{})
+	if err != nil {
+		t.Fatalf("GetTask failed: %v", err)
+	}
+	if int(task.Id) != taskID || task.LeaseMs <= 0 {
+		t.Fatalf("Expected leased task %d, got %d with lease %d", taskID, task.Id, task.LeaseMs)
+	}
+
+	// аренда ещё действует — в очередь ничего не возвращается
+	reapExpiredLeases(time.Now())
+	if taskQueue.len() != 0 {
+		t.Fatalf("Task with an active lease should not be requeued")
+	}
+
+	resp, err := server.ExtendLease(context.Background(), &pb.TaskLease{Id: task.Id})
+	if err != nil || !resp.Success {
+		t.Fatalf("ExtendLease failed: %v", err)
+	}
+
+	for attempt := 2; attempt <= getMaxAttempts(); attempt++ {
+		reapExpiredLeases(time.Now().Add(time.Hour))
+
+		if taskQueue.len() != 1 {
+			t.Fatalf("Expired task was not requeued on attempt %d", attempt)
+		}
+
+		task, err = server.GetTask(context.Background(), &pb.TaskRequest{})
+		if err != nil || int(task.Id) != taskID {
+			t.Fatalf("Expected task %d on attempt %d, got %d (%v)", taskID, attempt, task.Id, err)
+		}
+	}
+
+	// попытки исчерпаны — ожидающий вычислитель получает ошибку
+	reapExpiredLeases(time.Now().Add(time.Hour))
+	select {
+	case outcome := <-waiting:
+		if outcome.err == nil {
+			t.Error("Expected an error after max attempts")
+		}
+	default:
+		t.Fatal("Waiting evaluator was not notified about the failed task")
+	}
+
+	if taskQueue.len() != 0 {
+		t.Error("Failed task should not be requeued")
+	}
+}
+
+func TestFailTaskWithoutWaiter(t *testing.T) {
+	database := db.GetInstance()
+
+	userID, err := database.CreateUser("orphanuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	if err := database.SaveExpression(expressionID, userID, "1+1", "processing", 0); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+
+	taskID, err := database.SaveTask(expressionID, 0, []float64{1.0, 1.0}, "+")
+	if err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+
+	failTask(taskID, expressionID, errors.New("lost"))
+
+	_, status, _, err := database.GetExpression(expressionID, userID)
+	if err != nil {
+		t.Fatalf("Failed to get expression: %v", err)
+	}
+	if status != "error" {
+		t.Errorf("Status mismatch: expected error, got %s", status)
+	}
+}
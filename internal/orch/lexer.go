@@ -0,0 +1,133 @@
+package orch
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type tokenKind int
+
+const (
+	tokenNumber tokenKind = iota
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenIdent
+	tokenComma
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value float64
+	pos   int
+}
+
+// tokenize разбивает выражение на числа, имена, операторы, скобки и запятые, пропуская пробелы
+func tokenize(expression string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(expression); {
+		c := expression[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '/' && i+1 < len(expression) && expression[i+1] == '/':
+			tokens = append(tokens, token{kind: tokenOperator, text: "//", pos: i})
+			i += 2
+
+		case c == '+' || c == '-' || c == '*' || c == '/' || c == '%' || c == '^':
+			tokens = append(tokens, token{kind: tokenOperator, text: string(c), pos: i})
+			i++
+
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+
+		case isLetter(c):
+			end := i + 1
+			for end < len(expression) && (isLetter(expression[end]) || isDigit(expression[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: expression[i:end], pos: i})
+			i = end
+
+		// $42 и $label — ссылки на результаты других выражений пользователя.
+		// Метка, как и имя переменной, состоит из латинских букв, цифр и _.
+		case c == '$':
+			end := i + 1
+			for end < len(expression) && (isLetter(expression[end]) || isDigit(expression[end])) {
+				end++
+			}
+			if end == i+1 {
+				return nil, fmt.Errorf("missing expression reference after '$' at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: expression[i:end], pos: i})
+			i = end
+
+		case isDigit(c) || c == '.':
+			end := scanNumber(expression, i)
+			text := expression[i:end]
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", text, i)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, value: value, pos: i})
+			i = end
+
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+// scanNumber возвращает позицию конца числа: целая часть, дробная часть и экспонента
+func scanNumber(s string, start int) int {
+	i := start
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+
+	// экспоненту забираем только если за ней действительно идут цифры
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
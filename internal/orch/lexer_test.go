@@ -0,0 +1,97 @@
+package orch
+
+import (
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected []token
+	}{
+		{"Multi-digit", "12+3", []token{
+			{kind: tokenNumber, value: 12},
+			{kind: tokenOperator, text: "+"},
+			{kind: tokenNumber, value: 3},
+		}},
+		{"Decimal", "12+3.5", []token{
+			{kind: tokenNumber, value: 12},
+			{kind: tokenOperator, text: "+"},
+			{kind: tokenNumber, value: 3.5},
+		}},
+		{"Leading dot", ".5*2", []token{
+			{kind: tokenNumber, value: 0.5},
+			{kind: tokenOperator, text: "*"},
+			{kind: tokenNumber, value: 2},
+		}},
+		{"Scientific", "1e-3/2E2", []token{
+			{kind: tokenNumber, value: 0.001},
+			{kind: tokenOperator, text: "/"},
+			{kind: tokenNumber, value: 200},
+		}},
+		{"Integer division", "7//2%3^2", []token{
+			{kind: tokenNumber, value: 7},
+			{kind: tokenOperator, text: "//"},
+			{kind: tokenNumber, value: 2},
+			{kind: tokenOperator, text: "%"},
+			{kind: tokenNumber, value: 3},
+			{kind: tokenOperator, text: "^"},
+			{kind: tokenNumber, value: 2},
+		}},
+		{"Function call", "max(x_1,2)", []token{
+			{kind: tokenIdent, text: "max"},
+			{kind: tokenLParen, text: "("},
+			{kind: tokenIdent, text: "x_1"},
+			{kind: tokenComma, text: ","},
+			{kind: tokenNumber, value: 2},
+			{kind: tokenRParen, text: ")"},
+		}},
+		{"References", "$42+$total_2", []token{
+			{kind: tokenIdent, text: "$42"},
+			{kind: tokenOperator, text: "+"},
+			{kind: tokenIdent, text: "$total_2"},
+		}},
+		{"Whitespace and parens", " ( 7 - 1 ) ", []token{
+			{kind: tokenLParen, text: "("},
+			{kind: tokenNumber, value: 7},
+			{kind: tokenOperator, text: "-"},
+			{kind: tokenNumber, value: 1},
+			{kind: tokenRParen, text: ")"},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := tokenize(tc.input)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", tc.name, err)
+			}
+
+			if len(tokens) != len(tc.expected) {
+				t.Fatalf("%s: expected %d tokens, got %d", tc.name, len(tc.expected), len(tokens))
+			}
+
+			for i, tok := range tokens {
+				want := tc.expected[i]
+				if tok.kind != want.kind {
+					t.Errorf("%s: token %d kind mismatch: expected %d, got %d", tc.name, i, want.kind, tok.kind)
+				}
+				if want.kind == tokenNumber && tok.value != want.value {
+					t.Errorf("%s: token %d value mismatch: expected %f, got %f", tc.name, i, want.value, tok.value)
+				}
+				if want.kind != tokenNumber && tok.text != want.text {
+					t.Errorf("%s: token %d text mismatch: expected %s, got %s", tc.name, i, want.text, tok.text)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenizeErrors(t *testing.T) {
+	for _, input := range []string{"2&3", ".", "1#", "sqrt(4);", "$+1"} {
+		if _, err := tokenize(input); err == nil {
+			t.Errorf("Expected error for %q, got nil", input)
+		}
+	}
+}
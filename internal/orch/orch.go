@@ -2,31 +2,55 @@ package orch
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/Solmorn/Distributed-calculations/internal/agent"
 	"github.com/Solmorn/Distributed-calculations/internal/auth"
 	"github.com/Solmorn/Distributed-calculations/internal/db"
 	"github.com/Solmorn/Distributed-calculations/pkg"
 	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+// calculateRequest — тело POST /api/v1/calculate
+type calculateRequest struct {
+	Expr        string `json:"expression"`
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Replicas — сколько разных агентов должны посчитать каждую операцию
+	Replicas int `json:"replicas,omitempty"`
+	// Variables — значения имён, использованных в выражении
+	Variables map[string]float64 `json:"variables,omitempty"`
+	// Label — имя, по которому на результат можно сослаться из других выражений как $label
+	Label string `json:"label,omitempty"`
+	// IdempotencyKey — заголовок Idempotency-Key; в отпечаток запроса не входит
+	IdempotencyKey string `json:"-"`
+}
+
 type Expression struct {
-	ID     int     `json:"id"`
-	Expr   string  `json:"expression"`
-	Status string  `json:"status"`
-	Result float64 `json:"result"`
+	ID        int                `json:"id"`
+	Expr      string             `json:"expression"`
+	Status    string             `json:"status"`
+	Result    float64            `json:"result"`
+	Variables map[string]float64 `json:"variables,omitempty"`
+	Label     string             `json:"label,omitempty"`
+	DependsOn []int              `json:"depends_on,omitempty"`
 }
 
 var (
-	taskQueue     = make(chan *pb.Task, 100)
-	chTaskResults = make(map[int]chan float64)
-	mu            sync.Mutex
+	taskQueue    = newDispatchQueue()
+	pendingTasks = newTaskRegistry()
+	mu           sync.Mutex
 )
 
 type TaskServer struct {
@@ -34,258 +58,520 @@ type TaskServer struct {
 }
 
 func (s *TaskServer) GetTask(ctx context.Context, req *pb.TaskRequest) (*pb.Task, error) {
-	select {
-	case task := <-taskQueue:
+	if err := checkAgentID(ctx, req.AgentId); err != nil {
+		return nil, err
+	}
+
+	if task := pollTask(req.AgentId); task != nil {
 		return task, nil
-	default:
-		database := db.GetInstance()
-		unprocessedTasks, err := database.GetUnprocessedTasks(1)
-		if err != nil {
-			log.Printf("Error receiving unprocessed tasks: %v", err)
-			return &pb.Task{HasTask: false}, nil
+	}
+	return &pb.Task{HasTask: false}, nil
+}
+
+// pollTask выдаёт агенту подходящую задачу из очереди, а если там таких нет — из базы.
+// Возвращает nil, если выдавать нечего.
+func pollTask(agentID string) *pb.Task {
+	if task := popTask(agentID); task != nil {
+		return task
+	}
+
+	database := db.GetInstance()
+	unprocessedTasks, err := database.GetUnprocessedTasks(unprocessedBatch)
+	if err != nil {
+		log.Printf("Error receiving unprocessed tasks: %v", err)
+		return nil
+	}
+
+	accept := acceptsTask(agentID)
+	for _, task := range unprocessedTasks {
+		pbTask := newTask(task.ID, task.Operation, task.Args)
+		if accept(pbTask) && leaseTask(pbTask, agentID) {
+			return pbTask
 		}
+	}
+
+	return nil
+}
 
-		if len(unprocessedTasks) > 0 {
-			task := unprocessedTasks[0]
-			opTime := getOperationTime(task.Operation)
-			return &pb.Task{
-				Id:            int32(task.ID),
-				Arg1:          task.Arg1,
-				Arg2:          task.Arg2,
-				Operation:     task.Operation,
-				OperationTime: int32(opTime),
-				HasTask:       true,
-			}, nil
+// сколько невыполненных задач просматривается в базе в поиске подходящей агенту
+const unprocessedBatch = 20
+
+// popTask выдаёт агенту первую подходящую ему задачу из очереди
+func popTask(agentID string) *pb.Task {
+	accept := acceptsTask(agentID)
+	for {
+		task := taskQueue.pop(accept)
+		if task == nil {
+			return nil
+		}
+		// задача могла быть уже выполнена по предыдущей аренде
+		if leaseTask(task, agentID) {
+			return task
 		}
+	}
+}
 
-		return &pb.Task{HasTask: false}, nil
+// acceptsTask отбирает задачи, которые можно выдать агенту: операцию он умеет выполнять
+// и другую копию той же операции не считает
+func acceptsTask(agentID string) func(*pb.Task) bool {
+	return func(task *pb.Task) bool {
+		return agents.supports(agentID, task.Operation) && !votes.excludes(int(task.Id), agentID)
 	}
 }
 
 func (s *TaskServer) SendTaskResult(ctx context.Context, result *pb.TaskResult) (*pb.TaskResponse, error) {
+	if err := checkAgentID(ctx, result.AgentId); err != nil {
+		return nil, err
+	}
+
+	// результат или ошибка копии учитывается голосованием, а не принимается сразу
+	if _, replicated := votes.headOf(int(result.Id)); replicated {
+		return &pb.TaskResponse{Success: acceptVote(result)}, nil
+	}
+
 	database := db.GetInstance()
-	err := database.UpdateTaskResult(int(result.Id), result.Result)
+
+	// агент не смог выполнить операцию — выражение завершается с его ошибкой,
+	// если задача выдана именно ему
+	if result.Error != "" {
+		expressionID, ok := expressionOfTask(int(result.Id))
+		if !ok {
+			return &pb.TaskResponse{Success: false}, nil
+		}
+		leased, err := database.ReleaseFailedTask(int(result.Id), result.AgentId)
+		if err != nil {
+			log.Printf("Error releasing the failed task: %v", err)
+			return &pb.TaskResponse{Success: false}, nil
+		}
+		if !leased {
+			log.Printf("Rejected error of task %d from agent %q: task is not leased to it", result.Id, result.AgentId)
+			return &pb.TaskResponse{Success: false}, nil
+		}
+		log.Printf("Task %d failed on agent %q: %s", result.Id, result.AgentId, result.Error)
+		failTask(int(result.Id), expressionID, errors.New(result.Error))
+		return &pb.TaskResponse{Success: true}, nil
+	}
+
+	// результат принимается только от агента, которому выдана задача, и только один раз
+	saved, err := database.SubmitTaskResult(int(result.Id), result.AgentId, result.Result)
 	if err != nil {
 		log.Printf("Error saving the task result: %v", err)
 		return &pb.TaskResponse{Success: false}, nil
 	}
-
-	mu.Lock()
-	ch, exists := chTaskResults[int(result.Id)]
-	mu.Unlock()
-
-	if exists {
-		ch <- result.Result
+	if !saved {
+		log.Printf("Rejected result of task %d from agent %q: task is not leased to it", result.Id, result.AgentId)
+		return &pb.TaskResponse{Success: false}, nil
 	}
 
+	pendingTasks.resolve(int(result.Id), taskOutcome{value: result.Result})
+
 	return &pb.TaskResponse{Success: true}, nil
 }
 
-func RunOrchestrator() {
+// Config — адреса, на которых оркестратор принимает запросы
+type Config struct {
+	HTTPAddr string // REST API для клиентов
+	GRPCAddr string // TaskService для агентов
+
+	// TLS для gRPC: без сертификата сервер работает без шифрования,
+	// с TLSClientCA требует от агентов клиентский сертификат (mTLS)
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	// RequireAgentAuth — пускать к TaskService только агентов с действующим токеном
+	RequireAgentAuth bool
+}
+
+func RunOrchestrator(cfg Config) {
+	// Продолжаем выражения, которые не успели досчитаться до перезапуска
+	recoverExpressions()
+	recoverSheets()
+	recoverWebhooks()
+
+	// Возвращаем в очередь задачи, агенты которых пропали
+	go runLeaseReaper(time.Second)
+
+	// Помечаем мёртвыми агентов, переставших присылать heartbeat
+	go runAgentMonitor(time.Second)
+
+	// Отправляем уведомления о завершённых выражениях и повторяем неудачные
+	go runWebhookDispatcher(time.Second)
+
+	// Удаляем ключи идемпотентности старше срока хранения
+	go runIdempotencyJanitor(time.Minute)
+
 	// Запускаем HTTP сервер для API
-	go runHTTPServer()
+	go runHTTPServer(cfg.HTTPAddr)
 
 	// Запускаем gRPC сервер
-	runGRPCServer()
+	runGRPCServer(cfg)
 }
 
-func runHTTPServer() {
+func runHTTPServer(addr string) {
 	http.HandleFunc("/api/v1/register", handleRegister)
 	http.HandleFunc("/api/v1/login", handleLogin)
 
 	http.HandleFunc("/api/v1/calculate", auth.AuthMiddleware(handleCalculate))
+	http.HandleFunc("/api/v1/calculate/batch", auth.AuthMiddleware(handleCalculateBatch))
+	http.HandleFunc("/api/v1/batches/", auth.AuthMiddleware(handleBatchByID))
 	http.HandleFunc("/api/v1/expressions", auth.AuthMiddleware(handleExpressions))
 	http.HandleFunc("/api/v1/expressions/", auth.AuthMiddleware(handleExpressionByID))
-
-	log.Println("HTTP server started on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	http.HandleFunc("/api/v1/variables", auth.AuthMiddleware(handleVariables))
+	http.HandleFunc("/api/v1/variables/", auth.AuthMiddleware(handleVariableByName))
+	http.HandleFunc("/api/v1/sheets", auth.AuthMiddleware(handleSheets))
+	http.HandleFunc("/api/v1/sheets/", auth.AuthMiddleware(handleSheetByID))
+	http.HandleFunc("/api/v1/webhook-secret", auth.AuthMiddleware(handleWebhookSecret))
+	http.HandleFunc("/api/v1/replicas", auth.AuthMiddleware(handleDefaultReplicas))
+
+	http.HandleFunc("/api/v1/admin/agents", auth.AuthMiddleware(adminOnly(handleAdminAgents)))
+	http.HandleFunc("/api/v1/admin/agent-tokens", auth.AuthMiddleware(adminOnly(handleAgentTokens)))
+	http.HandleFunc("/api/v1/admin/agent-tokens/", auth.AuthMiddleware(adminOnly(handleAgentTokenByID)))
+
+	// токен для WebSocket проверяется при рукопожатии, браузер может передать его в ?token=
+	http.HandleFunc("/api/v1/ws", handleWebSocket)
+
+	log.Printf("HTTP server started on %s", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
 		log.Fatalf("Failed to start HTTP server: %v", err)
 	}
 }
 
-func runGRPCServer() {
-	lis, err := net.Listen("tcp", ":50051")
-	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+// newGRPCServer создаёт gRPC сервер с TaskService и настроенными TLS и проверкой токенов агентов
+func newGRPCServer(cfg Config) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if cfg.TLSCert != "" {
+		tlsConfig, err := pkg.ServerTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if cfg.TLSClientCA != "" {
+		return nil, errors.New("client certificate verification requires a server certificate")
+	}
+
+	if cfg.RequireAgentAuth {
+		opts = append(opts,
+			grpc.UnaryInterceptor(agentAuthUnaryInterceptor),
+			grpc.StreamInterceptor(agentAuthStreamInterceptor),
+		)
 	}
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(opts...)
 	pb.RegisterTaskServiceServer(s, &TaskServer{})
+	return s, nil
+}
 
-	log.Println("gRPC server started on :50051")
+func runGRPCServer(cfg Config) {
+	s, err := newGRPCServer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure gRPC server: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", cfg.GRPCAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	switch {
+	case cfg.TLSClientCA != "":
+		log.Printf("gRPC server started on %s with mutual TLS", cfg.GRPCAddr)
+	case cfg.TLSCert != "":
+		log.Printf("gRPC server started on %s with TLS", cfg.GRPCAddr)
+	default:
+		log.Printf("gRPC server started on %s", cfg.GRPCAddr)
+	}
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
 }
 
 func handleCalculate(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Expr string `json:"expression"`
-	}
+	var req calculateRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	userID, err := auth.GetUserIDFromContext(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if err := validateCalculateRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	database := db.GetInstance()
-	lastID, err := database.GetLastExpressionID()
-	if err != nil {
-		log.Printf("Error getting last ID: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	req.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	if err := validateIdempotencyKey(req.IdempotencyKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	mu.Lock()
-	expressionID := lastID + 1
-	err = database.SaveExpression(expressionID, userID, req.Expr, "processing", 0)
+	userID, err := auth.GetUserIDFromContext(r)
 	if err != nil {
-		log.Printf("Error saving expression: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	chTaskResults[expressionID] = make(chan float64, 1)
-	mu.Unlock()
+	expressionID, err := submitExpression(userID, req)
+	// повтор отвечает так же, как первый запрос
+	var replay *idempotentReplay
+	if errors.As(err, &replay) {
+		w.Header().Set("Idempotent-Replayed", "true")
+		expressionID, err = replay.id, nil
+	}
 
-	go parseExpression(expressionID, userID, req.Expr)
+	var unbound *bindError
+	switch {
+	case errors.As(err, &unbound):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, errLabelTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errIdempotencyMismatch):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]int{"id": expressionID})
 }
 
-func parseExpression(id int, userID int, expression string) {
-	var operations []rune
-	var numbers []float64
+// validateCalculateRequest проверяет поля запроса, не обращаясь к базе
+func validateCalculateRequest(req calculateRequest) error {
+	if strings.TrimSpace(req.Expr) == "" {
+		return errors.New("expression is required")
+	}
+
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			return fmt.Errorf("invalid callback_url: %w", err)
+		}
+	}
+
+	if err := validateReplicas(req.Replicas); err != nil {
+		return err
+	}
+
+	if err := validateVariables(req.Variables); err != nil {
+		return err
+	}
+
+	return validateLabel(req.Label)
+}
+
+// submitExpression сохраняет выражение пользователя и запускает его вычисление.
+// Имена выражения связываются со значениями сразу; если какому-то нечего подставить, возвращается *bindError.
+func submitExpression(userID int, req calculateRequest) (int, error) {
+	// повтор не связывает имена заново: сохранённые переменные могли измениться
+	if req.IdempotencyKey != "" {
+		if err := checkIdempotencyKey(userID, req); err != nil {
+			return 0, err
+		}
+	}
 
-	// Анализируем вводимые данные:
+	bindings, dependsOn, err := bindVariables(userID, req.Expr, req.Variables)
+	if err != nil {
+		var unbound *bindError
+		if !errors.As(err, &unbound) {
+			log.Printf("Error binding variables: %v", err)
+		}
+		return 0, err
+	}
 
-	for i := 0; i < len(expression); i++ {
+	return startExpression(userID, req, bindings, dependsOn)
+}
 
-		// числа и арифметические знаки записываем в списки
-		if expression[i] == '*' || expression[i] == '/' || expression[i] == '+' || expression[i] == '-' {
-			operations = append(operations, []rune(expression)[i])
+// startExpression сохраняет выражение с уже найденными значениями имён и запускает вычисление
+func startExpression(userID int, req calculateRequest, bindings map[string]float64, dependsOn []int) (int, error) {
+	database := db.GetInstance()
 
-		} else if (expression[i] - '0') <= 9 {
-			numbers = append(numbers, float64(expression[i]-'0'))
+	// секрет нужен для подписи уведомления, создаём его заранее
+	if req.CallbackURL != "" {
+		if _, err := webhookSecret(userID); err != nil {
+			log.Printf("Error getting webhook secret: %v", err)
+			return 0, err
 		}
 	}
 
-	// проверяем количество чисел и знаков
-	if len(numbers) != len(operations)+1 {
-		database := db.GetInstance()
-		database.SaveExpression(id, userID, expression, "error", 0)
-		return
-	}
-
-	// вычисляем преоритетные операции
-	for i := 0; i < len(operations); i++ {
-		switch operations[i] {
-		case '*':
-			taskID, res := addTask(id, "*", numbers[i], numbers[i+1])
-			if taskID == -1 {
-				database := db.GetInstance()
-				database.SaveExpression(id, userID, expression, "error", 0)
-				return
-			}
-
-			numbers = append(append(numbers[:i], res), numbers[i+2:]...)
-			operations = append(operations[:i], operations[i+1:]...)
-			i--
-
-		case '/':
-			if numbers[i+1] == 0 {
-				database := db.GetInstance()
-				database.SaveExpression(id, userID, expression, "error", 0)
-				return
-			}
-
-			taskID, res := addTask(id, "/", numbers[i], numbers[i+1])
-			if taskID == -1 {
-				database := db.GetInstance()
-				database.SaveExpression(id, userID, expression, "error", 0)
-				return
-			}
-
-			numbers = append(append(numbers[:i], res), numbers[i+2:]...)
-			operations = append(operations[:i], operations[i+1:]...)
-			i--
+	mu.Lock()
+	// одновременные запросы с одним ключом: выражение создаёт только первый
+	if req.IdempotencyKey != "" {
+		if err := checkIdempotencyKey(userID, req); err != nil {
+			mu.Unlock()
+			return 0, err
 		}
 	}
 
-	// вычисляем менее преоритетные операции
-	for i := 0; i < len(operations); i++ {
-		switch operations[i] {
-		case '+':
-			taskID, res := addTask(id, "+", numbers[i], numbers[i+1])
-			if taskID == -1 {
-				database := db.GetInstance()
-				database.SaveExpression(id, userID, expression, "error", 0)
-				return
-			}
-			numbers = append(append(numbers[:i], res), numbers[i+2:]...)
-			operations = append(operations[:i], operations[i+1:]...)
-			i--
-
-		case '-':
-			taskID, res := addTask(id, "-", numbers[i], numbers[i+1])
-			if taskID == -1 {
-				database := db.GetInstance()
-				database.SaveExpression(id, userID, expression, "error", 0)
-				return
-			}
-			numbers = append(append(numbers[:i], res), numbers[i+2:]...)
-			operations = append(operations[:i], operations[i+1:]...)
-			i--
+	if req.Label != "" {
+		_, _, _, err := database.FindExpressionByLabel(userID, req.Label)
+		if err == nil {
+			mu.Unlock()
+			return 0, errLabelTaken
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			mu.Unlock()
+			log.Printf("Error checking label: %v", err)
+			return 0, err
 		}
 	}
 
-	database := db.GetInstance()
-	database.SaveExpression(id, userID, expression, "completed", numbers[0])
+	// выражение, уведомление и ключ сохраняются вместе: повтор запроса не найдёт ключ
+	// без выражения, а выражение не останется без ключа
+	var fingerprint string
+	if req.IdempotencyKey != "" {
+		fingerprint = requestFingerprint(req)
+	}
+	replicas, err := replicasFor(userID, req.Replicas)
+	if err != nil {
+		mu.Unlock()
+		return 0, err
+	}
+	expressionID, err := database.CreateExpression(userID, db.NewExpression{
+		Expression:  req.Expr,
+		Replicas:    replicas,
+		Variables:   bindings,
+		Label:       req.Label,
+		DependsOn:   dependsOn,
+		CallbackURL: req.CallbackURL,
+	}, req.IdempotencyKey, fingerprint, time.Now())
+	mu.Unlock()
+	if err != nil {
+		log.Printf("Error saving expression: %v", err)
+		return 0, err
+	}
+
+	events.publish(expressionEvent{Type: "accepted", ID: expressionID, Status: "processing"})
+	go parseExpression(expressionID, req.Expr, replicas, bindings)
+
+	return expressionID, nil
 }
 
-func addTask(expressionID int, op string, arg1, arg2 float64) (int, float64) {
+// validateReplicas проверяет число копий; 0 — поле не задано, действует число копий пользователя
+func validateReplicas(replicas int) error {
+	if replicas < 0 || replicas > getMaxReplicas() {
+		return fmt.Errorf("replicas must be between 1 and %d, or 0 to use the default", getMaxReplicas())
+	}
+	return nil
+}
+
+func parseExpression(id int, expression string, replicas int, variables map[string]float64) {
+	g, err := buildGraph(expression, variables)
+	if err != nil {
+		log.Printf("Error parsing expression %d: %v", id, err)
+		finishExpression(id, "error", 0)
+		return
+	}
+
+	g.replicas = replicas
+	runGraph(id, g)
+}
+
+// buildGraph разбивает выражение на токены, строит дерево и граф зависимостей
+func buildGraph(expression string, variables map[string]float64) (*graph, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := parse(tokens, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkOperations(tree); err != nil {
+		return nil, err
+	}
+
+	return compile(tree), nil
+}
+
+// runGraph вычисляет граф выражения и сохраняет итог, если выражение не было отменено
+func runGraph(id int, g *graph) {
+	// Операции отправляются агентам параллельно по мере готовности аргументов
+	result, err := g.run(id)
+	pendingTasks.release(id, errExpressionFinished)
+	votes.release(id)
+	if err != nil {
+		log.Printf("Error evaluating expression %d: %v", id, err)
+		finishExpression(id, "error", 0)
+		return
+	}
+
+	finishExpression(id, "completed", result)
+}
+
+func addTask(expressionID int, node int, op string, args []float64) (float64, error) {
 	database := db.GetInstance()
-	taskID, err := database.SaveTask(expressionID, arg1, arg2, op)
+	taskID, err := database.SaveTask(expressionID, node, args, op)
 	if err != nil {
 		log.Printf("Error saving an task: %v", err)
-		return -1, 0
+		return 0, err
 	}
 
-	opTime := getOperationTime(op)
-	taskQueue <- &pb.Task{
-		Id:            int32(taskID),
-		Arg1:          arg1,
-		Arg2:          arg2,
-		Operation:     op,
-		OperationTime: int32(opTime),
-		HasTask:       true,
+	// регистрируем ожидание до постановки в очередь, чтобы не пропустить быстрый ответ
+	ch, err := registerTask(taskID, expressionID)
+	if err != nil {
+		return 0, err
 	}
 
-	mu.Lock()
-	ch := chTaskResults[expressionID]
-	mu.Unlock()
+	// задача видна в базе с момента сохранения: агент мог взять её оттуда
+	// и ответить раньше, чем ожидание было зарегистрировано
+	result, processed, leased, err := database.GetTaskState(taskID)
+	if err != nil {
+		pendingTasks.resolve(taskID, taskOutcome{err: err})
+	} else if processed {
+		pendingTasks.resolve(taskID, taskOutcome{value: result})
+	} else if !leased {
+		taskQueue.push(newTask(taskID, op, args))
+	}
+
+	outcome := <-ch
+	return outcome.value, outcome.err
+}
+
+// registerTask регистрирует ожидание задачи. Выражение могли отменить, пока задача
+// сохранялась: тогда ожидание уже снято и задачу никто не выдаст, поэтому ждать её нельзя.
+func registerTask(taskID, expressionID int) (<-chan taskOutcome, error) {
+	ch := pendingTasks.register(taskID, expressionID)
 
-	result := <-ch
-	return taskID, result
+	database := db.GetInstance()
+	status, err := database.GetExpressionStatus(expressionID)
+	if err == nil && status != "processing" {
+		err = errCancelled
+		if status != "cancelled" {
+			err = errExpressionFinished
+		}
+	}
+	if err != nil {
+		pendingTasks.resolve(taskID, taskOutcome{err: err})
+		return nil, err
+	}
+	return ch, nil
+}
+
+// newTask собирает задачу для агента. Для двух аргументов заполняются и arg1, arg2,
+// чтобы задачу мог выполнить агент, не знающий про args.
+func newTask(id int, op string, args []float64) *pb.Task {
+	task := &pb.Task{
+		Id:            int32(id),
+		Args:          args,
+		Operation:     op,
+		OperationTime: int32(getOperationTime(op)),
+		HasTask:       true,
+	}
+	if len(args) == 2 {
+		task.Arg1, task.Arg2 = args[0], args[1]
+	}
+	return task
 }
 
+// getOperationTime берёт время выполнения из реестра операций агента
 func getOperationTime(op string) int {
-	switch op {
-	case "+":
-		return pkg.GetEnvInt("TIME_ADDITION_MS", 100)
-	case "-":
-		return pkg.GetEnvInt("TIME_SUBTRACTION_MS", 100)
-	case "*":
-		return pkg.GetEnvInt("TIME_MULTIPLICATIONS_MS", 200)
-	case "/":
-		return pkg.GetEnvInt("TIME_DIVISIONS_MS", 300)
+	if operation, ok := agent.LookupOperation(op); ok {
+		return operation.Cost()
 	}
 	return 100
 }
@@ -313,19 +599,30 @@ func handleExpressions(w http.ResponseWriter, r *http.Request) {
 	var expList []Expression
 	for _, exp := range dbExpressions {
 		expList = append(expList, Expression{
-			ID:     exp.ID,
-			Expr:   exp.Expression,
-			Status: exp.Status,
-			Result: exp.Result,
+			ID:        exp.ID,
+			Expr:      exp.Expression,
+			Status:    exp.Status,
+			Result:    exp.Result,
+			Variables: exp.Variables,
+			Label:     exp.Label,
+			DependsOn: exp.DependsOn,
 		})
 	}
 
+	// результат, который нельзя записать в JSON, не должен превращаться в пустой ответ 200
+	body, err := json.Marshal(map[string]interface{}{"expressions": expList})
+	if err != nil {
+		log.Printf("Error encoding expressions of user %d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"expressions": expList})
+	w.Write(body)
 }
 
 func handleExpressionByID(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
 		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
 		return
 	}
@@ -337,6 +634,7 @@ func handleExpressionByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	idStr := r.URL.Path[len("/api/v1/expressions/"):]
+	idStr, streamEvents := strings.CutSuffix(idStr, "/events")
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -344,6 +642,20 @@ func handleExpressionByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if streamEvents {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+			return
+		}
+		handleExpressionEvents(w, r, id, userID)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		handleCancelExpression(w, id, userID)
+		return
+	}
+
 	database := db.GetInstance()
 	expr, status, result, err := database.GetExpression(id, userID)
 	if err != nil {
@@ -351,16 +663,30 @@ func handleExpressionByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	lineage, err := database.GetExpressionLineage(id, userID)
+	if err != nil {
+		log.Printf("Error receiving variables of expression %d: %v", id, err)
+	}
+
 	expression := Expression{
-		ID:     id,
-		Expr:   expr,
-		Status: status,
-		Result: result,
+		ID:        id,
+		Expr:      expr,
+		Status:    status,
+		Result:    result,
+		Variables: lineage.Variables,
+		Label:     lineage.Label,
+		DependsOn: lineage.DependsOn,
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"expression": expression})
+	body, err := json.Marshal(map[string]interface{}{"expression": expression})
+	if err != nil {
+		log.Printf("Error encoding expression %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
 }
 
 type UserCredentials struct {
@@ -4,11 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/Solmorn/Distributed-calculations/internal/agent"
 	"github.com/Solmorn/Distributed-calculations/internal/auth"
 	"github.com/Solmorn/Distributed-calculations/internal/db"
 	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
@@ -17,8 +23,8 @@ import (
 func TestMain(m *testing.M) {
 	os.Setenv("DB_PATH", ":memory:")
 
-	taskQueue = make(chan *pb.Task, 100)
-	chTaskResults = make(map[int]chan float64)
+	taskQueue = newDispatchQueue()
+	pendingTasks = newTaskRegistry()
 
 	code := m.Run()
 
@@ -44,7 +50,7 @@ func TestGetTask(t *testing.T) {
 		t.Fatalf("Failed to save expression: %v", err)
 	}
 
-	taskID, err := database.SaveTask(expressionID, 5.0, 5.0, "+")
+	taskID, err := database.SaveTask(expressionID, 0, []float64{5.0, 5.0}, "+")
 	if err != nil {
 		t.Fatalf("Failed to create test task: %v", err)
 	}
@@ -88,19 +94,32 @@ func TestSendTaskResult(t *testing.T) {
 		t.Fatalf("Failed to save expression: %v", err)
 	}
 
-	taskID, err := database.SaveTask(expressionID, 10.0, 5.0, "+")
+	taskID, err := database.SaveTask(expressionID, 0, []float64{10.0, 5.0}, "+")
 	if err != nil {
 		t.Fatalf("Failed to save task: %v", err)
 	}
 
-	mu.Lock()
-	chTaskResults[expressionID] = make(chan float64, 1)
-	mu.Unlock()
+	waiting := pendingTasks.register(taskID, expressionID)
+
+	if ok, err := database.LeaseTask(taskID, "adder", time.Now().Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
 
 	server := &TaskServer{}
+	forged, _ := server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(taskID), Result: 99.0, AgentId: "other"})
+	if forged.Success {
+		t.Error("Result from an agent the task is not leased to should be rejected")
+	}
+	select {
+	case outcome := <-waiting:
+		t.Fatalf("Rejected result reached the waiting consumer: %f", outcome.value)
+	default:
+	}
+
 	result := &pb.TaskResult{
-		Id:     int32(taskID),
-		Result: 15.0,
+		Id:      int32(taskID),
+		Result:  15.0,
+		AgentId: "adder",
 	}
 
 	response, err := server.SendTaskResult(context.Background(), result)
@@ -124,6 +143,77 @@ func TestSendTaskResult(t *testing.T) {
 	if resultValue != 15.0 {
 		t.Errorf("Result mismatch: expected 15.0, got %f", resultValue)
 	}
+
+	select {
+	case outcome := <-waiting:
+		if outcome.err != nil || outcome.value != 15.0 {
+			t.Errorf("Waiting consumer got (%f, %v), expected 15.0", outcome.value, outcome.err)
+		}
+	default:
+		t.Error("Result was not delivered to the waiting consumer")
+	}
+
+	// повторный ответ не перезаписывает уже сохранённый результат
+	late, _ := server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(taskID), Result: 99.0, AgentId: "adder"})
+	if late.Success {
+		t.Error("Result of an already completed task should be rejected")
+	}
+	if resultValue, _, _ := database.GetTaskResult(taskID); resultValue != 15.0 {
+		t.Errorf("Completed result was overwritten with %f", resultValue)
+	}
+}
+
+func TestSendTaskError(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("testerror", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	if err := database.SaveExpression(expressionID, userID, "1/0", "processing", 0); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+	taskID, err := database.SaveTask(expressionID, 0, []float64{1.0, 0.0}, "/")
+	if err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+	waiting := pendingTasks.register(taskID, expressionID)
+	defer pendingTasks.release(expressionID, errExpressionFinished)
+
+	if ok, err := database.LeaseTask(taskID, "divider", time.Now().Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("Failed to lease task: %v", err)
+	}
+
+	server := &TaskServer{}
+	response, _ := server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(taskID), Error: "division by zero", AgentId: "other"})
+	if response.Success {
+		t.Error("Error from an agent the task is not leased to should be rejected")
+	}
+	select {
+	case outcome := <-waiting:
+		t.Fatalf("Rejected error reached the waiting consumer: %v", outcome.err)
+	default:
+	}
+
+	response, _ = server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(taskID), Error: "division by zero", AgentId: "divider"})
+	if !response.Success {
+		t.Error("Expected success response, got failure")
+	}
+
+	select {
+	case outcome := <-waiting:
+		if outcome.err == nil || outcome.err.Error() != "division by zero" {
+			t.Errorf("Expected the agent error, got %v", outcome.err)
+		}
+	default:
+		t.Error("Error was not delivered to the waiting consumer")
+	}
+
+	if _, processed, _ := database.GetTaskResult(taskID); processed {
+		t.Error("Failed task should not be marked as processed")
+	}
 }
 
 func TestHandleCalculate(t *testing.T) {
@@ -179,6 +269,75 @@ func TestHandleCalculate(t *testing.T) {
 	if status != "processing" && status != "completed" {
 		t.Errorf("Status should be processing or completed, got %s", status)
 	}
+
+	// пустое выражение отклоняется так же, как в WebSocket API
+	empty := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(`{"expression": "  "}`))
+	empty = empty.WithContext(context.WithValue(empty.Context(), auth.GetUserIDContextKey(), userID))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, empty)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Empty expression: expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestCalculateWithVariables(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("variablesuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	calculate := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		handleCalculate(rr, req)
+		return rr
+	}
+
+	if rr := calculate(`{"expression": "rate * years", "variables": {"rate": 2}}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Unknown variable: expected %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	if rr := calculate(`{"expression": "pi * 2", "variables": {"pi": 3}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Shadowed constant: expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	defer startFakeAgent()()
+
+	rr := calculate(`{"expression": "rate * principal + fee", "variables": {"rate": 0.5, "principal": 10, "fee": 1}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Calculate returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var created map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &created)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, status, result, _ := database.GetExpression(created["id"], userID)
+		if status == "completed" {
+			if result != 6 {
+				t.Errorf("Expected 6, got %f", result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expression did not complete, status %s", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/expressions/"+strconv.Itoa(created["id"]), nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+	rr = httptest.NewRecorder()
+	handleExpressionByID(rr, req)
+
+	var response struct {
+		Expression Expression `json:"expression"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	if !maps.Equal(response.Expression.Variables, map[string]float64{"rate": 0.5, "principal": 10, "fee": 1}) {
+		t.Errorf("Unexpected variables: %v", response.Expression.Variables)
+	}
 }
 
 func TestHandleExpressions(t *testing.T) {
@@ -252,6 +411,29 @@ func TestHandleExpressions(t *testing.T) {
 	}
 }
 
+func TestHandleExpressionNotFinite(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("infuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	// так сохранялись переполнения до проверки результатов операций
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	if err := database.SaveExpression(expressionID, userID, "1e308*10", "completed", math.Inf(1)); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/expressions/"+strconv.Itoa(expressionID), nil)
+	req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+	rr := httptest.NewRecorder()
+	handleExpressionByID(rr, req)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected %d for a result JSON cannot hold, got %d: %q", http.StatusInternalServerError, rr.Code, rr.Body.String())
+	}
+}
+
 func TestParseExpression(t *testing.T) {
 	database := db.GetInstance()
 	userID, err := database.CreateUser("parseuser", "password")
@@ -262,15 +444,14 @@ func TestParseExpression(t *testing.T) {
 	expressionID := 1000
 	expression := "2+3"
 
-	mu.Lock()
-	chTaskResults[expressionID] = make(chan float64, 1)
+	err = database.SaveExpression(expressionID, userID, expression, "processing", 0)
+	if err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
 
-	go func() {
-		chTaskResults[expressionID] <- 5.0
-	}()
-	mu.Unlock()
+	defer startFakeAgent()()
 
-	parseExpression(expressionID, userID, expression)
+	parseExpression(expressionID, expression, 1, nil)
 
 	expr, status, result, err := database.GetExpression(expressionID, userID)
 	if err != nil {
@@ -289,3 +470,107 @@ func TestParseExpression(t *testing.T) {
 		t.Errorf("Result mismatch: expected 5.0, got %f", result)
 	}
 }
+
+func TestParseExpressionOperatorsAndFunctions(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("operatorsuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	defer startFakeAgent()()
+
+	testCases := []struct {
+		expression string
+		status     string
+		result     float64
+	}{
+		{"2^3^2", "completed", 512},
+		{"-2^2+1", "completed", -3},
+		{"17%5*2", "completed", 4},
+		{"-7//2", "completed", -4},
+		{"(1+1)^-1", "completed", 0.5},
+		{"5%(2-2)", "error", 0},
+		{"5//(1-1)", "error", 0},
+		{"max(1+2, 3*4, 5)-min(7, 2)", "completed", 10},
+		{"round(sqrt(2)*100, 1)", "completed", 141.4},
+		{"-abs(1-4)^2", "completed", -9},
+		{"log(8, 2)+ln(1)", "completed", 3},
+		{"sqrt(1-2)", "error", 0},
+	}
+
+	for _, tc := range testCases {
+		lastID, _ := database.GetLastExpressionID()
+		expressionID := lastID + 1
+		if err := database.SaveExpression(expressionID, userID, tc.expression, "processing", 0); err != nil {
+			t.Fatalf("Failed to save expression: %v", err)
+		}
+
+		parseExpression(expressionID, tc.expression, 1, nil)
+
+		_, status, result, _ := database.GetExpression(expressionID, userID)
+		if status != tc.status || result != tc.result {
+			t.Errorf("%s: expected %s %f, got %s %f", tc.expression, tc.status, tc.result, status, result)
+		}
+	}
+}
+
+// startFakeAgent запускает fakeAgent и возвращает функцию, которая останавливает его
+// и ждёт выхода: иначе агент успеет взять задачу следующего теста
+func startFakeAgent() func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeAgent(stop)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// fakeAgent берёт задачи через GetTask и отвечает как настоящий агент, пока не закрыт stop
+func fakeAgent(stop <-chan struct{}) {
+	server := &TaskServer{}
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		task, err := server.GetTask(context.Background(), &pb.TaskRequest{})
+		if err != nil || !task.HasTask {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		result := &pb.TaskResult{Id: task.Id}
+		value, err := fakeExecute(task)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Result = value
+		server.SendTaskResult(context.Background(), result)
+	}
+}
+
+// fakeExecute выполняет задачу по реестру операций агента, без задержки
+func fakeExecute(task *pb.Task) (float64, error) {
+	args := task.Args
+	if len(args) == 0 {
+		args = []float64{task.Arg1, task.Arg2}
+	}
+
+	op, ok := agent.LookupOperation(task.Operation)
+	if !ok {
+		return 0, fmt.Errorf("unsupported operation %q", task.Operation)
+	}
+	return op.Apply(args)
+}
+
+func fakeCompute(task *pb.Task) float64 {
+	result, _ := fakeExecute(task)
+	return result
+}
@@ -0,0 +1,371 @@
+package orch
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Solmorn/Distributed-calculations/internal/agent"
+)
+
+// Узлы синтаксического дерева выражения
+type node interface {
+	String() string
+}
+
+type numberNode struct {
+	value float64
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+// callNode — вызов функции; функция выполняется агентом как операция с именем name
+type callNode struct {
+	name string
+	args []node
+}
+
+func (n *numberNode) String() string {
+	return strconv.FormatFloat(n.value, 'g', -1, 64)
+}
+
+func (n *unaryNode) String() string {
+	return "(" + n.op + n.operand.String() + ")"
+}
+
+func (n *binaryNode) String() string {
+	return "(" + n.left.String() + " " + n.op + " " + n.right.String() + ")"
+}
+
+func (n *callNode) String() string {
+	args := make([]string, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.String()
+	}
+	return n.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// Грамматика (рекурсивный спуск):
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "//" | "%") unary }
+//	unary   = ("+" | "-") unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | call | ident | "(" expr ")"
+//	call    = ident "(" [ expr { "," expr } ] ")"
+//
+// Имя без скобок — переменная, ссылка на результат другого выражения ($42, $label)
+// или встроенная константа; её значение подставляется сразу.
+//
+// Степень правоассоциативна и связывает сильнее унарного минуса: -2^2 = -4, 2^-1 = 0.5.
+type parser struct {
+	tokens    []token
+	pos       int
+	variables map[string]float64
+}
+
+// встроенные константы; переменные запроса не могут называться так же
+var constants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// parse строит синтаксическое дерево из списка токенов, подставляя значения переменных
+func parse(tokens []token, variables map[string]float64) (node, error) {
+	p := &parser{tokens: tokens, variables: variables}
+
+	tree, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+
+	return tree, nil
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// acceptOperator забирает следующий токен, если это один из указанных операторов
+func (p *parser) acceptOperator(ops ...string) (string, bool) {
+	tok, ok := p.peek()
+	if !ok || tok.kind != tokenOperator {
+		return "", false
+	}
+
+	for _, op := range ops {
+		if tok.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseExpr() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.acceptOperator("+", "-")
+		if !ok {
+			return left, nil
+		}
+
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseTerm() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.acceptOperator("*", "/", "//", "%")
+		if !ok {
+			return left, nil
+		}
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	op, ok := p.acceptOperator("+", "-")
+	if !ok {
+		return p.parsePower()
+	}
+
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if op == "+" {
+		return operand, nil
+	}
+
+	// отрицательные числа сворачиваем сразу
+	if num, ok := operand.(*numberNode); ok {
+		return &numberNode{value: -num.value}, nil
+	}
+	return &unaryNode{op: op, operand: operand}, nil
+}
+
+func (p *parser) parsePower() (node, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.acceptOperator("^"); !ok {
+		return base, nil
+	}
+
+	// показатель разбирается как unary, поэтому 2^3^2 = 2^(3^2)
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{op: "^", left: base, right: exponent}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	switch tok.kind {
+	case tokenNumber:
+		p.pos++
+		return &numberNode{value: tok.value}, nil
+
+	case tokenIdent:
+		p.pos++
+		if isReference(tok.text) {
+			return p.resolve(tok)
+		}
+		return p.parseCall(tok)
+
+	case tokenLParen:
+		p.pos++
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		closing, ok := p.peek()
+		if !ok || closing.kind != tokenRParen {
+			return nil, fmt.Errorf("missing closing parenthesis for %q at position %d", tok.text, tok.pos)
+		}
+		p.pos++
+		return inner, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// parseCall разбирает аргументы функции name после её имени
+func (p *parser) parseCall(name token) (node, error) {
+	open, ok := p.peek()
+	if !ok || open.kind != tokenLParen {
+		return p.resolve(name)
+	}
+	p.pos++
+
+	call := &callNode{name: name.text}
+	if closing, ok := p.peek(); ok && closing.kind == tokenRParen {
+		p.pos++
+		return call, nil
+	}
+
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+
+		next, ok := p.peek()
+		if !ok {
+			return nil, fmt.Errorf("missing closing parenthesis for %s( at position %d", name.text, open.pos)
+		}
+		p.pos++
+		switch next.kind {
+		case tokenComma:
+			continue
+		case tokenRParen:
+			return call, nil
+		}
+		return nil, fmt.Errorf("unexpected %q at position %d", next.text, next.pos)
+	}
+}
+
+// resolve подставляет значение переменной или константы
+func (p *parser) resolve(name token) (node, error) {
+	if value, ok := p.variables[name.text]; ok {
+		return &numberNode{value: value}, nil
+	}
+	if value, ok := constants[name.text]; ok {
+		return &numberNode{value: value}, nil
+	}
+	return nil, fmt.Errorf("unknown variable %q at position %d", name.text, name.pos)
+}
+
+// validateVariables проверяет имена переменных: это должны быть идентификаторы,
+// не совпадающие со встроенными константами
+func validateVariables(variables map[string]float64) error {
+	for name := range variables {
+		if !isIdentifier(name) {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+		if _, ok := constants[name]; ok {
+			return fmt.Errorf("variable %q shadows a built-in constant", name)
+		}
+	}
+	return nil
+}
+
+// isIdentifier проверяет, что name — одно имя без $, как у переменных и меток
+func isIdentifier(name string) bool {
+	tokens, err := tokenize(name)
+	return err == nil && len(tokens) == 1 && tokens[0].kind == tokenIdent &&
+		tokens[0].text == name && !isReference(name)
+}
+
+func isReference(name string) bool {
+	return strings.HasPrefix(name, "$")
+}
+
+// variableNames возвращает имена выражения, которым нужны значения: всё, кроме функций и констант.
+// Если выражение не разбивается на токены, имён нет: синтаксическая ошибка всплывёт при разборе.
+func variableNames(expression string) []token {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil
+	}
+
+	var names []token
+	for i, tok := range tokens {
+		if tok.kind != tokenIdent {
+			continue
+		}
+		if !isReference(tok.text) {
+			if i+1 < len(tokens) && tokens[i+1].kind == tokenLParen {
+				continue
+			}
+			if _, ok := constants[tok.text]; ok {
+				continue
+			}
+		}
+		names = append(names, tok)
+	}
+	return names
+}
+
+// checkOperations проверяет по реестру операций агента, что каждая операция дерева
+// существует и принимает столько аргументов
+func checkOperations(n node) error {
+	switch n := n.(type) {
+	case *unaryNode:
+		return checkOperations(n.operand)
+
+	case *binaryNode:
+		op, ok := agent.LookupOperation(n.op)
+		if !ok {
+			return fmt.Errorf("unsupported operation %q", n.op)
+		}
+		if err := agent.CheckArity(op, 2); err != nil {
+			return err
+		}
+		if err := checkOperations(n.left); err != nil {
+			return err
+		}
+		return checkOperations(n.right)
+
+	case *callNode:
+		op, ok := agent.LookupOperation(n.name)
+		if !ok {
+			return fmt.Errorf("unknown function %q", n.name)
+		}
+		if err := agent.CheckArity(op, len(n.args)); err != nil {
+			return err
+		}
+		for _, arg := range n.args {
+			if err := checkOperations(arg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
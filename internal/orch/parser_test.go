@@ -0,0 +1,145 @@
+package orch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"Priority", "2+3*4", "(2 + (3 * 4))"},
+		{"Left associativity", "10-4-3", "((10 - 4) - 3)"},
+		{"Left associativity division", "8/4/2", "((8 / 4) / 2)"},
+		{"Parentheses", "(2+3)*4", "((2 + 3) * 4)"},
+		{"Nested parentheses", "((1+2)*(3-(4/5)))", "((1 + 2) * (3 - (4 / 5)))"},
+		{"Unary minus", "-5+2", "(-5 + 2)"},
+		{"Unary minus on group", "-(2+3)*4", "((-(2 + 3)) * 4)"},
+		{"Unary plus", "+7*-2", "(7 * -2)"},
+		{"Double negation", "--3", "3"},
+		{"Single number", "42", "42"},
+		{"Power right associativity", "2^3^2", "(2 ^ (3 ^ 2))"},
+		{"Power binds tighter than unary minus", "-2^2", "(-(2 ^ 2))"},
+		{"Negative exponent", "2^-1", "(2 ^ -1)"},
+		{"Power before multiplication", "3*2^2", "(3 * (2 ^ 2))"},
+		{"Modulo and integer division", "7%3+9//2*2", "((7 % 3) + ((9 // 2) * 2))"},
+		{"Function call", "sqrt(16)+1", "(sqrt(16) + 1)"},
+		{"Variadic function", "max(1, 2+3, -4)", "max(1, (2 + 3), -4)"},
+		{"Nested calls", "round(log(100)*abs(-2), 1)", "round((log(100) * abs(-2)), 1)"},
+		{"Power of call", "-sqrt(4)^2", "(-(sqrt(4) ^ 2))"},
+		{"Call without arguments", "f()", "f()"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := tokenize(tc.input)
+			if err != nil {
+				t.Fatalf("%s: tokenize failed: %v", tc.name, err)
+			}
+
+			tree, err := parse(tokens, nil)
+			if err != nil {
+				t.Fatalf("%s: parse failed: %v", tc.name, err)
+			}
+
+			if tree.String() != tc.expected {
+				t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, tree.String())
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{"", "2++", "2*", "(2+3", "2+3)", "()", "2 3", "1.2.3", "*2", "2^", "^2", "2///3",
+		"x+1", "1e", "sqrt", "sqrt(", "sqrt(4", "max(1,)", "max(,1)", "max(1 2)", "sqrt(4))"} {
+		tokens, err := tokenize(input)
+		if err != nil {
+			t.Fatalf("tokenize %q failed: %v", input, err)
+		}
+
+		if _, err := parse(tokens, nil); err == nil {
+			t.Errorf("Expected parse error for %q, got nil", input)
+		}
+	}
+}
+
+func TestCheckOperations(t *testing.T) {
+	tree := &binaryNode{op: "+", left: &numberNode{value: 1}, right: &unaryNode{op: "-", operand: &binaryNode{
+		op: "?", left: &numberNode{value: 2}, right: &numberNode{value: 3},
+	}}}
+	if err := checkOperations(tree); err == nil {
+		t.Error("Expected an error for an unregistered operation")
+	}
+
+	tree.right = &numberNode{value: 2}
+	if err := checkOperations(tree); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	for _, input := range []string{"nosuch(1)", "sqrt(1, 2)", "round()", "1+max()", "-abs(sqrt())"} {
+		tokens, _ := tokenize(input)
+		tree, err := parse(tokens, nil)
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", input, err)
+		}
+		if err := checkOperations(tree); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestParseVariables(t *testing.T) {
+	variables := map[string]float64{"rate": 0.05, "principal": 1000, "fee": 2}
+
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"rate * principal + fee", "((0.05 * 1000) + 2)"},
+		{"-fee", "-2"},
+		{"max(fee, rate)", "max(2, 0.05)"},
+		{"2*pi", "(2 * 3.141592653589793)"},
+		{"e^1", "(2.718281828459045 ^ 1)"},
+	}
+
+	for _, tc := range testCases {
+		tokens, _ := tokenize(tc.input)
+		tree, err := parse(tokens, variables)
+		if err != nil {
+			t.Fatalf("%q: parse failed: %v", tc.input, err)
+		}
+		if tree.String() != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.input, tc.expected, tree.String())
+		}
+	}
+
+	tokens, _ := tokenize("rate * years")
+	if _, err := parse(tokens, variables); err == nil || err.Error() != `unknown variable "years" at position 7` {
+		t.Errorf("Expected an unknown variable error, got %v", err)
+	}
+
+	var names []string
+	for _, tok := range variableNames("rate * years + sqrt(fee) * pi - $42 + $total") {
+		names = append(names, tok.text)
+	}
+	if strings.Join(names, " ") != "rate years fee $42 $total" {
+		t.Errorf("Unexpected variable names: %v", names)
+	}
+
+	tokens, _ = tokenize("$total * 2")
+	if tree, err := parse(tokens, map[string]float64{"$total": 21}); err != nil || tree.String() != "(21 * 2)" {
+		t.Errorf("Reference should be substituted, got %v (%v)", tree, err)
+	}
+
+	for _, name := range []string{"pi", "e", "1x", "a b", "", "x+1", "$x", "$1"} {
+		if err := validateVariables(map[string]float64{name: 1}); err == nil {
+			t.Errorf("Variable name %q should be rejected", name)
+		}
+	}
+	if err := validateVariables(variables); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package orch
+
+import (
+	"errors"
+	"sync"
+)
+
+var errExpressionFinished = errors.New("expression is already finished")
+
+// taskOutcome — результат задачи, которого ждёт вычислитель выражения
+type taskOutcome struct {
+	value float64
+	err   error
+}
+
+type waitingTask struct {
+	expressionID int
+	result       chan taskOutcome
+}
+
+// taskRegistry связывает ID задачи с ожидающим её вычислителем и выражением.
+// Одно выражение может ждать несколько задач одновременно.
+type taskRegistry struct {
+	mu           sync.Mutex
+	tasks        map[int]*waitingTask
+	byExpression map[int]map[int]struct{}
+}
+
+func newTaskRegistry() *taskRegistry {
+	return &taskRegistry{
+		tasks:        make(map[int]*waitingTask),
+		byExpression: make(map[int]map[int]struct{}),
+	}
+}
+
+// register регистрирует задачу до её отправки в очередь, чтобы результат не потерялся
+func (r *taskRegistry) register(taskID, expressionID int) <-chan taskOutcome {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wt := &waitingTask{expressionID: expressionID, result: make(chan taskOutcome, 1)}
+	r.tasks[taskID] = wt
+
+	if r.byExpression[expressionID] == nil {
+		r.byExpression[expressionID] = make(map[int]struct{})
+	}
+	r.byExpression[expressionID][taskID] = struct{}{}
+
+	return wt.result
+}
+
+// resolve передаёт результат ожидающему вычислителю и удаляет запись.
+// Возвращает false, если задачу никто не ждёт.
+func (r *taskRegistry) resolve(taskID int, outcome taskOutcome) bool {
+	r.mu.Lock()
+	wt, exists := r.tasks[taskID]
+	if exists {
+		r.remove(taskID, wt.expressionID)
+	}
+	r.mu.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	// событие публикуется раньше, чем проснётся вычислитель, чтобы не обогнать итог выражения
+	if outcome.err == nil {
+		events.publish(expressionEvent{Type: "task_completed", ID: wt.expressionID, TaskID: taskID, Result: outcome.value})
+	}
+	wt.result <- outcome
+	return true
+}
+
+// expressionOf возвращает выражение, к которому относится ожидаемая задача
+func (r *taskRegistry) expressionOf(taskID int) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wt, exists := r.tasks[taskID]
+	if !exists {
+		return 0, false
+	}
+	return wt.expressionID, true
+}
+
+// release завершает ожидание всех оставшихся задач выражения с ошибкой err
+func (r *taskRegistry) release(expressionID int, err error) {
+	r.mu.Lock()
+	var waiting []*waitingTask
+	for taskID := range r.byExpression[expressionID] {
+		waiting = append(waiting, r.tasks[taskID])
+		delete(r.tasks, taskID)
+	}
+	delete(r.byExpression, expressionID)
+	r.mu.Unlock()
+
+	for _, wt := range waiting {
+		wt.result <- taskOutcome{err: err}
+	}
+}
+
+func (r *taskRegistry) remove(taskID, expressionID int) {
+	delete(r.tasks, taskID)
+
+	ids := r.byExpression[expressionID]
+	delete(ids, taskID)
+	if len(ids) == 0 {
+		delete(r.byExpression, expressionID)
+	}
+}
@@ -0,0 +1,74 @@
+package orch
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTaskRegistryConcurrentTasks(t *testing.T) {
+	registry := newTaskRegistry()
+
+	first := registry.register(1, 10)
+	second := registry.register(2, 10)
+	other := registry.register(3, 11)
+
+	if owner, ok := registry.expressionOf(2); !ok || owner != 10 {
+		t.Errorf("Expected task 2 to belong to expression 10, got %d", owner)
+	}
+
+	// результаты приходят в обратном порядке и всё равно попадают к своим потребителям
+	if !registry.resolve(2, taskOutcome{value: 20}) {
+		t.Error("Expected task 2 to be resolved")
+	}
+	if !registry.resolve(1, taskOutcome{value: 10}) {
+		t.Error("Expected task 1 to be resolved")
+	}
+
+	if outcome := <-first; outcome.value != 10 {
+		t.Errorf("Task 1 got %f, expected 10", outcome.value)
+	}
+	if outcome := <-second; outcome.value != 20 {
+		t.Errorf("Task 2 got %f, expected 20", outcome.value)
+	}
+
+	if registry.resolve(1, taskOutcome{value: 10}) {
+		t.Error("Resolved task should not be resolved twice")
+	}
+
+	if _, ok := registry.byExpression[10]; ok {
+		t.Error("Expression 10 should be cleaned up after all its tasks are resolved")
+	}
+
+	select {
+	case <-other:
+		t.Error("Task of another expression should still be waiting")
+	default:
+	}
+}
+
+func TestTaskRegistryRelease(t *testing.T) {
+	registry := newTaskRegistry()
+
+	waiting := registry.register(1, 10)
+	kept := registry.register(2, 11)
+
+	failure := errors.New("failed")
+	registry.release(10, failure)
+
+	if outcome := <-waiting; !errors.Is(outcome.err, failure) {
+		t.Errorf("Expected release error, got %v", outcome.err)
+	}
+
+	if _, ok := registry.expressionOf(1); ok {
+		t.Error("Released task should be removed")
+	}
+
+	if registry.resolve(1, taskOutcome{value: 1}) {
+		t.Error("Released task should not be resolved")
+	}
+
+	if !registry.resolve(2, taskOutcome{value: 2}) {
+		t.Error("Task of another expression should not be released")
+	}
+	<-kept
+}
@@ -0,0 +1,108 @@
+package orch
+
+import (
+	"sync"
+	"time"
+
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+// dispatchQueue — очередь задач, готовых к выдаче агентам.
+// В отличие от канала, из неё можно взять первую задачу, подходящую конкретному агенту.
+type dispatchQueue struct {
+	mu    sync.Mutex
+	tasks []*pb.Task
+	// когда задача попала в очередь, по ID задачи
+	queuedAt map[int32]time.Time
+	// закрывается и заменяется при каждом добавлении задачи
+	signal chan struct{}
+}
+
+func newDispatchQueue() *dispatchQueue {
+	return &dispatchQueue{queuedAt: make(map[int32]time.Time), signal: make(chan struct{})}
+}
+
+func (q *dispatchQueue) push(task *pb.Task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.tasks = append(q.tasks, task)
+	q.queuedAt[task.Id] = time.Now()
+	close(q.signal)
+	q.signal = make(chan struct{})
+}
+
+// pop забирает первую задачу, которую принимает accept; nil, если такой нет
+func (q *dispatchQueue) pop(accept func(*pb.Task) bool) *pb.Task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, task := range q.tasks {
+		if accept == nil || accept(task) {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			delete(q.queuedAt, task.Id)
+			return task
+		}
+	}
+	return nil
+}
+
+// ready возвращает канал, который закроется при добавлении следующей задачи.
+// Канал нужно получить до неудачного pop, чтобы не пропустить задачу между ними.
+func (q *dispatchQueue) ready() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.signal
+}
+
+// removeIf убирает из очереди задачи, для которых match вернул true, и возвращает их количество
+func (q *dispatchQueue) removeIf(match func(*pb.Task) bool) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.remove(match))
+}
+
+// removeStale убирает из очереди задачи, ждущие выдачи с момента раньше before,
+// для которых match вернул true, и возвращает их
+func (q *dispatchQueue) removeStale(before time.Time, match func(*pb.Task) bool) []*pb.Task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.remove(func(task *pb.Task) bool {
+		return q.queuedAt[task.Id].Before(before) && match(task)
+	})
+}
+
+func (q *dispatchQueue) remove(match func(*pb.Task) bool) []*pb.Task {
+	var removed []*pb.Task
+	kept := q.tasks[:0]
+	for _, task := range q.tasks {
+		if match(task) {
+			removed = append(removed, task)
+			delete(q.queuedAt, task.Id)
+		} else {
+			kept = append(kept, task)
+		}
+	}
+	clear(q.tasks[len(kept):])
+	q.tasks = kept
+	return removed
+}
+
+// queued сообщает, что задача ждёт выдачи в очереди
+func (q *dispatchQueue) queued(taskID int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, ok := q.queuedAt[int32(taskID)]
+	return ok
+}
+
+func (q *dispatchQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.tasks)
+}
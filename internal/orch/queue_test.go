@@ -0,0 +1,132 @@
+package orch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+// queuedTask ждёт любую задачу из очереди; nil, если за timeout ничего не появилось
+func queuedTask(timeout time.Duration) *pb.Task {
+	deadline := time.After(timeout)
+	for {
+		ready := taskQueue.ready()
+		if task := taskQueue.pop(nil); task != nil {
+			return task
+		}
+		select {
+		case <-ready:
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func TestDispatchQueue(t *testing.T) {
+	queue := newDispatchQueue()
+	ready := queue.ready()
+
+	queue.push(&pb.Task{Id: 1, Operation: "*"})
+	queue.push(&pb.Task{Id: 2, Operation: "+"})
+	queue.push(&pb.Task{Id: 3, Operation: "+"})
+
+	select {
+	case <-ready:
+	default:
+		t.Fatal("Push should wake up waiting consumers")
+	}
+
+	adds := func(task *pb.Task) bool { return task.Operation == "+" }
+	if task := queue.pop(adds); task == nil || task.Id != 2 {
+		t.Fatalf("Expected task 2, got %v", task)
+	}
+	if task := queue.pop(func(*pb.Task) bool { return false }); task != nil {
+		t.Fatalf("No task should be accepted, got %v", task)
+	}
+
+	if removed := queue.removeIf(adds); removed != 1 {
+		t.Fatalf("Expected 1 removed task, got %d", removed)
+	}
+	if task := queue.pop(nil); task == nil || task.Id != 1 {
+		t.Fatalf("Expected task 1, got %v", task)
+	}
+	if queue.len() != 0 {
+		t.Errorf("Queue should be empty, got %d tasks", queue.len())
+	}
+}
+
+func TestStaleTasks(t *testing.T) {
+	queue := newDispatchQueue()
+	queue.push(&pb.Task{Id: 1, Operation: "*"})
+	queue.push(&pb.Task{Id: 2, Operation: "+"})
+	all := func(*pb.Task) bool { return true }
+
+	if stale := queue.removeStale(time.Now().Add(-time.Minute), all); len(stale) != 0 {
+		t.Fatalf("Fresh tasks should not be stale, got %v", stale)
+	}
+
+	later := time.Now().Add(time.Minute)
+	stale := queue.removeStale(later, func(task *pb.Task) bool { return task.Operation == "*" })
+	if len(stale) != 1 || stale[0].Id != 1 {
+		t.Fatalf("Expected only task 1 to be removed, got %v", stale)
+	}
+	if queue.len() != 1 {
+		t.Errorf("Expected 1 task left, got %d", queue.len())
+	}
+
+	// возвращённая в очередь задача ждёт заново
+	queue.push(queue.pop(nil))
+	if stale := queue.removeStale(time.Now().Add(-time.Minute), all); len(stale) != 0 {
+		t.Errorf("Requeued task should not be stale, got %v", stale)
+	}
+}
+
+func TestCapabilityRouting(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("routinguser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	if err := database.SaveExpression(expressionID, userID, "2*3+4+5", "processing", 0); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+	mulID, _ := database.SaveTask(expressionID, 0, []float64{2, 3}, "*")
+	addID, _ := database.SaveTask(expressionID, 0, []float64{4, 5}, "+")
+	pendingTasks.register(mulID, expressionID)
+	pendingTasks.register(addID, expressionID)
+	defer func() {
+		pendingTasks.release(expressionID, errExpressionFinished)
+		database.FinishExpression(expressionID, "error", 0)
+	}()
+
+	// умножение уже в очереди, сложение дождалось только базы
+	taskQueue.push(&pb.Task{Id: int32(mulID), Arg1: 2, Arg2: 3, Operation: "*", HasTask: true})
+
+	server := &TaskServer{}
+	server.RegisterAgent(context.Background(), &pb.AgentInfo{AgentId: "adder", Workers: 1, Operations: []string{"+"}})
+	server.RegisterAgent(context.Background(), &pb.AgentInfo{AgentId: "multiplier", Workers: 1, Operations: []string{"*"}})
+
+	task, err := server.GetTask(context.Background(), &pb.TaskRequest{AgentId: "adder"})
+	if err != nil || int(task.Id) != addID {
+		t.Fatalf("Expected task %d for adder, got %v (%v)", addID, task, err)
+	}
+	if taskQueue.len() != 1 {
+		t.Fatal("Task the agent cannot execute should stay in the queue")
+	}
+
+	task, _ = server.GetTask(context.Background(), &pb.TaskRequest{AgentId: "adder"})
+	if task.HasTask {
+		t.Fatalf("Adder should not get task %d with operation %s", task.Id, task.Operation)
+	}
+
+	task, err = server.GetTask(context.Background(), &pb.TaskRequest{AgentId: "multiplier"})
+	if err != nil || int(task.Id) != mulID {
+		t.Fatalf("Expected task %d for multiplier, got %v (%v)", mulID, task, err)
+	}
+}
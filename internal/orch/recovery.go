@@ -0,0 +1,65 @@
+package orch
+
+import (
+	"log"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+// recoverExpressions продолжает вычисление выражений, оставшихся в обработке после перезапуска.
+// Уже выполненные задачи не пересчитываются, ожидание невыполненных восстанавливается.
+func recoverExpressions() {
+	database := db.GetInstance()
+	expressions, err := database.GetProcessingExpressions()
+	if err != nil {
+		log.Printf("Error receiving unfinished expressions: %v", err)
+		return
+	}
+
+	for _, exp := range expressions {
+		g, err := buildGraph(exp.Expression, exp.Variables)
+		if err != nil {
+			log.Printf("Error parsing expression %d: %v", exp.ID, err)
+			finishExpression(exp.ID, "error", 0)
+			continue
+		}
+
+		tasks, err := database.GetExpressionTasks(exp.ID)
+		if err != nil {
+			log.Printf("Error receiving tasks of expression %d: %v", exp.ID, err)
+			continue
+		}
+		g.restore(tasks)
+		g.replicas = exp.Replicas
+
+		log.Printf("Resuming expression %d (%d tasks already created)", exp.ID, len(tasks))
+		go runGraph(exp.ID, g)
+	}
+}
+
+// resumeTask снова ждёт задачу, созданную до перезапуска.
+// Задачу без аренды возвращаем в очередь, арендованную вернёт reaper, если агент пропал.
+func resumeTask(expressionID, taskID int, op string, args []float64) (float64, error) {
+	ch, err := registerTask(taskID, expressionID)
+	if err != nil {
+		return 0, err
+	}
+
+	database := db.GetInstance()
+	result, processed, leased, err := database.GetTaskState(taskID)
+	if err != nil {
+		pendingTasks.resolve(taskID, taskOutcome{err: err})
+	} else if processed {
+		// результат успел прийти до регистрации ожидания
+		pendingTasks.resolve(taskID, taskOutcome{value: result})
+	} else if replicas, err := database.GetTaskReplicas(taskID); err != nil {
+		pendingTasks.resolve(taskID, taskOutcome{err: err})
+	} else if len(replicas) > 0 {
+		resumeReplicas(expressionID, taskID, op, args, replicas)
+	} else if !leased {
+		taskQueue.push(newTask(taskID, op, args))
+	}
+
+	outcome := <-ch
+	return outcome.value, outcome.err
+}
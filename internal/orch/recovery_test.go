@@ -0,0 +1,103 @@
+package orch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+func TestRecoverExpressions(t *testing.T) {
+	database := db.GetInstance()
+
+	userID, err := database.CreateUser("recoveryuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	if err := database.SaveExpression(expressionID, userID, "(1+2)*(3+4)", "processing", 0); err != nil {
+		t.Fatalf("Failed to save expression: %v", err)
+	}
+
+	// до перезапуска первое сложение успело выполниться, второе осталось в очереди
+	done, err := database.SaveTask(expressionID, 1, []float64{1.0, 2.0}, "+")
+	if err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+	database.UpdateTaskResult(done, 3.0)
+
+	lost, err := database.SaveTask(expressionID, 2, []float64{3.0, 4.0}, "+")
+	if err != nil {
+		t.Fatalf("Failed to save task: %v", err)
+	}
+
+	recoverExpressions()
+
+	server := &TaskServer{}
+	task := nextTask(t, expressionID)
+	if int(task.Id) != lost {
+		t.Fatalf("Expected lost task %d to be requeued, got %d", lost, task.Id)
+	}
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: task.Id, Result: 7})
+
+	product := nextTask(t, expressionID)
+	if product.Operation != "*" || product.Arg1 != 3 || product.Arg2 != 7 {
+		t.Fatalf("Expected 3 * 7, got %f %s %f", product.Arg1, product.Operation, product.Arg2)
+	}
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: product.Id, Result: 21})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, status, result, err := database.GetExpression(expressionID, userID)
+		if err != nil {
+			t.Fatalf("Failed to get expression: %v", err)
+		}
+		if status == "completed" {
+			if result != 21 {
+				t.Errorf("Result mismatch: expected 21, got %f", result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expression was not completed after recovery, status %s", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tasks, _ := database.GetExpressionTasks(expressionID)
+	if len(tasks) != 3 {
+		t.Errorf("Expected only the missing multiplication to be created, got %d tasks", len(tasks))
+	}
+}
+
+func TestRestoreSkipsCompletedSubtrees(t *testing.T) {
+	g, err := buildGraph("(1+2)*(3+4)", nil)
+	if err != nil {
+		t.Fatalf("buildGraph failed: %v", err)
+	}
+
+	g.restore([]struct {
+		ID        int
+		Node      int
+		Processed bool
+		Result    float64
+	}{
+		{ID: 1, Node: 1, Processed: true, Result: 3},
+		{ID: 2, Node: 2, Processed: true, Result: 7},
+		{ID: 3, Node: 0, Processed: false},
+	})
+
+	ready := g.ready()
+	if len(ready) != 1 || ready[0] != 0 {
+		t.Fatalf("Expected only the root to be ready, got %v", ready)
+	}
+
+	root := g.nodes[0]
+	if root.taskID != 3 || root.args[0].value != 3 || root.args[1].value != 7 {
+		t.Errorf("Root was not restored: task %d args %v", root.taskID, root.args)
+	}
+}
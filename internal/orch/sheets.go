@@ -0,0 +1,612 @@
+package orch
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+// Лист — набор ячеек с выражениями. Имя без скобок в выражении ячейки — ссылка на другую
+// ячейку того же листа ($42 и $label по-прежнему ссылаются на выражения). Каждый пересчёт
+// ячейки — обычное выражение, его задачи выполняют агенты. Когда ячейка меняется,
+// пересчитываются только она и ячейки, которые от неё зависят.
+
+// sheetsMu упорядочивает изменения ячеек, чтобы проверка на циклы видела все ссылки
+var sheetsMu sync.Mutex
+
+type sheetCell struct {
+	Name         string    `json:"name"`
+	Expression   string    `json:"expression"`
+	Status       string    `json:"status"`
+	Value        float64   `json:"value"`
+	Error        string    `json:"error,omitempty"`
+	ExpressionID int       `json:"expression_id,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type sheet struct {
+	ID        int         `json:"id"`
+	Name      string      `json:"name"`
+	CreatedAt time.Time   `json:"created_at"`
+	Cells     []sheetCell `json:"cells,omitempty"`
+}
+
+// sheetGraph — ссылки между ячейками: deps[c] — ячейки, на которые ссылается c,
+// dependents[c] — ячейки, которые ссылаются на c
+type sheetGraph struct {
+	cells      map[string]bool
+	deps       map[string][]string
+	dependents map[string][]string
+}
+
+func newSheetGraph(expressions map[string]string) *sheetGraph {
+	g := &sheetGraph{
+		cells:      make(map[string]bool, len(expressions)),
+		deps:       make(map[string][]string, len(expressions)),
+		dependents: make(map[string][]string),
+	}
+	for name, expression := range expressions {
+		g.cells[name] = true
+		g.deps[name] = cellReferences(expression)
+		for _, dep := range g.deps[name] {
+			g.dependents[dep] = append(g.dependents[dep], name)
+		}
+	}
+	return g
+}
+
+// cellReferences возвращает ячейки, на которые ссылается выражение, без повторов
+func cellReferences(expression string) []string {
+	var refs []string
+	for _, name := range variableNames(expression) {
+		if !isReference(name.text) && !slices.Contains(refs, name.text) {
+			refs = append(refs, name.text)
+		}
+	}
+	return refs
+}
+
+// cycle возвращает цикл ссылок через ячейку start (start -> ... -> start) или nil
+func (g *sheetGraph) cycle(start string) []string {
+	visited := make(map[string]bool)
+	path := []string{start}
+
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		for _, dep := range g.deps[name] {
+			if dep == start {
+				path = append(path, start)
+				return true
+			}
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			path = append(path, dep)
+			if visit(dep) {
+				return true
+			}
+			path = path[:len(path)-1]
+		}
+		return false
+	}
+
+	if visit(start) {
+		return path
+	}
+	return nil
+}
+
+// affected возвращает изменённые ячейки и все, что от них зависят, в порядке пересчёта:
+// каждая ячейка идёт после тех, на которые ссылается. Ячейки, попавшие в цикл, упорядочить
+// нельзя, они возвращаются отдельно.
+func (g *sheetGraph) affected(changed []string) (order []string, cyclic []string) {
+	marked := make(map[string]bool)
+	queue := slices.Clone(changed)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if marked[name] {
+			continue
+		}
+		marked[name] = true
+		queue = append(queue, g.dependents[name]...)
+	}
+
+	// удалённые ячейки пересчитывать не нужно, но их зависимые — нужно
+	waiting := make(map[string]int)
+	var ready []string
+	for name := range marked {
+		if !g.cells[name] {
+			continue
+		}
+		for _, dep := range g.deps[name] {
+			if marked[dep] && g.cells[dep] {
+				waiting[name]++
+			}
+		}
+		if waiting[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+	slices.Sort(ready)
+
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		for _, dependent := range g.dependents[name] {
+			if !marked[dependent] || !g.cells[dependent] {
+				continue
+			}
+			// cellReferences убирает повторы, поэтому каждая ссылка учтена один раз
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	for name := range marked {
+		if g.cells[name] && !slices.Contains(order, name) {
+			cyclic = append(cyclic, name)
+		}
+	}
+	slices.Sort(cyclic)
+	return order, cyclic
+}
+
+// sheetScheduler пересчитывает листы. Пересчёты одного листа идут по очереди: ячейки,
+// изменённые во время пересчёта, копятся и пересчитываются следующим проходом.
+type sheetScheduler struct {
+	mu      sync.Mutex
+	dirty   map[int]map[string]bool
+	running map[int]bool
+}
+
+var sheets = &sheetScheduler{
+	dirty:   make(map[int]map[string]bool),
+	running: make(map[int]bool),
+}
+
+func (s *sheetScheduler) schedule(sheetID, userID int, cells ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dirty[sheetID] == nil {
+		s.dirty[sheetID] = make(map[string]bool)
+	}
+	for _, name := range cells {
+		s.dirty[sheetID][name] = true
+	}
+
+	if !s.running[sheetID] {
+		s.running[sheetID] = true
+		go s.run(sheetID, userID)
+	}
+}
+
+func (s *sheetScheduler) run(sheetID, userID int) {
+	for {
+		s.mu.Lock()
+		var changed []string
+		for name := range s.dirty[sheetID] {
+			changed = append(changed, name)
+		}
+		delete(s.dirty, sheetID)
+		if len(changed) == 0 {
+			delete(s.running, sheetID)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		recalculateSheet(sheetID, userID, changed)
+	}
+}
+
+// cellState — значение ячейки, которое видят ссылающиеся на неё ячейки
+type cellState struct {
+	status       string
+	value        float64
+	expressionID int
+}
+
+// recalculateSheet пересчитывает изменённые ячейки и всё, что от них зависит.
+// Независимые ячейки считаются параллельно, каждая ждёт только те, на которые ссылается.
+func recalculateSheet(sheetID, userID int, changed []string) {
+	database := db.GetInstance()
+	cells, err := database.GetSheetCells(sheetID)
+	if err != nil {
+		log.Printf("Error receiving cells of sheet %d: %v", sheetID, err)
+		return
+	}
+
+	expressions := make(map[string]string, len(cells))
+	revisions := make(map[string]int, len(cells))
+	states := make(map[string]cellState, len(cells))
+	for _, c := range cells {
+		expressions[c.Name] = c.Expression
+		revisions[c.Name] = c.Revision
+		states[c.Name] = cellState{status: c.Status, value: c.Value, expressionID: c.ExpressionID}
+	}
+
+	g := newSheetGraph(expressions)
+	order, cyclic := g.affected(changed)
+	for _, name := range cyclic {
+		saveCellResult(sheetID, name, revisions[name], cellState{status: "error"}, "reference cycle")
+	}
+
+	var statesMu sync.Mutex
+	done := make(map[string]chan struct{}, len(order))
+	for _, name := range order {
+		done[name] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range order {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer close(done[name])
+
+			for _, dep := range g.deps[name] {
+				if ch, ok := done[dep]; ok {
+					<-ch
+				}
+			}
+
+			statesMu.Lock()
+			lookup := make(map[string]cellState, len(g.deps[name]))
+			waiting := false
+			for _, dep := range g.deps[name] {
+				if state, ok := states[dep]; ok {
+					lookup[dep] = state
+					waiting = waiting || state.status == "pending"
+				}
+			}
+			statesMu.Unlock()
+
+			// ячейку, на которую ссылаемся, пересчитает следующий проход, а вместе с ней и эту
+			if waiting {
+				return
+			}
+
+			state, errMsg := evaluateCell(userID, expressions[name], lookup)
+			saveCellResult(sheetID, name, revisions[name], state, errMsg)
+
+			statesMu.Lock()
+			states[name] = state
+			statesMu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+}
+
+// evaluateCell считает выражение ячейки по значениям ячеек, на которые оно ссылается
+func evaluateCell(userID int, expression string, cells map[string]cellState) (cellState, string) {
+	bindings := make(map[string]float64)
+	var dependsOn []int
+
+	for _, name := range variableNames(expression) {
+		if isReference(name.text) {
+			id, result, err := resolveReference(userID, name)
+			if err != nil {
+				return cellState{status: "error"}, err.Error()
+			}
+			bindings[name.text] = result
+			dependsOn = append(dependsOn, id)
+			continue
+		}
+
+		dep, ok := cells[name.text]
+		if !ok {
+			return cellState{status: "error"}, fmt.Sprintf("cell %s is empty", name.text)
+		}
+		if dep.status != "completed" {
+			return cellState{status: "error"}, fmt.Sprintf("cell %s has no value", name.text)
+		}
+		bindings[name.text] = dep.value
+		if dep.expressionID != 0 && !slices.Contains(dependsOn, dep.expressionID) {
+			dependsOn = append(dependsOn, dep.expressionID)
+		}
+	}
+
+	id, err := startExpression(userID, calculateRequest{Expr: expression}, bindings, dependsOn)
+	if err != nil {
+		return cellState{status: "error"}, "internal error"
+	}
+
+	status, result, err := awaitExpression(context.Background(), id, userID)
+	if err != nil {
+		log.Printf("Error waiting for expression %d: %v", id, err)
+		return cellState{status: "error", expressionID: id}, "internal error"
+	}
+	if status != "completed" {
+		return cellState{status: "error", expressionID: id}, fmt.Sprintf("expression %d finished with status %s", id, status)
+	}
+	return cellState{status: "completed", value: result, expressionID: id}, ""
+}
+
+// saveCellResult сохраняет итог ячейки. Если ячейку за время пересчёта изменили,
+// итог устарел: её пересчитает следующий проход.
+func saveCellResult(sheetID int, name string, revision int, state cellState, errMsg string) {
+	database := db.GetInstance()
+	_, err := database.SetCellResult(sheetID, name, revision, state.status, state.value, errMsg, state.expressionID, time.Now())
+	if err != nil {
+		log.Printf("Error saving cell %s of sheet %d: %v", name, sheetID, err)
+	}
+}
+
+// recoverSheets продолжает пересчёт ячеек, прерванный перезапуском
+func recoverSheets() {
+	database := db.GetInstance()
+	cells, err := database.GetPendingCells()
+	if err != nil {
+		log.Printf("Error receiving pending cells: %v", err)
+		return
+	}
+
+	for _, c := range cells {
+		sheets.schedule(c.SheetID, c.UserID, c.Name)
+	}
+}
+
+func handleSheets(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		listSheets(w, userID)
+	case http.MethodPost:
+		createSheet(w, r, userID)
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+func createSheet(w http.ResponseWriter, r *http.Request, userID int) {
+	var req sheet
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	created := sheet{Name: req.Name, CreatedAt: time.Now()}
+	database := db.GetInstance()
+	id, err := database.CreateSheet(userID, created.Name, created.CreatedAt)
+	if err != nil {
+		log.Printf("Error saving sheet: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	created.ID = id
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+func listSheets(w http.ResponseWriter, userID int) {
+	database := db.GetInstance()
+	dbSheets, err := database.GetSheets(userID)
+	if err != nil {
+		log.Printf("Error receiving sheets: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]sheet, 0, len(dbSheets))
+	for _, s := range dbSheets {
+		list = append(list, sheet{ID: s.ID, Name: s.Name, CreatedAt: s.CreatedAt})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"sheets": list})
+}
+
+// handleSheetByID обслуживает /api/v1/sheets/{id} и /api/v1/sheets/{id}/cells/{name}
+func handleSheetByID(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	idStr, cell, isCell := strings.Cut(r.URL.Path[len("/api/v1/sheets/"):], "/cells/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	database := db.GetInstance()
+	name, createdAt, err := database.GetSheet(id, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Sheet not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error receiving sheet %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case isCell && r.Method == http.MethodPut:
+		setCell(w, r, id, userID, cell)
+	case isCell && r.Method == http.MethodDelete:
+		deleteCell(w, id, userID, cell)
+	case !isCell && r.Method == http.MethodGet:
+		getSheet(w, sheet{ID: id, Name: name, CreatedAt: createdAt})
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+func getSheet(w http.ResponseWriter, s sheet) {
+	database := db.GetInstance()
+	cells, err := database.GetSheetCells(s.ID)
+	if err != nil {
+		log.Printf("Error receiving cells of sheet %d: %v", s.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, c := range cells {
+		s.Cells = append(s.Cells, sheetCell{
+			Name:         c.Name,
+			Expression:   c.Expression,
+			Status:       c.Status,
+			Value:        c.Value,
+			Error:        c.Error,
+			ExpressionID: c.ExpressionID,
+			UpdatedAt:    c.UpdatedAt,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"sheet": s})
+}
+
+// setCell меняет выражение ячейки и запускает пересчёт её и зависимых ячеек.
+// Выражение, замыкающее цикл ссылок, отклоняется.
+func setCell(w http.ResponseWriter, r *http.Request, sheetID, userID int, name string) {
+	var req struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateVariables(map[string]float64{name: 0}); err != nil {
+		http.Error(w, "Invalid cell name "+strconv.Quote(name), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Expression) == "" {
+		http.Error(w, "Expression is required", http.StatusBadRequest)
+		return
+	}
+
+	sheetsMu.Lock()
+	defer sheetsMu.Unlock()
+
+	g, err := loadSheetGraph(sheetID, map[string]string{name: req.Expression})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if cycle := g.cycle(name); cycle != nil {
+		http.Error(w, "Reference cycle: "+strings.Join(cycle, " -> "), http.StatusUnprocessableEntity)
+		return
+	}
+
+	now := time.Now()
+	database := db.GetInstance()
+	if err := database.SetCellExpression(sheetID, name, req.Expression, now); err != nil {
+		log.Printf("Error saving cell %s of sheet %d: %v", name, sheetID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	affected, ok := markAffected(g, sheetID, userID, name, now)
+	if !ok {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	cell := sheetCell{Name: name, Expression: req.Expression, Status: "pending", UpdatedAt: now}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"cell": cell, "affected": affected})
+}
+
+// deleteCell удаляет ячейку; ссылающиеся на неё ячейки пересчитываются и получают ошибку
+func deleteCell(w http.ResponseWriter, sheetID, userID int, name string) {
+	sheetsMu.Lock()
+	defer sheetsMu.Unlock()
+
+	database := db.GetInstance()
+	ok, err := database.DeleteCell(sheetID, name)
+	if err != nil {
+		log.Printf("Error deleting cell %s of sheet %d: %v", name, sheetID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Cell not found", http.StatusNotFound)
+		return
+	}
+
+	g, err := loadSheetGraph(sheetID, nil)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	affected, ok := markAffected(g, sheetID, userID, name, time.Now())
+	if !ok {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "status": "deleted", "affected": affected})
+}
+
+// loadSheetGraph строит граф ссылок листа, заменяя выражения ячеек из changed
+func loadSheetGraph(sheetID int, changed map[string]string) (*sheetGraph, error) {
+	database := db.GetInstance()
+	cells, err := database.GetSheetCells(sheetID)
+	if err != nil {
+		log.Printf("Error receiving cells of sheet %d: %v", sheetID, err)
+		return nil, err
+	}
+
+	expressions := make(map[string]string, len(cells)+len(changed))
+	for _, c := range cells {
+		expressions[c.Name] = c.Expression
+	}
+	for name, expression := range changed {
+		expressions[name] = expression
+	}
+	return newSheetGraph(expressions), nil
+}
+
+// markAffected отмечает ячейки, которые затронет изменение name, и ставит лист в пересчёт
+func markAffected(g *sheetGraph, sheetID, userID int, name string, now time.Time) ([]string, bool) {
+	affected, _ := g.affected([]string{name})
+	if affected == nil {
+		affected = []string{}
+	}
+
+	database := db.GetInstance()
+	if err := database.MarkCellsPending(sheetID, affected, now); err != nil {
+		log.Printf("Error marking cells of sheet %d: %v", sheetID, err)
+		return nil, false
+	}
+
+	sheets.schedule(sheetID, userID, name)
+	return affected, true
+}
@@ -0,0 +1,180 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+func TestSheetGraph(t *testing.T) {
+	g := newSheetGraph(map[string]string{
+		"a": "1",
+		"b": "a * 2",
+		"c": "a + b + sqrt(b)",
+		"d": "pi",
+		"e": "gone + 1",
+	})
+
+	order, cyclic := g.affected([]string{"a"})
+	if !slices.Equal(order, []string{"a", "b", "c"}) || len(cyclic) != 0 {
+		t.Errorf("Unexpected recalculation order %v, cyclic %v", order, cyclic)
+	}
+	// удалённая ячейка сама не пересчитывается, её зависимые — да
+	if order, _ := g.affected([]string{"gone"}); !slices.Equal(order, []string{"e"}) {
+		t.Errorf("Expected only e to be affected, got %v", order)
+	}
+	if cycle := g.cycle("c"); cycle != nil {
+		t.Errorf("Unexpected cycle %v", cycle)
+	}
+
+	g = newSheetGraph(map[string]string{"a": "c + 1", "b": "a * 2", "c": "b - 1", "s": "s"})
+	if cycle := g.cycle("a"); !slices.Equal(cycle, []string{"a", "c", "b", "a"}) {
+		t.Errorf("Expected cycle a -> c -> b -> a, got %v", cycle)
+	}
+	if cycle := g.cycle("s"); !slices.Equal(cycle, []string{"s", "s"}) {
+		t.Errorf("Expected self reference, got %v", cycle)
+	}
+	if order, cyclic := g.affected([]string{"a"}); len(order) != 0 || !slices.Equal(cyclic, []string{"a", "b", "c"}) {
+		t.Errorf("Cells in a cycle cannot be ordered, got %v and %v", order, cyclic)
+	}
+}
+
+func TestSheetRecalculation(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("sheetuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	request := func(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	rr := request(handleSheets, "POST", "/api/v1/sheets", `{"name": "budget"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Create sheet returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var created sheet
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	cellsPath := "/api/v1/sheets/" + strconv.Itoa(created.ID) + "/cells/"
+
+	setCell := func(name, expression string) (int, []string) {
+		rr := request(handleSheetByID, "PUT", cellsPath+name, `{"expression": "`+expression+`"}`)
+		var response struct {
+			Affected []string `json:"affected"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response.Affected
+	}
+	// settled ждёт, пока на листе не останется ячеек в пересчёте
+	settled := func() map[string]sheetCell {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			rr := request(handleSheetByID, "GET", "/api/v1/sheets/"+strconv.Itoa(created.ID), "")
+			var response struct {
+				Sheet sheet `json:"sheet"`
+			}
+			json.Unmarshal(rr.Body.Bytes(), &response)
+
+			cells := make(map[string]sheetCell)
+			pending := false
+			for _, c := range response.Sheet.Cells {
+				cells[c.Name] = c
+				pending = pending || c.Status == "pending"
+			}
+			if !pending {
+				return cells
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Sheet did not settle: %+v", response.Sheet.Cells)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	defer startFakeAgent()()
+
+	setCell("price", "20")
+	setCell("qty", "3")
+	setCell("total", "price * qty")
+	setCell("taxed", "total * 1.5 + price")
+	cells := settled()
+	if cells["taxed"].Status != "completed" || cells["taxed"].Value != 110 {
+		t.Fatalf("Expected taxed = 110, got %+v", cells["taxed"])
+	}
+
+	code, affected := setCell("qty", "4")
+	if code != http.StatusOK || !slices.Equal(affected, []string{"qty", "total", "taxed"}) {
+		t.Fatalf("Expected qty, total and taxed to be recalculated, got %d %v", code, affected)
+	}
+	recalculated := settled()
+	if recalculated["taxed"].Value != 140 {
+		t.Errorf("Expected taxed = 140, got %+v", recalculated["taxed"])
+	}
+	if recalculated["price"].ExpressionID != cells["price"].ExpressionID {
+		t.Error("Unaffected cell should not be recalculated")
+	}
+
+	if code, _ := setCell("price", "taxed / 2"); code != http.StatusUnprocessableEntity {
+		t.Errorf("Reference cycle: expected %d, got %d", http.StatusUnprocessableEntity, code)
+	}
+	if code, _ := setCell("2x", "1"); code != http.StatusBadRequest {
+		t.Errorf("Invalid cell name: expected %d, got %d", http.StatusBadRequest, code)
+	}
+
+	rr = request(handleSheetByID, "DELETE", cellsPath+"qty", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Delete cell returned %d", rr.Code)
+	}
+	cells = settled()
+	if cells["total"].Status != "error" || cells["taxed"].Status != "error" {
+		t.Errorf("Cells referencing a deleted cell should fail, got %+v", cells)
+	}
+	if cells["price"].Status != "completed" {
+		t.Errorf("Unrelated cell should keep its value, got %+v", cells["price"])
+	}
+
+	setCell("qty", "1")
+	if cells := settled(); cells["taxed"].Value != 50 {
+		t.Errorf("Expected taxed = 50 after restoring qty, got %+v", cells["taxed"])
+	}
+}
+
+func TestRecalculationWaitsForPendingReferences(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("sheetpendinguser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	sheetID, err := database.CreateSheet(userID, "pending", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create sheet: %v", err)
+	}
+
+	database.SetCellExpression(sheetID, "total", "2", time.Now())
+	database.SetCellExpression(sheetID, "taxed", "total * 2", time.Now())
+
+	// total ждёт своего прохода, который пересчитает и taxed: отдельный проход
+	// для taxed не должен записать ей ошибку
+	recalculateSheet(sheetID, userID, []string{"taxed"})
+
+	cells, _ := database.GetSheetCells(sheetID)
+	for _, c := range cells {
+		if c.Name == "taxed" && c.Status != "pending" {
+			t.Errorf("Cell referencing a pending cell should stay pending, got %s (%s)", c.Status, c.Error)
+		}
+	}
+}
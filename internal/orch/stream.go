@@ -0,0 +1,208 @@
+package orch
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+// TaskStream отправляет агенту задачи, как только они попадают в очередь, но не больше,
+// чем агент объявил свободных мест. Результаты приходят по тому же потоку.
+func (s *TaskServer) TaskStream(stream pb.TaskService_TaskStreamServer) error {
+	ctx := stream.Context()
+	capacity := make(chan *pb.AgentCapacity, 16)
+	errc := make(chan error, 1)
+
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			switch payload := msg.Payload.(type) {
+			case *pb.AgentMessage_Capacity:
+				if err := checkAgentID(ctx, payload.Capacity.AgentId); err != nil {
+					errc <- err
+					return
+				}
+				select {
+				case capacity <- payload.Capacity:
+				case <-ctx.Done():
+					return
+				}
+			case *pb.AgentMessage_Result:
+				if _, err := s.SendTaskResult(ctx, payload.Result); err != nil {
+					errc <- err
+					return
+				}
+				streamed.forget(int(payload.Result.Id))
+			}
+		}
+	}()
+
+	// задачи, которые есть в базе, но не в очереди, забираем так же, как GetTask
+	fallback := time.NewTicker(time.Second)
+	defer fallback.Stop()
+
+	inbox := newStreamInbox()
+	defer streamed.close(inbox)
+
+	var agentID string
+	free := 0
+	for {
+		var task *pb.Task
+		var ready <-chan struct{}
+		// пока у агента нет свободных мест, очередь не трогаем
+		if free > 0 {
+			// канал берём до попытки, чтобы не пропустить задачу, добавленную сразу после неё
+			ready = taskQueue.ready()
+			task = popTask(agentID)
+		}
+
+		if task == nil {
+			select {
+			case c := <-capacity:
+				agentID = c.AgentId
+				free += int(c.Free)
+				// задачи могли накопиться в базе, пока агент был занят
+				if free > 0 {
+					task = pollTask(agentID)
+				}
+			case <-ready:
+			case <-inbox.signal:
+				for _, id := range inbox.take() {
+					if err := stream.Send(&pb.Task{Id: id, Cancelled: true}); err != nil {
+						return err
+					}
+				}
+			case <-fallback.C:
+				if free > 0 {
+					task = pollTask(agentID)
+				}
+			case err := <-errc:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if task == nil {
+			continue
+		}
+
+		if err := stream.Send(task); err != nil {
+			// агент задачу не получил — сразу возвращаем её в очередь
+			database := db.GetInstance()
+			if err := database.ReleaseTaskLease(int(task.Id)); err != nil {
+				log.Printf("Error releasing lease of task %d: %v", task.Id, err)
+			} else {
+				taskQueue.push(task)
+			}
+			return err
+		}
+		streamed.hold(int(task.Id), inbox)
+		free--
+	}
+}
+
+// streamInbox — отмены задач, которые нужно передать агенту по его потоку
+type streamInbox struct {
+	mu        sync.Mutex
+	cancelled []int32
+	signal    chan struct{}
+}
+
+func newStreamInbox() *streamInbox {
+	return &streamInbox{signal: make(chan struct{}, 1)}
+}
+
+func (b *streamInbox) push(taskID int) {
+	b.mu.Lock()
+	b.cancelled = append(b.cancelled, int32(taskID))
+	b.mu.Unlock()
+
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (b *streamInbox) take() []int32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ids := b.cancelled
+	b.cancelled = nil
+	return ids
+}
+
+// streamedTasks помнит, по какому потоку отправлена задача, чтобы сообщить агенту об её отмене.
+// Агенту, который только опрашивает GetTask, об отмене скажет отказ в продлении аренды.
+type streamedTasks struct {
+	mu    sync.Mutex
+	tasks map[int]*streamInbox
+}
+
+var streamed = &streamedTasks{tasks: make(map[int]*streamInbox)}
+
+func (s *streamedTasks) hold(taskID int, inbox *streamInbox) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tasks[taskID] = inbox
+}
+
+// forget убирает задачу, результат которой агент уже прислал
+func (s *streamedTasks) forget(taskID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tasks, taskID)
+}
+
+// close убирает задачи закрытого потока
+func (s *streamedTasks) close(inbox *streamInbox) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, held := range s.tasks {
+		if held == inbox {
+			delete(s.tasks, id)
+		}
+	}
+}
+
+// drop просит агентов бросить задачи ids
+func (s *streamedTasks) drop(ids []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if inbox, ok := s.tasks[id]; ok {
+			inbox.push(id)
+			delete(s.tasks, id)
+		}
+	}
+}
+
+// cancel просит агентов бросить задачи выражения и возвращает, сколько задач отменено.
+// Вызывается до того, как выражение перестанут ждать, иначе задачи уже не связать с ним.
+func (s *streamedTasks) cancel(expressionID int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, inbox := range s.tasks {
+		if owner, ok := expressionOfTask(id); ok && owner == expressionID {
+			inbox.push(id)
+			delete(s.tasks, id)
+			n++
+		}
+	}
+	return n
+}
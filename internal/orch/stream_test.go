@@ -0,0 +1,126 @@
+package orch
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestTaskStream(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterTaskServiceServer(server, &TaskServer{})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	database := db.GetInstance()
+	userID, err := database.CreateUser("streamuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	lastID, _ := database.GetLastExpressionID()
+	expressionID := lastID + 1
+	database.SaveExpression(expressionID, userID, "3+4", "processing", 0)
+	defer func() {
+		pendingTasks.release(expressionID, errExpressionFinished)
+		database.FinishExpression(expressionID, "error", 0)
+	}()
+
+	enqueue := func(arg1, arg2 float64) (int, <-chan taskOutcome) {
+		taskID, err := database.SaveTask(expressionID, 0, []float64{arg1, arg2}, "+")
+		if err != nil {
+			t.Fatalf("Failed to save task: %v", err)
+		}
+		waiting := pendingTasks.register(taskID, expressionID)
+		taskQueue.push(&pb.Task{Id: int32(taskID), Arg1: arg1, Arg2: arg2, Operation: "+", HasTask: true})
+		return taskID, waiting
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := pb.NewTaskServiceClient(conn).TaskStream(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	capacity := func(free int32) {
+		msg := &pb.AgentMessage{Payload: &pb.AgentMessage_Capacity{Capacity: &pb.AgentCapacity{AgentId: "stream-agent", Free: free}}}
+		if err := stream.Send(msg); err != nil {
+			t.Fatalf("Failed to send capacity: %v", err)
+		}
+	}
+
+	first, waiting := enqueue(3, 4)
+
+	// агент ещё не объявил свободных мест — задача остаётся в очереди
+	time.Sleep(50 * time.Millisecond)
+	if taskQueue.len() != 1 {
+		t.Fatalf("Task was taken from the queue without capacity")
+	}
+
+	capacity(1)
+	task, err := stream.Recv()
+	if err != nil || int(task.Id) != first {
+		t.Fatalf("Expected task %d, got %v (%v)", first, task, err)
+	}
+
+	second, _ := enqueue(5, 6)
+	time.Sleep(50 * time.Millisecond)
+	if taskQueue.len() != 1 {
+		t.Fatalf("Task was pushed beyond the announced capacity")
+	}
+
+	result := &pb.AgentMessage{Payload: &pb.AgentMessage_Result{Result: &pb.TaskResult{Id: task.Id, Result: 7, AgentId: "stream-agent"}}}
+	if err := stream.Send(result); err != nil {
+		t.Fatalf("Failed to send result: %v", err)
+	}
+
+	select {
+	case outcome := <-waiting:
+		if outcome.err != nil || outcome.value != 7 {
+			t.Errorf("Expected 7, got %v (%v)", outcome.value, outcome.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Result sent over the stream was not delivered")
+	}
+
+	capacity(1)
+	task, err = stream.Recv()
+	if err != nil || int(task.Id) != second {
+		t.Fatalf("Expected task %d, got %v (%v)", second, task, err)
+	}
+
+	held, _ := database.GetAgentTasks("stream-agent")
+	if len(held) != 1 || held[0].ID != second {
+		t.Errorf("Expected task %d to be leased by stream-agent, got %+v", second, held)
+	}
+
+	// отмена выражения доходит до агента, не дожидаясь продления аренды
+	rr := httptest.NewRecorder()
+	handleCancelExpression(rr, expressionID, userID)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Cancel returned %d: %s", rr.Code, rr.Body.String())
+	}
+	task, err = stream.Recv()
+	if err != nil || int(task.Id) != second || !task.Cancelled {
+		t.Errorf("Expected cancellation of task %d, got %v (%v)", second, task, err)
+	}
+}
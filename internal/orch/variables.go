@@ -0,0 +1,218 @@
+package orch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+var errLabelTaken = errors.New("label is already used by another expression")
+
+// bindError — имя выражения, которому нечего подставить; такой запрос отклоняется сразу
+type bindError struct {
+	msg string
+}
+
+func (e *bindError) Error() string { return e.msg }
+
+// bindVariables находит значения всех имён выражения: переменные запроса, затем сохранённые
+// переменные пользователя, а для $42 и $label — результаты его завершённых выражений.
+// Возвращает только использованные значения и выражения, от результатов которых зависит это.
+func bindVariables(userID int, expression string, variables map[string]float64) (map[string]float64, []int, error) {
+	database := db.GetInstance()
+	bindings := make(map[string]float64)
+	var dependsOn []int
+	var saved map[string]float64
+
+	for _, name := range variableNames(expression) {
+		if _, ok := bindings[name.text]; ok {
+			continue
+		}
+
+		if isReference(name.text) {
+			id, result, err := resolveReference(userID, name)
+			if err != nil {
+				return nil, nil, err
+			}
+			bindings[name.text] = result
+			if !slices.Contains(dependsOn, id) {
+				dependsOn = append(dependsOn, id)
+			}
+			continue
+		}
+
+		if value, ok := variables[name.text]; ok {
+			bindings[name.text] = value
+			continue
+		}
+
+		// сохранённые переменные читаем, только если в запросе чего-то не хватило
+		if saved == nil {
+			userVariables, err := database.GetUserVariables(userID)
+			if err != nil {
+				return nil, nil, err
+			}
+			saved = make(map[string]float64, len(userVariables))
+			for _, v := range userVariables {
+				saved[v.Name] = v.Value
+			}
+		}
+		if value, ok := saved[name.text]; ok {
+			bindings[name.text] = value
+			continue
+		}
+
+		return nil, nil, &bindError{fmt.Sprintf("unknown variable %q at position %d", name.text, name.pos)}
+	}
+
+	return bindings, dependsOn, nil
+}
+
+// resolveReference возвращает выражение пользователя, на которое указывает $42 или $label, и его результат
+func resolveReference(userID int, ref token) (int, float64, error) {
+	database := db.GetInstance()
+	key := strings.TrimPrefix(ref.text, "$")
+
+	var id int
+	var status string
+	var result float64
+	var err error
+	if n, convErr := strconv.Atoi(key); convErr == nil {
+		id = n
+		_, status, result, err = database.GetExpression(id, userID)
+	} else {
+		id, status, result, err = database.FindExpressionByLabel(userID, key)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, &bindError{fmt.Sprintf("expression %s at position %d not found", ref.text, ref.pos)}
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if status != "completed" {
+		return 0, 0, &bindError{fmt.Sprintf("expression %s at position %d has no result yet (status %s)", ref.text, ref.pos, status)}
+	}
+	return id, result, nil
+}
+
+// validateLabel проверяет метку выражения: на неё ссылаются как на $label
+func validateLabel(label string) error {
+	if label != "" && !isIdentifier(label) {
+		return fmt.Errorf("invalid label %q", label)
+	}
+	return nil
+}
+
+// userVariable — сохранённая переменная пользователя, тело POST /api/v1/variables
+type userVariable struct {
+	Name      string    `json:"name"`
+	Value     *float64  `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func handleVariables(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		listUserVariables(w, userID)
+	case http.MethodPost:
+		saveUserVariable(w, r, userID)
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+	}
+}
+
+func saveUserVariable(w http.ResponseWriter, r *http.Request, userID int) {
+	var req userVariable
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Value == nil {
+		http.Error(w, "Value is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateVariables(map[string]float64{req.Name: *req.Value}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.UpdatedAt = time.Now()
+	database := db.GetInstance()
+	if err := database.SetUserVariable(userID, req.Name, *req.Value, req.UpdatedAt); err != nil {
+		log.Printf("Error saving variable %s of user %d: %v", req.Name, userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(req)
+}
+
+func listUserVariables(w http.ResponseWriter, userID int) {
+	database := db.GetInstance()
+	dbVariables, err := database.GetUserVariables(userID)
+	if err != nil {
+		log.Printf("Error receiving variables of user %d: %v", userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	variables := make([]userVariable, 0, len(dbVariables))
+	for _, v := range dbVariables {
+		value := v.Value
+		variables = append(variables, userVariable{Name: v.Name, Value: &value, UpdatedAt: v.UpdatedAt})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"variables": variables})
+}
+
+func handleVariableByName(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.URL.Path[len("/api/v1/variables/"):]
+
+	database := db.GetInstance()
+	ok, err := database.DeleteUserVariable(userID, name)
+	if err != nil {
+		log.Printf("Error deleting variable %s of user %d: %v", name, userID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Variable not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"name": name, "status": "deleted"})
+}
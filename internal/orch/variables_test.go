@@ -0,0 +1,119 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+func TestNamedResults(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("lineageuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	request := func(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	calculate := func(body string) (int, *httptest.ResponseRecorder) {
+		rr := request(handleCalculate, "POST", "/api/v1/calculate", body)
+		var created map[string]int
+		json.Unmarshal(rr.Body.Bytes(), &created)
+		return created["id"], rr
+	}
+	wait := func(id int) float64 {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			_, status, result, _ := database.GetExpression(id, userID)
+			if status == "completed" {
+				return result
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expression %d did not complete, status %s", id, status)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	if rr := request(handleVariables, "POST", "/api/v1/variables", `{"name": "rate", "value": 0.5}`); rr.Code != http.StatusOK {
+		t.Fatalf("Save variable returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := request(handleVariables, "POST", "/api/v1/variables", `{"name": "$rate", "value": 1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Invalid variable name: expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	baseID, rr := calculate(`{"expression": "rate * 20", "label": "base"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Calculate returned %d: %s", rr.Code, rr.Body.String())
+	}
+	// агентов ещё нет, поэтому у выражения нет результата
+	if _, rr := calculate(`{"expression": "$base + 1"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Reference to unfinished expression: expected %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	defer startFakeAgent()()
+
+	if result := wait(baseID); result != 10 {
+		t.Fatalf("Expected 10, got %f", result)
+	}
+
+	if _, rr := calculate(`{"expression": "2", "label": "base"}`); rr.Code != http.StatusConflict {
+		t.Errorf("Duplicate label: expected %d, got %d", http.StatusConflict, rr.Code)
+	}
+	// метку можно записать в выражении как $label, поэтому она подчиняется тем же правилам
+	if _, rr := calculate(`{"expression": "2", "label": "метка"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Non-ASCII label: expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if _, rr := calculate(`{"expression": "$missing + 1"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Unknown reference: expected %d, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+
+	// переменная запроса важнее сохранённой
+	body := `{"expression": "$base * rate + $` + strconv.Itoa(baseID) + `", "variables": {"rate": 2, "unused": 7}}`
+	totalID, rr := calculate(body)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Calculate returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if result := wait(totalID); result != 30 {
+		t.Errorf("Expected 30, got %f", result)
+	}
+
+	rr = request(handleExpressionByID, "GET", "/api/v1/expressions/"+strconv.Itoa(totalID), "")
+	var response struct {
+		Expression Expression `json:"expression"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	expected := map[string]float64{"$base": 10, "$" + strconv.Itoa(baseID): 10, "rate": 2}
+	if !maps.Equal(response.Expression.Variables, expected) {
+		t.Errorf("Unexpected variables: %v", response.Expression.Variables)
+	}
+	if !slices.Equal(response.Expression.DependsOn, []int{baseID}) {
+		t.Errorf("Expected dependency on %d, got %v", baseID, response.Expression.DependsOn)
+	}
+
+	rr = request(handleVariableByName, "DELETE", "/api/v1/variables/rate", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Delete variable returned %d", rr.Code)
+	}
+	if rr := request(handleVariableByName, "DELETE", "/api/v1/variables/rate", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Deleted variable: expected %d, got %d", http.StatusNotFound, rr.Code)
+	}
+	if _, rr := calculate(`{"expression": "rate * 2"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Deleted variable should not resolve, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,465 @@
+package orch
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+var (
+	errNoQuorum        = errors.New("replicas did not agree on the result")
+	errNotEnoughAgents = errors.New("not enough agents to reach a quorum")
+)
+
+func getMaxReplicas() int {
+	return pkg.GetEnvInt("MAX_REPLICAS", 5)
+}
+
+// quorumOf — сколько копий должны совпасть, чтобы результат был принят
+func quorumOf(replicas int) int {
+	return replicas/2 + 1
+}
+
+// ballot — ответ копии: значение или ошибка, с которой агент не смог её выполнить
+type ballot struct {
+	value float64
+	err   string
+}
+
+type vote struct {
+	agentID string
+	ballot  ballot
+}
+
+// voteGroup — копии одной операции, выданные разным агентам, и их результаты
+type voteGroup struct {
+	expressionID int
+	head         int
+	operation    string
+	started      time.Time
+	replicas     []int
+	agents       map[string]int // агент -> копия, которую ему выдали
+	votes        map[int]vote   // копия -> результат
+}
+
+// voteOutcome — что изменилось после очередного голоса
+type voteOutcome struct {
+	expressionID int
+	head         int
+	decided      bool // большинство только что сошлось на value
+	failed       bool // большинство сошлось на ошибке или уже не может сойтись
+	value        float64
+	err          error // ошибка, с которой завершается операция при failed
+	divergent    []string
+	unfinished   []int // копии, которые после решения уже не нужны
+}
+
+// voteRegistry хранит голосования по задачам, которые считаются несколькими агентами
+type voteRegistry struct {
+	mu     sync.Mutex
+	groups map[int]*voteGroup
+	heads  map[int]int
+}
+
+var votes = newVoteRegistry()
+
+func newVoteRegistry() *voteRegistry {
+	return &voteRegistry{
+		groups: make(map[int]*voteGroup),
+		heads:  make(map[int]int),
+	}
+}
+
+func (r *voteRegistry) track(expressionID, head int, operation string, replicas []int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.groups[head] = &voteGroup{
+		expressionID: expressionID,
+		head:         head,
+		operation:    operation,
+		started:      time.Now(),
+		replicas:     replicas,
+		agents:       make(map[string]int),
+		votes:        make(map[int]vote),
+	}
+	for _, id := range replicas {
+		r.heads[id] = head
+	}
+}
+
+// headOf возвращает головную задачу копии
+func (r *voteRegistry) headOf(taskID int) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	head, ok := r.heads[taskID]
+	return head, ok
+}
+
+// excludes сообщает, что агенту уже выдана другая копия той же операции
+func (r *voteRegistry) excludes(taskID int, agentID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	head, ok := r.heads[taskID]
+	if !ok {
+		return false
+	}
+	replica, took := r.groups[head].agents[agentID]
+	return took && replica != taskID
+}
+
+func (r *voteRegistry) leased(taskID int, agentID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if head, ok := r.heads[taskID]; ok {
+		r.groups[head].agents[agentID] = taskID
+	}
+}
+
+// record учитывает результат копии. Возвращает false, если голосование по ней уже не ведётся.
+func (r *voteRegistry) record(taskID int, agentID string, b ballot) (voteOutcome, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	head, ok := r.heads[taskID]
+	if !ok {
+		return voteOutcome{}, false
+	}
+	g := r.groups[head]
+	g.votes[taskID] = vote{agentID: agentID, ballot: b}
+
+	outcome := voteOutcome{expressionID: g.expressionID, head: head}
+	counts, best := g.tally()
+	quorum := quorumOf(len(g.replicas))
+	remaining := len(g.replicas) - len(g.votes)
+	if counts[b] >= quorum {
+		if b.err != "" {
+			// большинство копий не смогло выполнить операцию — это её результат
+			outcome.failed, outcome.err = true, errors.New(b.err)
+		} else {
+			outcome.decided, outcome.value = true, b.value
+		}
+		for _, v := range g.votes {
+			if v.ballot != b {
+				outcome.divergent = append(outcome.divergent, v.agentID)
+			}
+		}
+	} else if best+remaining < quorum {
+		outcome.failed, outcome.err = true, errNoQuorum
+	}
+
+	if outcome.decided || outcome.failed {
+		// после решения остальные копии не ждут: их убирает applyVote
+		outcome.unfinished = g.unfinished()
+		r.remove(g)
+	}
+	return outcome, true
+}
+
+// unreachable завершает голосования, которые ждут дольше before и уже не наберут кворум:
+// недостающие голоса некому отдать, потому что живых агентов, умеющих выполнять операцию
+// и ещё не бравших её копию, слишком мало. Пока живых зарегистрированных агентов нет, ничего не делает.
+func (r *voteRegistry) unreachable(before time.Time, capable func(operation string) (map[string]bool, bool)) []voteOutcome {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var outcomes []voteOutcome
+	for _, g := range r.groups {
+		if !g.started.Before(before) {
+			continue
+		}
+		live, registered := capable(g.operation)
+		if !registered {
+			continue
+		}
+
+		// копии, которые сейчас считают живые агенты
+		held := 0
+		for agentID, id := range g.agents {
+			if _, voted := g.votes[id]; !voted && live[agentID] {
+				held++
+			}
+		}
+		// агенты, которым ещё можно выдать копию
+		free := 0
+		for agentID := range live {
+			if _, took := g.agents[agentID]; !took {
+				free++
+			}
+		}
+
+		_, best := g.tally()
+		waiting := len(g.replicas) - len(g.votes) - held
+		if best+held+min(waiting, free) >= quorumOf(len(g.replicas)) {
+			continue
+		}
+
+		outcomes = append(outcomes, voteOutcome{
+			expressionID: g.expressionID,
+			head:         g.head,
+			failed:       true,
+			err:          errNotEnoughAgents,
+			unfinished:   g.unfinished(),
+		})
+		r.remove(g)
+	}
+	return outcomes
+}
+
+// tally считает голоса за каждый ответ и возвращает их вместе с числом голосов за самый частый
+func (g *voteGroup) tally() (map[ballot]int, int) {
+	counts := make(map[ballot]int)
+	best := 0
+	for _, v := range g.votes {
+		counts[v.ballot]++
+		best = max(best, counts[v.ballot])
+	}
+	return counts, best
+}
+
+// unfinished возвращает копии, результатов которых ещё нет
+func (g *voteGroup) unfinished() []int {
+	var ids []int
+	for _, id := range g.replicas {
+		if _, voted := g.votes[id]; !voted {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// release прекращает голосования выражения
+func (r *voteRegistry) release(expressionID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, g := range r.groups {
+		if g.expressionID == expressionID {
+			r.remove(g)
+		}
+	}
+}
+
+func (r *voteRegistry) remove(g *voteGroup) {
+	delete(r.groups, g.head)
+	for _, id := range g.replicas {
+		delete(r.heads, id)
+	}
+}
+
+// expressionOfTask возвращает выражение ожидаемой задачи или копии
+func expressionOfTask(taskID int) (int, bool) {
+	if head, ok := votes.headOf(taskID); ok {
+		taskID = head
+	}
+	return pendingTasks.expressionOf(taskID)
+}
+
+// addReplicatedTask отдаёт операцию replicas разным агентам и ждёт, пока большинство результатов совпадёт
+func addReplicatedTask(expressionID int, node int, op string, args []float64, replicas int) (float64, error) {
+	database := db.GetInstance()
+	head, ids, err := database.SaveReplicatedTask(expressionID, node, args, op, replicas)
+	if err != nil {
+		log.Printf("Error saving an task: %v", err)
+		return 0, err
+	}
+
+	ch, err := registerTask(head, expressionID)
+	if err != nil {
+		return 0, err
+	}
+	votes.track(expressionID, head, op, ids)
+
+	for _, id := range ids {
+		taskQueue.push(newTask(id, op, args))
+	}
+
+	outcome := <-ch
+	return outcome.value, outcome.err
+}
+
+// acceptVote сохраняет результат или ошибку копии и, если большинство сошлось, результат операции.
+// Возвращает false, если копия выдана не этому агенту.
+func acceptVote(result *pb.TaskResult) bool {
+	database := db.GetInstance()
+	var ok bool
+	var err error
+	if result.Error != "" {
+		ok, err = database.SubmitReplicaError(int(result.Id), result.AgentId, result.Error)
+	} else {
+		ok, err = database.SubmitReplicaResult(int(result.Id), result.AgentId, result.Result)
+	}
+	if err != nil {
+		log.Printf("Error saving the task result: %v", err)
+		return false
+	}
+	if !ok {
+		log.Printf("Rejected result of task %d from agent %q: task is not leased to it", result.Id, result.AgentId)
+		return false
+	}
+
+	if result.Error != "" {
+		log.Printf("Replica %d failed on agent %q: %s", result.Id, result.AgentId, result.Error)
+	}
+	if outcome, ok := votes.record(int(result.Id), result.AgentId, ballot{value: result.Result, err: result.Error}); ok {
+		applyVote(outcome)
+	}
+	return true
+}
+
+func applyVote(outcome voteOutcome) {
+	for _, agentID := range outcome.divergent {
+		log.Printf("Agent %q returned a result that differs from the majority for task %d", agentID, outcome.head)
+		agents.flagDivergent(agentID)
+	}
+
+	if len(outcome.unfinished) > 0 {
+		dropReplicas(outcome.head, outcome.unfinished)
+	}
+
+	switch {
+	case outcome.decided:
+		database := db.GetInstance()
+		if err := database.UpdateTaskResult(outcome.head, outcome.value); err != nil {
+			log.Printf("Error saving the task result: %v", err)
+		}
+		pendingTasks.resolve(outcome.head, taskOutcome{value: outcome.value})
+	case outcome.failed:
+		log.Printf("Replicas of task %d failed: %v", outcome.head, outcome.err)
+		failTask(outcome.head, outcome.expressionID, outcome.err)
+	}
+}
+
+// dropReplicas убирает копии, которые голосованию уже не нужны, из очереди и базы
+// и просит агентов, получивших их потоком, их бросить
+func dropReplicas(head int, ids []int) {
+	taskQueue.removeIf(func(task *pb.Task) bool {
+		return slices.Contains(ids, int(task.Id))
+	})
+	streamed.drop(ids)
+
+	database := db.GetInstance()
+	if _, err := database.DeleteUnprocessedReplicas(head); err != nil {
+		log.Printf("Error deleting replicas of task %d: %v", head, err)
+	}
+}
+
+// failUnreachableVotes завершает ошибкой операции, для кворума которых не хватает живых агентов
+func failUnreachableVotes(now time.Time) {
+	for _, outcome := range votes.unreachable(now.Add(-getDispatchTimeout()), agents.capable) {
+		applyVote(outcome)
+	}
+}
+
+// resumeReplicas восстанавливает голосование после перезапуска: учитывает уже присланные
+// результаты и возвращает в очередь копии, которые никому не выданы
+func resumeReplicas(expressionID, head int, op string, args []float64, replicas []struct {
+	ID        int
+	AgentID   string
+	Processed bool
+	Leased    bool
+	Result    float64
+	Error     string
+}) {
+	ids := make([]int, 0, len(replicas))
+	for _, r := range replicas {
+		ids = append(ids, r.ID)
+	}
+	votes.track(expressionID, head, op, ids)
+
+	for _, r := range replicas {
+		if r.Processed || r.Leased {
+			votes.leased(r.ID, r.AgentID)
+		}
+	}
+
+	for _, r := range replicas {
+		if r.Processed {
+			if outcome, ok := votes.record(r.ID, r.AgentID, ballot{value: r.Result, err: r.Error}); ok {
+				applyVote(outcome)
+			}
+		}
+	}
+
+	// если голосование уже решилось, оставшиеся копии удалены и в очередь не нужны
+	for _, r := range replicas {
+		if _, tracked := votes.headOf(r.ID); tracked && !r.Processed && !r.Leased {
+			taskQueue.push(newTask(r.ID, op, args))
+		}
+	}
+}
+
+// replicasFor возвращает число копий для выражения пользователя: заданное в запросе,
+// а без него — выбранное пользователем по умолчанию
+func replicasFor(userID, replicas int) (int, error) {
+	if replicas != 0 {
+		return replicas, nil
+	}
+
+	database := db.GetInstance()
+	replicas, err := database.GetUserReplicas(userID)
+	if err != nil {
+		log.Printf("Error receiving default replicas of user %d: %v", userID, err)
+		return 0, err
+	}
+	return replicas, nil
+}
+
+// handleDefaultReplicas показывает и меняет число копий, с которым считаются выражения
+// пользователя без поля replicas
+func handleDefaultReplicas(w http.ResponseWriter, r *http.Request) {
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	database := db.GetInstance()
+	var req struct {
+		Replicas int `json:"replicas"`
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		req.Replicas, err = database.GetUserReplicas(userID)
+		if err != nil {
+			log.Printf("Error receiving default replicas of user %d: %v", userID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := validateReplicas(req.Replicas); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := database.SetUserReplicas(userID, req.Replicas); err != nil {
+			log.Printf("Error saving default replicas of user %d: %v", userID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(req)
+}
@@ -0,0 +1,520 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	pb "github.com/Solmorn/Distributed-calculations/proto/generated/proto"
+)
+
+func TestVoteRegistry(t *testing.T) {
+	registry := newVoteRegistry()
+	registry.track(1, 10, "+", []int{11, 12, 13})
+
+	registry.leased(11, "a")
+	if !registry.excludes(12, "a") {
+		t.Error("Agent should not get a second replica of the same task")
+	}
+	if registry.excludes(11, "a") || registry.excludes(12, "b") {
+		t.Error("Agent should be able to take its own replica and other agents any replica")
+	}
+
+	if outcome, _ := registry.record(11, "a", ballot{value: 4}); outcome.decided || outcome.failed {
+		t.Fatalf("One vote of three should not decide: %+v", outcome)
+	}
+	if outcome, _ := registry.record(12, "b", ballot{value: 5}); outcome.decided || outcome.failed {
+		t.Fatalf("Split vote with one replica left should wait: %+v", outcome)
+	}
+
+	outcome, ok := registry.record(13, "c", ballot{value: 4})
+	if !ok || !outcome.decided || outcome.value != 4 || outcome.head != 10 {
+		t.Fatalf("Expected quorum on 4, got %+v", outcome)
+	}
+	if len(outcome.divergent) != 1 || outcome.divergent[0] != "b" {
+		t.Errorf("Expected agent b to diverge, got %v", outcome.divergent)
+	}
+
+	// все копии ответили — голосование закрыто
+	if _, ok := registry.headOf(11); ok {
+		t.Error("Finished vote should be forgotten")
+	}
+
+	registry.track(2, 20, "+", []int{21, 22, 23})
+	registry.record(21, "a", ballot{value: 1})
+	if outcome, _ := registry.record(22, "b", ballot{value: 2}); outcome.failed {
+		t.Errorf("Third replica can still break the tie: %+v", outcome)
+	}
+	if outcome, _ := registry.record(23, "c", ballot{value: 3}); !outcome.failed {
+		t.Errorf("Vote that can no longer reach a quorum should fail: %+v", outcome)
+	}
+
+	// ошибка — такой же голос: большинство ошибок завершает операцию с ней
+	registry.track(4, 40, "+", []int{41, 42, 43})
+	registry.record(41, "a", ballot{err: "division by zero"})
+	if outcome, _ := registry.record(42, "b", ballot{value: 1}); outcome.failed {
+		t.Errorf("One error of three should not fail the operation: %+v", outcome)
+	}
+	outcome, _ = registry.record(43, "c", ballot{err: "division by zero"})
+	if !outcome.failed || outcome.err == nil || outcome.err.Error() != "division by zero" {
+		t.Fatalf("Expected quorum on the error, got %+v", outcome)
+	}
+	if len(outcome.divergent) != 1 || outcome.divergent[0] != "b" {
+		t.Errorf("Expected agent b to diverge, got %v", outcome.divergent)
+	}
+
+	// ошибка одного агента при согласии остальных — расхождение
+	registry.track(5, 50, "+", []int{51, 52, 53})
+	registry.record(51, "a", ballot{err: "overflow"})
+	registry.record(52, "b", ballot{value: 7})
+	outcome, _ = registry.record(53, "c", ballot{value: 7})
+	if !outcome.decided || outcome.value != 7 {
+		t.Fatalf("Expected quorum on 7, got %+v", outcome)
+	}
+	if len(outcome.divergent) != 1 || outcome.divergent[0] != "a" {
+		t.Errorf("Expected agent a to diverge, got %v", outcome.divergent)
+	}
+
+	// кворум набран раньше, чем ответили все копии — остальные больше не нужны
+	registry.track(6, 60, "+", []int{61, 62, 63})
+	registry.record(61, "a", ballot{value: 2})
+	outcome, _ = registry.record(62, "b", ballot{value: 2})
+	if !outcome.decided || len(outcome.unfinished) != 1 || outcome.unfinished[0] != 63 {
+		t.Fatalf("Expected quorum on 2 with replica 63 left over, got %+v", outcome)
+	}
+	if _, ok := registry.record(63, "c", ballot{value: 2}); ok {
+		t.Error("Decided vote should not accept late replicas")
+	}
+
+	registry.track(3, 30, "+", []int{31, 32})
+	registry.release(3)
+	if _, ok := registry.record(31, "a", ballot{value: 1}); ok {
+		t.Error("Released vote should not accept results")
+	}
+}
+
+func TestValidateReplicas(t *testing.T) {
+	limit := getMaxReplicas()
+	tests := []struct {
+		replicas int
+		valid    bool
+	}{
+		{0, true}, // поле не задано — одна копия
+		{1, true},
+		{limit, true},
+		{limit + 1, false},
+		{-1, false},
+	}
+
+	for _, tt := range tests {
+		if err := validateReplicas(tt.replicas); (err == nil) != tt.valid {
+			t.Errorf("validateReplicas(%d) = %v, expected valid %v", tt.replicas, err, tt.valid)
+		}
+	}
+}
+
+func TestUnreachableQuorum(t *testing.T) {
+	registry := newVoteRegistry()
+	later := time.Now().Add(time.Hour)
+	capable := func(live ...string) func(string) (map[string]bool, bool) {
+		return func(string) (map[string]bool, bool) {
+			ids := make(map[string]bool)
+			for _, id := range live {
+				ids[id] = true
+			}
+			return ids, true
+		}
+	}
+
+	// пять копий требуют трёх разных агентов, а живых только два
+	registry.track(1, 10, "+", []int{11, 12, 13, 14, 15})
+	registry.leased(11, "a")
+	registry.record(11, "a", ballot{value: 1})
+	if outcomes := registry.unreachable(time.Now().Add(-time.Hour), capable("a", "b")); len(outcomes) != 0 {
+		t.Fatalf("Vote should get time to find agents, got %+v", outcomes)
+	}
+	if outcomes := registry.unreachable(later, capable("a", "b", "c")); len(outcomes) != 0 {
+		t.Fatalf("Three agents can still reach a quorum, got %+v", outcomes)
+	}
+
+	outcomes := registry.unreachable(later, capable("a", "b"))
+	if len(outcomes) != 1 || !outcomes[0].failed || outcomes[0].err != errNotEnoughAgents {
+		t.Fatalf("Expected the vote to fail for lack of agents, got %+v", outcomes)
+	}
+	if len(outcomes[0].unfinished) != 4 {
+		t.Errorf("Expected 4 unfinished replicas, got %v", outcomes[0].unfinished)
+	}
+	if _, ok := registry.headOf(12); ok {
+		t.Error("Failed vote should be forgotten")
+	}
+
+	// копия у живого агента ещё может прийти, у мёртвого — нет
+	registry.track(2, 20, "+", []int{21, 22, 23})
+	registry.leased(21, "a")
+	registry.leased(22, "b")
+	if outcomes := registry.unreachable(later, capable("a", "b")); len(outcomes) != 0 {
+		t.Fatalf("Replicas held by live agents can reach a quorum, got %+v", outcomes)
+	}
+	if outcomes := registry.unreachable(later, capable("a")); len(outcomes) != 1 {
+		t.Fatalf("Expected the vote to fail once agent b is gone, got %+v", outcomes)
+	}
+
+	// без живых зарегистрированных агентов подходящий ещё может подключиться
+	registry.track(3, 30, "+", []int{31, 32, 33})
+	none := func(string) (map[string]bool, bool) { return nil, false }
+	if outcomes := registry.unreachable(later, none); len(outcomes) != 0 {
+		t.Errorf("Vote should wait while no agents are registered, got %+v", outcomes)
+	}
+}
+
+func TestReplicatedExpression(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("replicauser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	server := &TaskServer{}
+	for _, id := range []string{"honest-1", "honest-2", "liar"} {
+		server.RegisterAgent(context.Background(), &pb.AgentInfo{AgentId: id, Hostname: "host", Workers: 1})
+	}
+
+	calculate := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		handleCalculate(rr, req)
+		return rr
+	}
+
+	if rr := calculate(`{"expression": "2*3", "replicas": 100}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Too many replicas returned %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr := calculate(`{"expression": "2*3", "replicas": 3}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Calculate returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var created map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	expressionID := created["id"]
+
+	// getTask выдаёт агенту копию операции выражения, задачи других тестов досчитывает
+	getTask := func(agentID string, wait time.Duration) *pb.Task {
+		t.Helper()
+		deadline := time.Now().Add(wait)
+		for time.Now().Before(deadline) {
+			task, _ := server.GetTask(context.Background(), &pb.TaskRequest{AgentId: agentID})
+			if !task.HasTask {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			if owner, ok := expressionOfTask(int(task.Id)); ok && owner == expressionID {
+				return task
+			}
+			server.SendTaskResult(context.Background(), &pb.TaskResult{Id: task.Id, Result: fakeCompute(task), AgentId: agentID})
+		}
+		return nil
+	}
+
+	first := getTask("honest-1", 2*time.Second)
+	if first == nil {
+		t.Fatal("No replica for honest-1")
+	}
+	if again := getTask("honest-1", 100*time.Millisecond); again != nil {
+		t.Fatalf("Agent got a second replica %d of the same operation", again.Id)
+	}
+
+	second := getTask("honest-2", 2*time.Second)
+	liar := getTask("liar", 2*time.Second)
+	if second == nil || liar == nil {
+		t.Fatal("Expected a replica for each agent")
+	}
+
+	// чужой результат для копии не принимается
+	resp, _ := server.SendTaskResult(context.Background(), &pb.TaskResult{Id: second.Id, Result: 6, AgentId: "liar"})
+	if resp.Success {
+		t.Error("Result from an agent the replica is not leased to should be rejected")
+	}
+
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: liar.Id, Result: 7, AgentId: "liar"})
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: first.Id, Result: 6, AgentId: "honest-1"})
+
+	// одного честного результата мало для кворума
+	time.Sleep(20 * time.Millisecond)
+	if _, status, _, _ := database.GetExpression(expressionID, userID); status != "processing" {
+		t.Fatalf("Expression finished before quorum, status %s", status)
+	}
+
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: second.Id, Result: 6, AgentId: "honest-2"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, status, result, _ := database.GetExpression(expressionID, userID)
+		if status == "completed" {
+			if result != 6 {
+				t.Errorf("Expected majority result 6, got %v", result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expression did not complete, status %s", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, agent := range agents.list() {
+		switch agent.ID {
+		case "liar":
+			if agent.DivergentResults != 1 {
+				t.Errorf("Expected liar to be flagged once, got %d", agent.DivergentResults)
+			}
+		case "honest-1", "honest-2":
+			if agent.DivergentResults != 0 {
+				t.Errorf("Honest agent %s should not be flagged", agent.ID)
+			}
+		}
+	}
+}
+
+func TestResumeReplicas(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("replicaresume", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	expressionID, err := database.CreateExpression(userID, db.NewExpression{Expression: "2+3", Replicas: 3}, "", "", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+
+	// до перезапуска: первая копия посчитана, вторая у агента, третья никому не выдана
+	head, ids, err := database.SaveReplicatedTask(expressionID, 0, []float64{2, 3}, "+", 3)
+	if err != nil {
+		t.Fatalf("Failed to save replicated task: %v", err)
+	}
+	database.LeaseTask(ids[0], "a", time.Now().Add(time.Minute))
+	database.SubmitReplicaResult(ids[0], "a", 5)
+	database.LeaseTask(ids[1], "b", time.Now().Add(time.Minute))
+
+	if tasks, _ := database.GetExpressionTasks(expressionID); len(tasks) != 1 || tasks[0].ID != head {
+		t.Fatalf("Only the head task should describe the graph node, got %+v", tasks)
+	}
+
+	done := make(chan taskOutcome, 1)
+	go func() {
+		value, err := resumeTask(expressionID, head, "+", []float64{2, 3})
+		done <- taskOutcome{value: value, err: err}
+	}()
+
+	task := queuedTask(2 * time.Second)
+	if task == nil {
+		t.Fatal("Unassigned replica was not requeued")
+	}
+	if int(task.Id) != ids[2] {
+		t.Fatalf("Expected replica %d to be requeued, got %d", ids[2], task.Id)
+	}
+	if !votes.excludes(ids[2], "a") {
+		t.Error("Agent that answered before the restart should not get another replica")
+	}
+
+	if !leaseTask(task, "c") {
+		t.Fatal("Failed to lease replica")
+	}
+	server := &TaskServer{}
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: task.Id, Result: 5, AgentId: "c"})
+
+	select {
+	case outcome := <-done:
+		if outcome.err != nil || outcome.value != 5 {
+			t.Errorf("Expected 5, got %v (%v)", outcome.value, outcome.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Vote restored after restart did not finish")
+	}
+
+	if result, processed, _, _ := database.GetTaskState(head); !processed || result != 5 {
+		t.Errorf("Head task should store the accepted result, got %v (%v)", result, processed)
+	}
+	votes.release(expressionID)
+	database.FinishExpression(expressionID, "completed", 5)
+}
+
+func TestReplicaErrorVote(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("replicaerror", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	expressionID, err := database.CreateExpression(userID, db.NewExpression{Expression: "1/0", Replicas: 3}, "", "", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+	defer func() {
+		votes.release(expressionID)
+		pendingTasks.release(expressionID, errExpressionFinished)
+		database.FinishExpression(expressionID, "error", 0)
+	}()
+
+	head, ids, err := database.SaveReplicatedTask(expressionID, 0, []float64{1, 0}, "/", 3)
+	if err != nil {
+		t.Fatalf("Failed to save replicated task: %v", err)
+	}
+	waiting := pendingTasks.register(head, expressionID)
+	votes.track(expressionID, head, "/", ids)
+	for i, agentID := range []string{"a", "b", "c"} {
+		database.LeaseTask(ids[i], agentID, time.Now().Add(time.Minute))
+		votes.leased(ids[i], agentID)
+	}
+
+	server := &TaskServer{}
+	if resp, _ := server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(ids[0]), Error: "division by zero", AgentId: "b"}); resp.Success {
+		t.Error("Error from an agent the replica is not leased to should be rejected")
+	}
+
+	// одна ошибка — только голос, операция ещё не завершена
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(ids[0]), Error: "division by zero", AgentId: "a"})
+	select {
+	case outcome := <-waiting:
+		t.Fatalf("Single replica error finished the operation: %v", outcome.err)
+	default:
+	}
+
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(ids[1]), Error: "division by zero", AgentId: "b"})
+	select {
+	case outcome := <-waiting:
+		if outcome.err == nil || outcome.err.Error() != "division by zero" {
+			t.Errorf("Expected the error of the majority, got %v", outcome.err)
+		}
+	default:
+		t.Fatal("Majority of errors did not finish the operation")
+	}
+
+	// третья копия после решения не нужна и удаляется
+	replicas, _ := database.GetTaskReplicas(head)
+	if len(replicas) != 2 || !replicas[0].Processed || replicas[0].Error != "division by zero" {
+		t.Errorf("Replica errors should be stored and the leftover replica deleted, got %+v", replicas)
+	}
+	if _, ok := votes.headOf(ids[2]); ok {
+		t.Error("Leftover replica should no longer be voted on")
+	}
+}
+
+func TestForgedHeadResult(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("replicaforger", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	expressionID, err := database.CreateExpression(userID, db.NewExpression{Expression: "2+3", Replicas: 3}, "", "", time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+	defer func() {
+		votes.release(expressionID)
+		pendingTasks.release(expressionID, errExpressionFinished)
+		database.FinishExpression(expressionID, "completed", 5)
+	}()
+
+	head, ids, err := database.SaveReplicatedTask(expressionID, 0, []float64{2, 3}, "+", 3)
+	if err != nil {
+		t.Fatalf("Failed to save replicated task: %v", err)
+	}
+	waiting := pendingTasks.register(head, expressionID)
+	votes.track(expressionID, head, "+", ids)
+	for i, agentID := range []string{"a", "b", "c"} {
+		database.LeaseTask(ids[i], agentID, time.Now().Add(time.Minute))
+		votes.leased(ids[i], agentID)
+	}
+
+	// результат головной задачи определяет только голосование копий
+	server := &TaskServer{}
+	if resp, _ := server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(head), Result: 999, AgentId: "a"}); resp.Success {
+		t.Error("Result sent for the head task should be rejected")
+	}
+	if resp, _ := server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(head), Error: "forged", AgentId: "a"}); resp.Success {
+		t.Error("Error sent for the head task should be rejected")
+	}
+	select {
+	case outcome := <-waiting:
+		t.Fatalf("Forged head result finished the operation: (%f, %v)", outcome.value, outcome.err)
+	default:
+	}
+	if _, processed, _ := database.GetTaskResult(head); processed {
+		t.Fatal("Forged head result was saved")
+	}
+
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(ids[0]), Result: 5, AgentId: "a"})
+	server.SendTaskResult(context.Background(), &pb.TaskResult{Id: int32(ids[1]), Result: 5, AgentId: "b"})
+	select {
+	case outcome := <-waiting:
+		if outcome.err != nil || outcome.value != 5 {
+			t.Errorf("Expected the majority result 5, got (%f, %v)", outcome.value, outcome.err)
+		}
+	default:
+		t.Fatal("Majority of replicas did not finish the operation")
+	}
+}
+
+func TestDefaultReplicas(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("replicadefault", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	request := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/replicas", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+		rr := httptest.NewRecorder()
+		handleDefaultReplicas(rr, req)
+		return rr
+	}
+
+	if rr := request("PUT", `{"replicas": 100}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Too many replicas: expected %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if rr := request("PUT", `{"replicas": 3}`); rr.Code != http.StatusOK {
+		t.Fatalf("Setting default replicas returned %d: %s", rr.Code, rr.Body.String())
+	}
+	var got map[string]int
+	json.Unmarshal(request("GET", "").Body.Bytes(), &got)
+	if got["replicas"] != 3 {
+		t.Errorf("Expected default of 3 replicas, got %v", got)
+	}
+
+	// без поля replicas действует значение пользователя, заданное поле важнее
+	implicit, err := submitExpression(userID, calculateRequest{Expr: "1+2"})
+	if err != nil {
+		t.Fatalf("Failed to submit expression: %v", err)
+	}
+	explicit, err := submitExpression(userID, calculateRequest{Expr: "1+2", Replicas: 1})
+	if err != nil {
+		t.Fatalf("Failed to submit expression: %v", err)
+	}
+	defer func() {
+		for _, id := range []int{implicit, explicit} {
+			votes.release(id)
+			pendingTasks.release(id, errExpressionFinished)
+			database.FinishExpression(id, "cancelled", 0)
+		}
+	}()
+
+	expressions, _ := database.GetProcessingExpressions()
+	replicas := make(map[int]int)
+	for _, exp := range expressions {
+		replicas[exp.ID] = exp.Replicas
+	}
+	if replicas[implicit] != 3 || replicas[explicit] != 1 {
+		t.Errorf("Expected 3 replicas by default and 1 when set, got %d and %d", replicas[implicit], replicas[explicit])
+	}
+}
@@ -0,0 +1,291 @@
+package orch
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"github.com/Solmorn/Distributed-calculations/pkg"
+)
+
+// webhookPayload — тело уведомления об итоге выражения
+type webhookPayload struct {
+	ID         int     `json:"id"`
+	Expression string  `json:"expression"`
+	Status     string  `json:"status"`
+	Result     float64 `json:"result"`
+}
+
+// сигнал диспетчеру, что появились уведомления для немедленной отправки
+var webhookKick = make(chan struct{}, 1)
+
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute http(s) URL")
+	}
+
+	// имя хоста проверяется при отправке, когда известен его адрес
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return checkWebhookAddress(ip)
+	}
+	return nil
+}
+
+// getAllowedNetworks — внутренние сети, в которые всё же можно отправлять уведомления
+func getAllowedNetworks() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(pkg.GetEnvString("WEBHOOK_ALLOWED_NETWORKS", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// одиночный адрес — сеть из одного адреса
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid network %q in WEBHOOK_ALLOWED_NETWORKS", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// checkWebhookAddress не пускает уведомления во внутренние сети оркестратора: loopback,
+// частные и link-local адреса, в том числе адрес метаданных облака 169.254.169.254
+func checkWebhookAddress(ip net.IP) error {
+	for _, network := range getAllowedNetworks() {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("address %s is not allowed", ip)
+	}
+	return nil
+}
+
+// webhookTransport проверяет адрес при каждом соединении: имя хоста могло указывать
+// на внутренний адрес или смениться после проверки callback_url, а перенаправление — вести внутрь
+var webhookTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("address %s is not allowed", host)
+			}
+			return checkWebhookAddress(ip)
+		},
+	}).DialContext,
+	IdleConnTimeout: 90 * time.Second,
+}
+
+// scheduleWebhooks ставит в очередь уведомления завершившегося выражения
+func scheduleWebhooks(expressionID int) {
+	database := db.GetInstance()
+	n, err := database.ActivateWebhooks(expressionID, time.Now())
+	if err != nil {
+		log.Printf("Error scheduling webhooks of expression %d: %v", expressionID, err)
+		return
+	}
+
+	if n > 0 {
+		select {
+		case webhookKick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// recoverWebhooks ставит в очередь уведомления выражений, завершившихся перед остановкой:
+// итог и активация уведомлений сохраняются по отдельности
+func recoverWebhooks() {
+	database := db.GetInstance()
+	n, err := database.ActivateFinishedWebhooks(time.Now())
+	if err != nil {
+		log.Printf("Error scheduling webhooks of finished expressions: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Scheduled %d webhooks of expressions finished before restart", n)
+	}
+}
+
+// runWebhookDispatcher отправляет уведомления сразу после завершения выражений
+// и повторяет неудачные попытки по расписанию из базы
+func runWebhookDispatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-webhookKick:
+		}
+		deliverDueWebhooks(time.Now())
+	}
+}
+
+func deliverDueWebhooks(now time.Time) {
+	database := db.GetInstance()
+	due, err := database.GetDueWebhooks(now, 100)
+	if err != nil {
+		log.Printf("Error receiving webhooks: %v", err)
+		return
+	}
+
+	maxAttempts := pkg.GetEnvInt("WEBHOOK_MAX_ATTEMPTS", 5)
+	backoff := time.Duration(pkg.GetEnvInt("WEBHOOK_BACKOFF_MS", 1000)) * time.Millisecond
+	client := &http.Client{
+		Transport: webhookTransport,
+		Timeout:   time.Duration(pkg.GetEnvInt("WEBHOOK_TIMEOUT_MS", 5000)) * time.Millisecond,
+	}
+
+	for _, w := range due {
+		attempts := w.Attempts + 1
+		body, err := json.Marshal(webhookPayload{
+			ID:         w.ExpressionID,
+			Expression: w.Expression,
+			Status:     w.Status,
+			Result:     w.Result,
+		})
+		if err != nil {
+			// повтор не поможет: итог выражения не записать в JSON
+			log.Printf("Error encoding webhook %d for expression %d: %v", w.ID, w.ExpressionID, err)
+			recordWebhookAttempt(w.ID, "failed", attempts, now, err.Error())
+			continue
+		}
+
+		err = postWebhook(client, w.URL, w.Secret, body, attempts)
+		if err == nil {
+			recordWebhookAttempt(w.ID, "delivered", attempts, now, "")
+			continue
+		}
+
+		if attempts >= maxAttempts {
+			log.Printf("Webhook %d for expression %d failed after %d attempts: %v", w.ID, w.ExpressionID, attempts, err)
+			recordWebhookAttempt(w.ID, "failed", attempts, now, err.Error())
+			continue
+		}
+
+		// экспоненциальная задержка: backoff, 2*backoff, 4*backoff...
+		next := now.Add(backoff << (attempts - 1))
+		log.Printf("Webhook %d for expression %d failed (attempt %d), retrying at %s: %v", w.ID, w.ExpressionID, attempts, next.Format(time.RFC3339), err)
+		recordWebhookAttempt(w.ID, "pending", attempts, next, err.Error())
+	}
+}
+
+// recordWebhookAttempt сохраняет итог попытки. Если сохранить не удалось,
+// уведомление отправится ещё раз: получатель может увидеть его повторно.
+func recordWebhookAttempt(id int, status string, attempts int, nextAttempt time.Time, lastError string) {
+	database := db.GetInstance()
+	if err := database.RecordWebhookAttempt(id, status, attempts, nextAttempt, lastError); err != nil {
+		log.Printf("Error saving attempt %d of webhook %d: %v", attempts, id, err)
+	}
+}
+
+func postWebhook(client *http.Client, target, secret string, body []byte, attempt int) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Signature", "sha256="+signPayload(secret, body))
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(attempt))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signPayload — HMAC-SHA256 тела уведомления на секрете пользователя
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSecret возвращает секрет пользователя, создавая его при первом обращении
+func webhookSecret(userID int) (string, error) {
+	database := db.GetInstance()
+	secret, err := database.GetWebhookSecret(userID)
+	if err != nil || secret != "" {
+		return secret, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	// при одновременном первом обращении сохраняется один секрет, и его получают все
+	return database.SetWebhookSecret(userID, hex.EncodeToString(raw))
+}
+
+func handleWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := auth.GetUserIDFromContext(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := webhookSecret(userID)
+	if err != nil {
+		log.Printf("Error getting webhook secret: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret})
+}
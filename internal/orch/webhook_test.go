@@ -0,0 +1,289 @@
+package orch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+)
+
+type webhookRecorder struct {
+	mu         sync.Mutex
+	bodies     [][]byte
+	signatures []string
+	statuses   []int
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	rec.bodies = append(rec.bodies, body)
+	rec.signatures = append(rec.signatures, r.Header.Get("X-Webhook-Signature"))
+
+	status := http.StatusOK
+	if len(rec.statuses) >= len(rec.bodies) {
+		status = rec.statuses[len(rec.bodies)-1]
+	}
+	w.WriteHeader(status)
+}
+
+func (rec *webhookRecorder) calls() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.bodies)
+}
+
+// calculateWithCallback отправляет выражение с callback_url и ждёт его завершения
+func calculateWithCallback(t *testing.T, userID int, expression, callbackURL string) int {
+	t.Helper()
+
+	// тестовый получатель слушает на loopback
+	t.Setenv("WEBHOOK_ALLOWED_NETWORKS", "127.0.0.1")
+
+	body, _ := json.Marshal(calculateRequest{Expr: expression, CallbackURL: callbackURL})
+	req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBuffer(body))
+	req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), userID))
+	rr := httptest.NewRecorder()
+	handleCalculate(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Calculate returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var created map[string]int
+	json.Unmarshal(rr.Body.Bytes(), &created)
+
+	defer startFakeAgent()()
+
+	// статус сохраняется раньше, чем уведомления встают в очередь, поэтому ждём и их
+	database := db.GetInstance()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, status, _, _ := database.GetExpression(created["id"], userID)
+		webhooks, _ := database.GetWebhooks(created["id"])
+		if isFinished(status) && len(webhooks) > 0 && webhooks[0].Status != "waiting" {
+			return created["id"]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expression %d did not finish", created["id"])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookDeliveryWithRetry(t *testing.T) {
+	t.Setenv("WEBHOOK_BACKOFF_MS", "1000")
+
+	database := db.GetInstance()
+	userID, err := database.CreateUser("webhookuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	recorder := &webhookRecorder{statuses: []int{http.StatusInternalServerError, http.StatusOK}}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	expressionID := calculateWithCallback(t, userID, "2*5", server.URL+"/hook")
+
+	now := time.Now()
+	deliverDueWebhooks(now)
+	if recorder.calls() != 1 {
+		t.Fatalf("Expected 1 delivery attempt, got %d", recorder.calls())
+	}
+
+	webhooks, _ := database.GetWebhooks(expressionID)
+	if len(webhooks) != 1 || webhooks[0].Status != "pending" || webhooks[0].Attempts != 1 || webhooks[0].LastError == "" {
+		t.Fatalf("Expected a pending webhook after the failed attempt, got %+v", webhooks)
+	}
+
+	// повтор ещё не наступил
+	deliverDueWebhooks(now.Add(500 * time.Millisecond))
+	if recorder.calls() != 1 {
+		t.Fatalf("Retry should wait for the backoff, got %d attempts", recorder.calls())
+	}
+
+	deliverDueWebhooks(now.Add(1500 * time.Millisecond))
+	if recorder.calls() != 2 {
+		t.Fatalf("Expected 2 delivery attempts, got %d", recorder.calls())
+	}
+
+	webhooks, _ = database.GetWebhooks(expressionID)
+	if webhooks[0].Status != "delivered" || webhooks[0].Attempts != 2 {
+		t.Errorf("Expected delivered webhook after 2 attempts, got %+v", webhooks[0])
+	}
+
+	secretReq := httptest.NewRequest("GET", "/api/v1/webhook-secret", nil)
+	secretReq = secretReq.WithContext(context.WithValue(secretReq.Context(), auth.GetUserIDContextKey(), userID))
+	rr := httptest.NewRecorder()
+	handleWebhookSecret(rr, secretReq)
+
+	var secret map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &secret)
+
+	body := recorder.bodies[1]
+	if recorder.signatures[1] != "sha256="+signPayload(secret["secret"], body) {
+		t.Errorf("Signature mismatch for body %s", body)
+	}
+
+	var payload webhookPayload
+	json.Unmarshal(body, &payload)
+	if payload.ID != expressionID || payload.Status != "completed" || payload.Result != 10 || payload.Expression != "2*5" {
+		t.Errorf("Unexpected payload %+v", payload)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	t.Setenv("WEBHOOK_BACKOFF_MS", "100")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "3")
+
+	database := db.GetInstance()
+	userID, _ := database.CreateUser("webhookfail", "password")
+
+	recorder := &webhookRecorder{statuses: []int{500, 500, 500, 500}}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	expressionID := calculateWithCallback(t, userID, "1/0", server.URL)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		deliverDueWebhooks(now)
+		now = now.Add(time.Second)
+	}
+
+	if recorder.calls() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", recorder.calls())
+	}
+
+	var payload webhookPayload
+	json.Unmarshal(recorder.bodies[0], &payload)
+	if payload.Status != "error" {
+		t.Errorf("Expected error status in payload, got %s", payload.Status)
+	}
+
+	webhooks, _ := database.GetWebhooks(expressionID)
+	if webhooks[0].Status != "failed" || webhooks[0].Attempts != 3 {
+		t.Errorf("Expected failed webhook after 3 attempts, got %+v", webhooks[0])
+	}
+}
+
+func TestCalculateRejectsInvalidCallback(t *testing.T) {
+	for _, callback := range []string{"ftp://example.com", "http://169.254.169.254/latest/meta-data"} {
+		body := `{"expression": "1+1", "callback_url": "` + callback + `"}`
+		req := httptest.NewRequest("POST", "/api/v1/calculate", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), auth.GetUserIDContextKey(), 1))
+		rr := httptest.NewRecorder()
+		handleCalculate(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", callback, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestCallbackAddresses(t *testing.T) {
+	internal := []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+		"https://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+	}
+	for _, callback := range internal {
+		if err := validateCallbackURL(callback); err == nil {
+			t.Errorf("%s: internal address should be rejected", callback)
+		}
+	}
+	for _, callback := range []string{"https://example.com/hook", "http://8.8.8.8/hook"} {
+		if err := validateCallbackURL(callback); err != nil {
+			t.Errorf("%s: unexpected error: %v", callback, err)
+		}
+	}
+
+	// имя хоста проверяется при соединении
+	server := httptest.NewServer(&webhookRecorder{})
+	defer server.Close()
+	client := &http.Client{Transport: webhookTransport, Timeout: time.Second}
+	if err := postWebhook(client, server.URL, "secret", []byte("{}"), 1); err == nil {
+		t.Error("Delivery to loopback should be refused")
+	}
+
+	t.Setenv("WEBHOOK_ALLOWED_NETWORKS", "127.0.0.0/8, ::1")
+	for _, callback := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook"} {
+		if err := validateCallbackURL(callback); err != nil {
+			t.Errorf("%s: allowed network should be accepted, got %v", callback, err)
+		}
+	}
+	if err := validateCallbackURL("http://10.0.0.5/hook"); err == nil {
+		t.Error("Network outside the allowed list should still be rejected")
+	}
+	if err := postWebhook(client, server.URL, "secret", []byte("{}"), 1); err != nil {
+		t.Errorf("Delivery to an allowed network failed: %v", err)
+	}
+}
+
+func TestWebhookSecretConcurrentCreation(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("secretuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	secrets := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range secrets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			secrets[i], _ = webhookSecret(userID)
+		}(i)
+	}
+	wg.Wait()
+
+	stored, err := database.GetWebhookSecret(userID)
+	if err != nil || stored == "" {
+		t.Fatalf("Secret was not saved: %v", err)
+	}
+	for i, secret := range secrets {
+		if secret != stored {
+			t.Errorf("Call %d got %q, but %q is stored", i, secret, stored)
+		}
+	}
+}
+
+func TestRecoverWebhooks(t *testing.T) {
+	database := db.GetInstance()
+	userID, _ := database.CreateUser("webhookrecover", "password")
+
+	finished, _ := database.CreateExpression(userID, db.NewExpression{Expression: "1+1", CallbackURL: "https://example.com/hook"}, "", "", time.Now())
+	cancelled, _ := database.CreateExpression(userID, db.NewExpression{Expression: "2+2", CallbackURL: "https://example.com/hook"}, "", "", time.Now())
+
+	// оркестратор остановился между сохранением итога и активацией уведомлений
+	database.FinishExpression(finished, "completed", 2)
+	database.FinishExpression(cancelled, "cancelled", 0)
+
+	recoverWebhooks()
+
+	webhooks, _ := database.GetWebhooks(finished)
+	if len(webhooks) != 1 || webhooks[0].Status != "pending" {
+		t.Fatalf("Webhook of a finished expression should be scheduled, got %+v", webhooks)
+	}
+	// чтобы другие тесты не пытались его доставить
+	defer database.RecordWebhookAttempt(webhooks[0].ID, "failed", 0, time.Now(), "")
+
+	if webhooks, _ := database.GetWebhooks(cancelled); len(webhooks) != 1 || webhooks[0].Status != "waiting" {
+		t.Errorf("Webhook of a cancelled expression should not be scheduled, got %+v", webhooks)
+	}
+}
@@ -0,0 +1,136 @@
+package orch
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"golang.org/x/net/websocket"
+)
+
+// wsMessage — сообщение WebSocket API в обе стороны.
+// Клиент отправляет "calculate" (новое выражение) или "watch" (следить за существующим),
+// сервер отвечает "accepted", итоговым "completed"/"error"/"cancelled" или "failed" при ошибке запроса.
+type wsMessage struct {
+	Type       string             `json:"type"`
+	Ref        string             `json:"ref,omitempty"`
+	ID         int                `json:"id,omitempty"`
+	Expression string             `json:"expression,omitempty"`
+	Replicas   int                `json:"replicas,omitempty"`
+	Variables  map[string]float64 `json:"variables,omitempty"`
+	Label      string             `json:"label,omitempty"`
+	Status     string             `json:"status,omitempty"`
+	Result     float64            `json:"result"`
+	Error      string             `json:"error,omitempty"`
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	tokenString, err := auth.ExtractTokenFromRequest(r)
+	if err != nil {
+		tokenString = r.URL.Query().Get("token")
+	}
+
+	if tokenString == "" {
+		http.Error(w, "Unauthorized: token is required", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := auth.ValidateToken(tokenString)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// websocket.Server без Handshake не проверяет Origin: доступ уже ограничен токеном
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		serveWebSocket(ws, userID)
+	}}.ServeHTTP(w, r)
+}
+
+func serveWebSocket(ws *websocket.Conn, userID int) {
+	defer ws.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// писать в соединение может только одна горутина
+	out := make(chan wsMessage, 16)
+	go func() {
+		for {
+			select {
+			case msg := <-out:
+				if err := websocket.JSON.Send(ws, msg); err != nil {
+					log.Printf("Error writing to websocket of user %d: %v", userID, err)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	send := func(msg wsMessage) {
+		select {
+		case out <- msg:
+		case <-ctx.Done():
+		}
+	}
+
+	for {
+		var msg wsMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "calculate":
+			req := calculateRequest{
+				Expr:      msg.Expression,
+				Replicas:  msg.Replicas,
+				Variables: msg.Variables,
+				Label:     msg.Label,
+			}
+			if err := validateCalculateRequest(req); err != nil {
+				send(wsMessage{Type: "failed", Ref: msg.Ref, Error: err.Error()})
+				continue
+			}
+
+			id, err := submitExpression(userID, req)
+			var unbound *bindError
+			if errors.As(err, &unbound) || errors.Is(err, errLabelTaken) {
+				send(wsMessage{Type: "failed", Ref: msg.Ref, Error: err.Error()})
+				continue
+			}
+			if err != nil {
+				send(wsMessage{Type: "failed", Ref: msg.Ref, Error: "internal server error"})
+				continue
+			}
+
+			send(wsMessage{Type: "accepted", Ref: msg.Ref, ID: id})
+			go watchExpression(ctx, id, userID, msg.Ref, send)
+
+		case "watch":
+			go watchExpression(ctx, msg.ID, userID, msg.Ref, send)
+
+		default:
+			send(wsMessage{Type: "failed", Ref: msg.Ref, Error: "unknown message type " + msg.Type})
+		}
+	}
+}
+
+// watchExpression отправляет клиенту итог выражения, когда он появится
+func watchExpression(ctx context.Context, id int, userID int, ref string, send func(wsMessage)) {
+	status, result, err := awaitExpression(ctx, id, userID)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		send(wsMessage{Type: "failed", Ref: ref, ID: id, Error: "expression not found"})
+		return
+	}
+
+	send(wsMessage{Type: status, Ref: ref, ID: id, Status: status, Result: result})
+}
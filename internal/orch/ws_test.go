@@ -0,0 +1,90 @@
+package orch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Solmorn/Distributed-calculations/internal/auth"
+	"github.com/Solmorn/Distributed-calculations/internal/db"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketCalculate(t *testing.T) {
+	database := db.GetInstance()
+	userID, err := database.CreateUser("wsuser", "password")
+	if err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	token, err := auth.GenerateToken(userID)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/ws?token=" + token
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer ws.Close()
+
+	defer startFakeAgent()()
+
+	requests := map[string]string{"a": "(1+2)*4", "b": "10/4", "c": "7"}
+	for ref, expression := range requests {
+		if err := websocket.JSON.Send(ws, wsMessage{Type: "calculate", Ref: ref, Expression: expression}); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+	}
+	websocket.JSON.Send(ws, wsMessage{Type: "calculate", Ref: "d"})
+
+	expected := map[string]float64{"a": 12, "b": 2.5, "c": 7}
+	accepted := make(map[string]int)
+	results := make(map[string]float64)
+
+	ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for len(results) < len(expected) || len(accepted) < len(expected) {
+		var msg wsMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("Failed to receive: %v (accepted %v, results %v)", err, accepted, results)
+		}
+
+		switch msg.Type {
+		case "accepted":
+			accepted[msg.Ref] = msg.ID
+		case "completed":
+			results[msg.Ref] = msg.Result
+			if accepted[msg.Ref] != msg.ID {
+				t.Errorf("Result for %s has id %d, accepted as %d", msg.Ref, msg.ID, accepted[msg.Ref])
+			}
+		case "failed":
+			if msg.Ref != "d" {
+				t.Errorf("Unexpected failure for %s: %s", msg.Ref, msg.Error)
+			}
+		default:
+			t.Errorf("Unexpected message %+v", msg)
+		}
+	}
+
+	for ref, want := range expected {
+		if results[ref] != want {
+			t.Errorf("Result for %s: expected %f, got %f", ref, want, results[ref])
+		}
+	}
+}
+
+func TestWebSocketRequiresToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/ws?token=invalid"
+	if _, err := websocket.Dial(url, "", server.URL); err == nil {
+		t.Error("Expected handshake to fail with an invalid token")
+	}
+}
@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// файлы в PEM
+	certFile string
+	keyFile  string
+}
+
+// newTestCert выпускает сертификат, подписанный parent; без parent — самоподписанный CA
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	os.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return tc
+}
+
+// handshake соединяет клиента и сервер через net.Pipe и возвращает ошибки рукопожатия обеих сторон
+func handshake(server, client *tls.Config) (error, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn := tls.Server(serverConn, server)
+		err := conn.Handshake()
+		// закрываем соединение, чтобы клиент узнал об отказе
+		conn.Close()
+		serverErr <- err
+	}()
+
+	conn := tls.Client(clientConn, client)
+	clientErr := conn.Handshake()
+	if clientErr == nil {
+		// в TLS 1.3 отказ в клиентском сертификате приходит после рукопожатия
+		_, clientErr = conn.Read(make([]byte, 1))
+		if errors.Is(clientErr, io.EOF) {
+			clientErr = nil
+		}
+	}
+	conn.Close()
+	return <-serverErr, clientErr
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, 0)
+	serverCert := newTestCert(t, "orchestrator", ca, x509.ExtKeyUsageServerAuth)
+	agentCert := newTestCert(t, "agent", ca, x509.ExtKeyUsageClientAuth)
+
+	otherCA := newTestCert(t, "other-ca", nil, 0)
+	impostor := newTestCert(t, "impostor", otherCA, x509.ExtKeyUsageClientAuth)
+
+	server, err := ServerTLSConfig(serverCert.certFile, serverCert.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatalf("Failed to load server config: %v", err)
+	}
+	if server.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("Client CA should enable client certificate verification")
+	}
+
+	testCases := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		ok       bool
+	}{
+		{"Agent with certificate", agentCert.certFile, agentCert.keyFile, true},
+		{"Agent without certificate", "", "", false},
+		{"Certificate from another CA", impostor.certFile, impostor.keyFile, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := ClientTLSConfig(ca.certFile, tc.certFile, tc.keyFile, "localhost")
+			if err != nil {
+				t.Fatalf("Failed to load client config: %v", err)
+			}
+
+			serverErr, _ := handshake(server, client)
+			if tc.ok && serverErr != nil {
+				t.Errorf("Expected handshake to succeed, got %v", serverErr)
+			}
+			if !tc.ok && serverErr == nil {
+				t.Error("Expected server to reject the client")
+			}
+		})
+	}
+}
+
+func TestServerTLSWithoutClientCA(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, 0)
+	serverCert := newTestCert(t, "orchestrator", ca, x509.ExtKeyUsageServerAuth)
+	otherCA := newTestCert(t, "other-ca", nil, 0)
+
+	server, err := ServerTLSConfig(serverCert.certFile, serverCert.keyFile, "")
+	if err != nil {
+		t.Fatalf("Failed to load server config: %v", err)
+	}
+	if server.ClientAuth != tls.NoClientCert {
+		t.Errorf("Client certificates should not be required without a client CA")
+	}
+
+	client, _ := ClientTLSConfig(ca.certFile, "", "", "localhost")
+	if serverErr, clientErr := handshake(server, client); serverErr != nil || clientErr != nil {
+		t.Errorf("Expected TLS without client certificate to work, got %v / %v", serverErr, clientErr)
+	}
+
+	// агент не доверяет серверу, подписанному чужим CA
+	untrusting, _ := ClientTLSConfig(otherCA.certFile, "", "", "localhost")
+	if _, clientErr := handshake(server, untrusting); clientErr == nil {
+		t.Error("Expected client to reject an untrusted server certificate")
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, 0)
+
+	if _, err := ServerTLSConfig("missing.crt", "missing.key", ""); err == nil {
+		t.Error("Expected error for missing server certificate")
+	}
+	if _, err := ClientTLSConfig("missing.crt", "", "", ""); err == nil {
+		t.Error("Expected error for missing CA file")
+	}
+	if _, err := ClientTLSConfig("", ca.certFile, "", ""); err == nil {
+		t.Error("Expected error for client certificate without key")
+	}
+
+	// ключ вместо сертификата — в файле нет ни одного сертификата
+	if _, err := ClientTLSConfig(ca.keyFile, "", "", ""); err == nil {
+		t.Error("Expected error for CA file without certificates")
+	}
+}
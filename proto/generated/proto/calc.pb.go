@@ -23,6 +23,7 @@ const (
 
 type TaskRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"` // агент, запрашивающий задачу
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -57,6 +58,13 @@ func (*TaskRequest) Descriptor() ([]byte, []int) {
 	return file_proto_calc_proto_rawDescGZIP(), []int{0}
 }
 
+func (x *TaskRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
 // Задача от аркестратора
 type Task struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -66,6 +74,9 @@ type Task struct {
 	Operation     string                 `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
 	OperationTime int32                  `protobuf:"varint,5,opt,name=operation_time,json=operationTime,proto3" json:"operation_time,omitempty"`
 	HasTask       bool                   `protobuf:"varint,6,opt,name=has_task,json=hasTask,proto3" json:"has_task,omitempty"`
+	LeaseMs       int32                  `protobuf:"varint,7,opt,name=lease_ms,json=leaseMs,proto3" json:"lease_ms,omitempty"` // сколько мс задача закреплена за агентом
+	Args          []float64              `protobuf:"fixed64,8,rep,packed,name=args,proto3" json:"args,omitempty"`              // все аргументы операции; arg1 и arg2 повторяют первые два для старых агентов
+	Cancelled     bool                   `protobuf:"varint,9,opt,name=cancelled,proto3" json:"cancelled,omitempty"`            // в потоке задач: выражение отменено, задачу id нужно бросить
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -142,11 +153,34 @@ func (x *Task) GetHasTask() bool {
 	return false
 }
 
+func (x *Task) GetLeaseMs() int32 {
+	if x != nil {
+		return x.LeaseMs
+	}
+	return 0
+}
+
+func (x *Task) GetArgs() []float64 {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *Task) GetCancelled() bool {
+	if x != nil {
+		return x.Cancelled
+	}
+	return false
+}
+
 // Результат от агента
 type TaskResult struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Id            int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
 	Result        float64                `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
+	AgentId       string                 `protobuf:"bytes,3,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Error         string                 `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"` // агент не смог выполнить операцию, result не заполнен
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -195,6 +229,20 @@ func (x *TaskResult) GetResult() float64 {
 	return 0
 }
 
+func (x *TaskResult) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *TaskResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
 type TaskResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
@@ -239,29 +287,416 @@ func (x *TaskResponse) GetSuccess() bool {
 	return false
 }
 
+// Продление аренды задачи агентом
+type TaskLease struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	AgentId       string                 `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TaskLease) Reset() {
+	*x = TaskLease{}
+	mi := &file_proto_calc_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TaskLease) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TaskLease) ProtoMessage() {}
+
+func (x *TaskLease) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_calc_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TaskLease.ProtoReflect.Descriptor instead.
+func (*TaskLease) Descriptor() ([]byte, []int) {
+	return file_proto_calc_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *TaskLease) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *TaskLease) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+// Сведения об агенте при регистрации
+type AgentInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Hostname      string                 `protobuf:"bytes,2,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Workers       int32                  `protobuf:"varint,3,opt,name=workers,proto3" json:"workers,omitempty"`
+	Operations    []string               `protobuf:"bytes,4,rep,name=operations,proto3" json:"operations,omitempty"` // поддерживаемые операции
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentInfo) Reset() {
+	*x = AgentInfo{}
+	mi := &file_proto_calc_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentInfo) ProtoMessage() {}
+
+func (x *AgentInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_calc_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentInfo.ProtoReflect.Descriptor instead.
+func (*AgentInfo) Descriptor() ([]byte, []int) {
+	return file_proto_calc_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *AgentInfo) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *AgentInfo) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *AgentInfo) GetWorkers() int32 {
+	if x != nil {
+		return x.Workers
+	}
+	return 0
+}
+
+func (x *AgentInfo) GetOperations() []string {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+type AgentHeartbeat struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentHeartbeat) Reset() {
+	*x = AgentHeartbeat{}
+	mi := &file_proto_calc_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentHeartbeat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentHeartbeat) ProtoMessage() {}
+
+func (x *AgentHeartbeat) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_calc_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentHeartbeat.ProtoReflect.Descriptor instead.
+func (*AgentHeartbeat) Descriptor() ([]byte, []int) {
+	return file_proto_calc_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *AgentHeartbeat) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+type AgentResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`                            // false — оркестратор не знает агента, нужно зарегистрироваться заново
+	HeartbeatMs   int32                  `protobuf:"varint,2,opt,name=heartbeat_ms,json=heartbeatMs,proto3" json:"heartbeat_ms,omitempty"` // как часто агент должен присылать heartbeat
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentResponse) Reset() {
+	*x = AgentResponse{}
+	mi := &file_proto_calc_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentResponse) ProtoMessage() {}
+
+func (x *AgentResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_calc_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentResponse.ProtoReflect.Descriptor instead.
+func (*AgentResponse) Descriptor() ([]byte, []int) {
+	return file_proto_calc_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *AgentResponse) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *AgentResponse) GetHeartbeatMs() int32 {
+	if x != nil {
+		return x.HeartbeatMs
+	}
+	return 0
+}
+
+// Агент сообщает, сколько задач готов принять ещё
+type AgentCapacity struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Free          int32                  `protobuf:"varint,2,opt,name=free,proto3" json:"free,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentCapacity) Reset() {
+	*x = AgentCapacity{}
+	mi := &file_proto_calc_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentCapacity) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentCapacity) ProtoMessage() {}
+
+func (x *AgentCapacity) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_calc_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentCapacity.ProtoReflect.Descriptor instead.
+func (*AgentCapacity) Descriptor() ([]byte, []int) {
+	return file_proto_calc_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *AgentCapacity) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *AgentCapacity) GetFree() int32 {
+	if x != nil {
+		return x.Free
+	}
+	return 0
+}
+
+// Сообщение агента в потоке задач
+type AgentMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Payload:
+	//
+	//	*AgentMessage_Capacity
+	//	*AgentMessage_Result
+	Payload       isAgentMessage_Payload `protobuf_oneof:"payload"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentMessage) Reset() {
+	*x = AgentMessage{}
+	mi := &file_proto_calc_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentMessage) ProtoMessage() {}
+
+func (x *AgentMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_calc_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentMessage.ProtoReflect.Descriptor instead.
+func (*AgentMessage) Descriptor() ([]byte, []int) {
+	return file_proto_calc_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *AgentMessage) GetPayload() isAgentMessage_Payload {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *AgentMessage) GetCapacity() *AgentCapacity {
+	if x != nil {
+		if x, ok := x.Payload.(*AgentMessage_Capacity); ok {
+			return x.Capacity
+		}
+	}
+	return nil
+}
+
+func (x *AgentMessage) GetResult() *TaskResult {
+	if x != nil {
+		if x, ok := x.Payload.(*AgentMessage_Result); ok {
+			return x.Result
+		}
+	}
+	return nil
+}
+
+type isAgentMessage_Payload interface {
+	isAgentMessage_Payload()
+}
+
+type AgentMessage_Capacity struct {
+	Capacity *AgentCapacity `protobuf:"bytes,1,opt,name=capacity,proto3,oneof"`
+}
+
+type AgentMessage_Result struct {
+	Result *TaskResult `protobuf:"bytes,2,opt,name=result,proto3,oneof"`
+}
+
+func (*AgentMessage_Capacity) isAgentMessage_Payload() {}
+
+func (*AgentMessage_Result) isAgentMessage_Payload() {}
+
 var File_proto_calc_proto protoreflect.FileDescriptor
 
 const file_proto_calc_proto_rawDesc = "" +
 	"\n" +
 	"\x10proto/calc.proto\x12\n" +
-	"calculator\"\r\n" +
-	"\vTaskRequest\"\x9e\x01\n" +
+	"calculator\"(\n" +
+	"\vTaskRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"\xeb\x01\n" +
 	"\x04Task\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x12\n" +
 	"\x04arg1\x18\x02 \x01(\x01R\x04arg1\x12\x12\n" +
 	"\x04arg2\x18\x03 \x01(\x01R\x04arg2\x12\x1c\n" +
 	"\toperation\x18\x04 \x01(\tR\toperation\x12%\n" +
 	"\x0eoperation_time\x18\x05 \x01(\x05R\roperationTime\x12\x19\n" +
-	"\bhas_task\x18\x06 \x01(\bR\ahasTask\"4\n" +
+	"\bhas_task\x18\x06 \x01(\bR\ahasTask\x12\x19\n" +
+	"\blease_ms\x18\a \x01(\x05R\aleaseMs\x12\x12\n" +
+	"\x04args\x18\b \x03(\x01R\x04args\x12\x1c\n" +
+	"\tcancelled\x18\t \x01(\bR\tcancelled\"e\n" +
 	"\n" +
 	"TaskResult\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x16\n" +
-	"\x06result\x18\x02 \x01(\x01R\x06result\"(\n" +
+	"\x06result\x18\x02 \x01(\x01R\x06result\x12\x19\n" +
+	"\bagent_id\x18\x03 \x01(\tR\aagentId\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\"(\n" +
 	"\fTaskResponse\x12\x18\n" +
-	"\asuccess\x18\x01 \x01(\bR\asuccess2\x87\x01\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\"6\n" +
+	"\tTaskLease\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\"|\n" +
+	"\tAgentInfo\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1a\n" +
+	"\bhostname\x18\x02 \x01(\tR\bhostname\x12\x18\n" +
+	"\aworkers\x18\x03 \x01(\x05R\aworkers\x12\x1e\n" +
+	"\n" +
+	"operations\x18\x04 \x03(\tR\n" +
+	"operations\"+\n" +
+	"\x0eAgentHeartbeat\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\"L\n" +
+	"\rAgentResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\x12!\n" +
+	"\fheartbeat_ms\x18\x02 \x01(\x05R\vheartbeatMs\">\n" +
+	"\rAgentCapacity\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x12\n" +
+	"\x04free\x18\x02 \x01(\x05R\x04free\"\x84\x01\n" +
+	"\fAgentMessage\x127\n" +
+	"\bcapacity\x18\x01 \x01(\v2\x19.calculator.AgentCapacityH\x00R\bcapacity\x120\n" +
+	"\x06result\x18\x02 \x01(\v2\x16.calculator.TaskResultH\x00R\x06resultB\t\n" +
+	"\apayload2\x8c\x03\n" +
 	"\vTaskService\x124\n" +
 	"\aGetTask\x12\x17.calculator.TaskRequest\x1a\x10.calculator.Task\x12B\n" +
-	"\x0eSendTaskResult\x12\x16.calculator.TaskResult\x1a\x18.calculator.TaskResponseB;Z9github.com/Oleg-Neevin/distributed_calculator_final/protob\x06proto3"
+	"\x0eSendTaskResult\x12\x16.calculator.TaskResult\x1a\x18.calculator.TaskResponse\x12>\n" +
+	"\vExtendLease\x12\x15.calculator.TaskLease\x1a\x18.calculator.TaskResponse\x12A\n" +
+	"\rRegisterAgent\x12\x15.calculator.AgentInfo\x1a\x19.calculator.AgentResponse\x12B\n" +
+	"\tHeartbeat\x12\x1a.calculator.AgentHeartbeat\x1a\x19.calculator.AgentResponse\x12<\n" +
+	"\n" +
+	"TaskStream\x12\x18.calculator.AgentMessage\x1a\x10.calculator.Task(\x010\x01B;Z9github.com/Oleg-Neevin/distributed_calculator_final/protob\x06proto3"
 
 var (
 	file_proto_calc_proto_rawDescOnce sync.Once
@@ -275,23 +710,39 @@ func file_proto_calc_proto_rawDescGZIP() []byte {
 	return file_proto_calc_proto_rawDescData
 }
 
-var file_proto_calc_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_proto_calc_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
 var file_proto_calc_proto_goTypes = []any{
-	(*TaskRequest)(nil),  // 0: calculator.TaskRequest
-	(*Task)(nil),         // 1: calculator.Task
-	(*TaskResult)(nil),   // 2: calculator.TaskResult
-	(*TaskResponse)(nil), // 3: calculator.TaskResponse
+	(*TaskRequest)(nil),    // 0: calculator.TaskRequest
+	(*Task)(nil),           // 1: calculator.Task
+	(*TaskResult)(nil),     // 2: calculator.TaskResult
+	(*TaskResponse)(nil),   // 3: calculator.TaskResponse
+	(*TaskLease)(nil),      // 4: calculator.TaskLease
+	(*AgentInfo)(nil),      // 5: calculator.AgentInfo
+	(*AgentHeartbeat)(nil), // 6: calculator.AgentHeartbeat
+	(*AgentResponse)(nil),  // 7: calculator.AgentResponse
+	(*AgentCapacity)(nil),  // 8: calculator.AgentCapacity
+	(*AgentMessage)(nil),   // 9: calculator.AgentMessage
 }
 var file_proto_calc_proto_depIdxs = []int32{
-	0, // 0: calculator.TaskService.GetTask:input_type -> calculator.TaskRequest
-	2, // 1: calculator.TaskService.SendTaskResult:input_type -> calculator.TaskResult
-	1, // 2: calculator.TaskService.GetTask:output_type -> calculator.Task
-	3, // 3: calculator.TaskService.SendTaskResult:output_type -> calculator.TaskResponse
-	2, // [2:4] is the sub-list for method output_type
-	0, // [0:2] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	8, // 0: calculator.AgentMessage.capacity:type_name -> calculator.AgentCapacity
+	2, // 1: calculator.AgentMessage.result:type_name -> calculator.TaskResult
+	0, // 2: calculator.TaskService.GetTask:input_type -> calculator.TaskRequest
+	2, // 3: calculator.TaskService.SendTaskResult:input_type -> calculator.TaskResult
+	4, // 4: calculator.TaskService.ExtendLease:input_type -> calculator.TaskLease
+	5, // 5: calculator.TaskService.RegisterAgent:input_type -> calculator.AgentInfo
+	6, // 6: calculator.TaskService.Heartbeat:input_type -> calculator.AgentHeartbeat
+	9, // 7: calculator.TaskService.TaskStream:input_type -> calculator.AgentMessage
+	1, // 8: calculator.TaskService.GetTask:output_type -> calculator.Task
+	3, // 9: calculator.TaskService.SendTaskResult:output_type -> calculator.TaskResponse
+	3, // 10: calculator.TaskService.ExtendLease:output_type -> calculator.TaskResponse
+	7, // 11: calculator.TaskService.RegisterAgent:output_type -> calculator.AgentResponse
+	7, // 12: calculator.TaskService.Heartbeat:output_type -> calculator.AgentResponse
+	1, // 13: calculator.TaskService.TaskStream:output_type -> calculator.Task
+	8, // [8:14] is the sub-list for method output_type
+	2, // [2:8] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
 }
 
 func init() { file_proto_calc_proto_init() }
@@ -299,13 +750,17 @@ func file_proto_calc_proto_init() {
 	if File_proto_calc_proto != nil {
 		return
 	}
+	file_proto_calc_proto_msgTypes[9].OneofWrappers = []any{
+		(*AgentMessage_Capacity)(nil),
+		(*AgentMessage_Result)(nil),
+	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_calc_proto_rawDesc), len(file_proto_calc_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   10,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -316,4 +771,4 @@ func file_proto_calc_proto_init() {
 	File_proto_calc_proto = out.File
 	file_proto_calc_proto_goTypes = nil
 	file_proto_calc_proto_depIdxs = nil
-}
\ No newline at end of file
+}
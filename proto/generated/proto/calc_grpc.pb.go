@@ -21,6 +21,10 @@ const _ = grpc.SupportPackageIsVersion9
 const (
 	TaskService_GetTask_FullMethodName        = "/calculator.TaskService/GetTask"
 	TaskService_SendTaskResult_FullMethodName = "/calculator.TaskService/SendTaskResult"
+	TaskService_ExtendLease_FullMethodName    = "/calculator.TaskService/ExtendLease"
+	TaskService_RegisterAgent_FullMethodName  = "/calculator.TaskService/RegisterAgent"
+	TaskService_Heartbeat_FullMethodName      = "/calculator.TaskService/Heartbeat"
+	TaskService_TaskStream_FullMethodName     = "/calculator.TaskService/TaskStream"
 )
 
 // TaskServiceClient is the client API for TaskService service.
@@ -33,6 +37,15 @@ type TaskServiceClient interface {
 	GetTask(ctx context.Context, in *TaskRequest, opts ...grpc.CallOption) (*Task, error)
 	// Отправка результата выполнения задачи
 	SendTaskResult(ctx context.Context, in *TaskResult, opts ...grpc.CallOption) (*TaskResponse, error)
+	// Продление аренды задачи, пока агент её считает
+	ExtendLease(ctx context.Context, in *TaskLease, opts ...grpc.CallOption) (*TaskResponse, error)
+	// Регистрация агента при запуске
+	RegisterAgent(ctx context.Context, in *AgentInfo, opts ...grpc.CallOption) (*AgentResponse, error)
+	// Периодический сигнал, что агент жив
+	Heartbeat(ctx context.Context, in *AgentHeartbeat, opts ...grpc.CallOption) (*AgentResponse, error)
+	// Поток задач: агент объявляет свободные места и присылает результаты,
+	// оркестратор отправляет задачи, как только они появляются в очереди
+	TaskStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AgentMessage, Task], error)
 }
 
 type taskServiceClient struct {
@@ -63,6 +76,49 @@ func (c *taskServiceClient) SendTaskResult(ctx context.Context, in *TaskResult,
 	return out, nil
 }
 
+func (c *taskServiceClient) ExtendLease(ctx context.Context, in *TaskLease, opts ...grpc.CallOption) (*TaskResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TaskResponse)
+	err := c.cc.Invoke(ctx, TaskService_ExtendLease_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskServiceClient) RegisterAgent(ctx context.Context, in *AgentInfo, opts ...grpc.CallOption) (*AgentResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AgentResponse)
+	err := c.cc.Invoke(ctx, TaskService_RegisterAgent_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskServiceClient) Heartbeat(ctx context.Context, in *AgentHeartbeat, opts ...grpc.CallOption) (*AgentResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AgentResponse)
+	err := c.cc.Invoke(ctx, TaskService_Heartbeat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *taskServiceClient) TaskStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AgentMessage, Task], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &TaskService_ServiceDesc.Streams[0], TaskService_TaskStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AgentMessage, Task]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type TaskService_TaskStreamClient = grpc.BidiStreamingClient[AgentMessage, Task]
+
 // TaskServiceServer is the server API for TaskService service.
 // All implementations must embed UnimplementedTaskServiceServer
 // for forward compatibility.
@@ -73,6 +129,15 @@ type TaskServiceServer interface {
 	GetTask(context.Context, *TaskRequest) (*Task, error)
 	// Отправка результата выполнения задачи
 	SendTaskResult(context.Context, *TaskResult) (*TaskResponse, error)
+	// Продление аренды задачи, пока агент её считает
+	ExtendLease(context.Context, *TaskLease) (*TaskResponse, error)
+	// Регистрация агента при запуске
+	RegisterAgent(context.Context, *AgentInfo) (*AgentResponse, error)
+	// Периодический сигнал, что агент жив
+	Heartbeat(context.Context, *AgentHeartbeat) (*AgentResponse, error)
+	// Поток задач: агент объявляет свободные места и присылает результаты,
+	// оркестратор отправляет задачи, как только они появляются в очереди
+	TaskStream(grpc.BidiStreamingServer[AgentMessage, Task]) error
 	mustEmbedUnimplementedTaskServiceServer()
 }
 
@@ -89,6 +154,18 @@ func (UnimplementedTaskServiceServer) GetTask(context.Context, *TaskRequest) (*T
 func (UnimplementedTaskServiceServer) SendTaskResult(context.Context, *TaskResult) (*TaskResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SendTaskResult not implemented")
 }
+func (UnimplementedTaskServiceServer) ExtendLease(context.Context, *TaskLease) (*TaskResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExtendLease not implemented")
+}
+func (UnimplementedTaskServiceServer) RegisterAgent(context.Context, *AgentInfo) (*AgentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterAgent not implemented")
+}
+func (UnimplementedTaskServiceServer) Heartbeat(context.Context, *AgentHeartbeat) (*AgentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedTaskServiceServer) TaskStream(grpc.BidiStreamingServer[AgentMessage, Task]) error {
+	return status.Errorf(codes.Unimplemented, "method TaskStream not implemented")
+}
 func (UnimplementedTaskServiceServer) mustEmbedUnimplementedTaskServiceServer() {}
 func (UnimplementedTaskServiceServer) testEmbeddedByValue()                     {}
 
@@ -146,6 +223,67 @@ func _TaskService_SendTaskResult_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _TaskService_ExtendLease_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskLease)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskServiceServer).ExtendLease(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TaskService_ExtendLease_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskServiceServer).ExtendLease(ctx, req.(*TaskLease))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TaskService_RegisterAgent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentInfo)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskServiceServer).RegisterAgent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TaskService_RegisterAgent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskServiceServer).RegisterAgent(ctx, req.(*AgentInfo))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TaskService_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentHeartbeat)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TaskServiceServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TaskService_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TaskServiceServer).Heartbeat(ctx, req.(*AgentHeartbeat))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TaskService_TaskStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TaskServiceServer).TaskStream(&grpc.GenericServerStream[AgentMessage, Task]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type TaskService_TaskStreamServer = grpc.BidiStreamingServer[AgentMessage, Task]
+
 // TaskService_ServiceDesc is the grpc.ServiceDesc for TaskService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -161,7 +299,26 @@ var TaskService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SendTaskResult",
 			Handler:    _TaskService_SendTaskResult_Handler,
 		},
+		{
+			MethodName: "ExtendLease",
+			Handler:    _TaskService_ExtendLease_Handler,
+		},
+		{
+			MethodName: "RegisterAgent",
+			Handler:    _TaskService_RegisterAgent_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _TaskService_Heartbeat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TaskStream",
+			Handler:       _TaskService_TaskStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/calc.proto",
-}
\ No newline at end of file
+}